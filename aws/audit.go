@@ -0,0 +1,124 @@
+package aws
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/sirupsen/logrus"
+
+	"github.com/justenwalker/awsnycast/clock"
+)
+
+// Why a route was changed (or would have been).
+const (
+	ReasonNoRoute           = "no_route"           // There was no route, so we created one
+	ReasonLocalHealthcheck  = "local_healthcheck"  // Our healthcheck for the route failed
+	ReasonRemoteHealthcheck = "remote_healthcheck" // The remote healthcheck of the instance holding it failed
+	ReasonInstanceImpaired  = "instance_impaired"  // EC2 says the instance holding it is impaired
+	ReasonInstanceGone      = "instance_gone"      // EC2 doesn't know the instance holding it (e.g. terminated)
+	ReasonRouteBlackhole    = "route_blackhole"    // The route's target has gone away
+	ReasonPeerUnhealthy     = "peer_unhealthy"     // The instance holding it told us over gossip that it is unhealthy
+	ReasonAddressMissing    = "address_missing"    // The route's address isn't on any local interface
+	ReasonDrain             = "drain"              // We are handing our routes over, as we're going away
+	ReasonManual            = "manual"             // The route is set to always be ours (no if_unhealthy)
+)
+
+// Actions taken on a route. A skip is a change which wasn't made as the route is never_delete.
+const (
+	ActionCreate  = "create"
+	ActionReplace = "replace"
+	ActionDelete  = "delete"
+	ActionSkip    = "skip"
+)
+
+// AuditEntry is one line of the audit log.
+type AuditEntry struct {
+	Time             time.Time `json:"time"`
+	RouteTable       string    `json:"route_table"`
+	Cidr             string    `json:"cidr"`
+	Action           string    `json:"action"`
+	PreviousTarget   string    `json:"previous_target,omitempty"`
+	NewTarget        string    `json:"new_target,omitempty"`
+	NetworkInterface string    `json:"network_interface,omitempty"`
+	Reason           string    `json:"reason"`
+	DryRun           bool      `json:"dry_run"`
+	Result           string    `json:"result"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// AuditLog records every change made to routes, as JSON Lines appended to a file.
+type AuditLog struct {
+	clock clock.Clock
+	sync.Mutex
+	file *os.File
+}
+
+// NewAuditLog appends to the file at path, creating it if need be.
+func NewAuditLog(path string, c clock.Clock) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{clock: c, file: f}, nil
+}
+
+// auditResult is what happened: skipped (as the route is never_delete), refused (by the
+// safety limits), or for the API call that made the change ok, dry_run (it would have
+// worked, but this was a dry run) or error.
+func auditResult(action string, err error) string {
+	if action == ActionSkip {
+		return "skipped"
+	}
+	if err == nil {
+		return "ok"
+	}
+	var refused RefusedError
+	if errors.As(err, &refused) {
+		return "refused"
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "DryRunOperation" {
+		return "dry_run"
+	}
+	return "error"
+}
+
+// Record adds an entry (timestamped now) for a change, and what came of the API call
+// which made it.
+func (a *AuditLog) Record(e AuditEntry, err error) {
+	if a == nil {
+		return
+	}
+	e.Time = a.clock.Now().UTC()
+	e.Result = auditResult(e.Action, err)
+	if e.Result == "error" || e.Result == "refused" {
+		e.Error = err.Error()
+	}
+	line, merr := json.Marshal(e)
+	if merr != nil {
+		log.WithFields(logrus.Fields{"err": merr.Error()}).Error("Could not encode audit log entry")
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	_, werr := a.file.Write(append(line, '\n'))
+	if werr == nil {
+		werr = a.file.Sync()
+	}
+	if werr != nil {
+		log.WithFields(logrus.Fields{"err": werr.Error(), "entry": string(line)}).Error("Could not write to audit log")
+	}
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	return a.file.Close()
+}
@@ -0,0 +1,225 @@
+package aws
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/justenwalker/awsnycast/clock"
+	"github.com/justenwalker/awsnycast/ec2sim"
+)
+
+var auditStart = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// getAuditedSim is a simulated failover setup whose manager writes to an audit log.
+func getAuditedSim(t *testing.T) (*ec2sim.EC2, *RouteTableManagerEC2, string) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := NewAuditLog(path, clock.NewFake(auditStart))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.Close() })
+	sim := getSimFailover(t)
+	rtm := NewRouteTableManagerEC2WithAPI(sim)
+	rtm.Audit = audit
+	return sim, rtm, path
+}
+
+func readAudit(t *testing.T, path string) []AuditEntry {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries := make([]AuditEntry, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditReplaceImpaired(t *testing.T) {
+	sim, rtm, path := getAuditedSim(t)
+	sim.SetInstanceStatus("i-primary", ec2type.SummaryStatusImpaired, ec2type.SummaryStatusOk)
+	assert.Nil(t, manageSimRoute(t, rtm, "i-backup1", false))
+	entries := readAudit(t, path)
+	if assert.Equal(t, len(entries), 1) {
+		assert.Equal(t, entries[0], AuditEntry{
+			Time:             auditStart,
+			RouteTable:       "rtb-1",
+			Cidr:             "0.0.0.0/0",
+			Action:           ActionReplace,
+			PreviousTarget:   "i-primary",
+			NewTarget:        "i-backup1",
+			NetworkInterface: "eni-backup1",
+			Reason:           ReasonInstanceImpaired,
+			Result:           "ok",
+		})
+	}
+}
+
+func TestAuditNothingToDo(t *testing.T) {
+	_, rtm, path := getAuditedSim(t)
+	assert.Nil(t, manageSimRoute(t, rtm, "i-backup1", false))
+	assert.Nil(t, manageSimRoute(t, rtm, "i-primary", false))
+	assert.Equal(t, len(readAudit(t, path)), 0)
+}
+
+func TestAuditReplaceBlackholeDryRun(t *testing.T) {
+	sim, rtm, path := getAuditedSim(t)
+	sim.SetInstanceState("i-primary", ec2type.InstanceStateNameStopped)
+	assert.NotNil(t, manageSimRoute(t, rtm, "i-backup1", true))
+	entries := readAudit(t, path)
+	if assert.Equal(t, len(entries), 1) {
+		assert.Equal(t, entries[0].Reason, ReasonRouteBlackhole)
+		assert.Equal(t, entries[0].DryRun, true)
+		assert.Equal(t, entries[0].Result, "dry_run")
+		assert.Equal(t, entries[0].Error, "")
+	}
+}
+
+func TestAuditReplaceTerminatedFails(t *testing.T) {
+	sim, rtm, path := getAuditedSim(t)
+	sim.SetInstanceState("i-primary", ec2type.InstanceStateNameTerminated)
+	sim.FailNext("ReplaceRoute", errors.New("UnauthorizedOperation: not allowed"))
+	assert.NotNil(t, manageSimRoute(t, rtm, "i-backup1", false))
+	entries := readAudit(t, path)
+	if assert.Equal(t, len(entries), 1) {
+		assert.Equal(t, entries[0].Reason, ReasonRouteBlackhole)
+		assert.Equal(t, entries[0].Result, "error")
+		assert.Contains(t, entries[0].Error, "UnauthorizedOperation")
+	}
+}
+
+func TestAuditManualReplace(t *testing.T) {
+	_, rtm, path := getAuditedSim(t)
+	tables, err := rtm.GetRouteTables(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, rtm.ManageInstanceRoute(context.Background(), tables[0], ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-backup2"}, false))
+	entries := readAudit(t, path)
+	if assert.Equal(t, len(entries), 1) {
+		assert.Equal(t, entries[0].Reason, ReasonManual)
+		assert.Equal(t, entries[0].NewTarget, "i-backup2")
+	}
+}
+
+func TestAuditCreateAndDelete(t *testing.T) {
+	sim, rtm, path := getAuditedSim(t)
+	ctx := context.Background()
+	sim.AddRouteTable("rtb-2", "vpc-1", "10.0.0.0/16", nil)
+	tables, _ := rtm.GetRouteTables(ctx)
+	hc := &FakeHealthCheck{isHealthy: true}
+	rs := ManageRoutesSpec{Cidr: "192.168.0.0/24", Instance: "i-backup1", HealthcheckName: "service", healthcheck: hc}
+	assert.Nil(t, rtm.ManageInstanceRoute(ctx, tables[1], rs, false))
+
+	hc.isHealthy = false
+	tables, _ = rtm.GetRouteTables(ctx)
+	assert.Nil(t, rtm.ManageInstanceRoute(ctx, tables[1], rs, false))
+
+	entries := readAudit(t, path)
+	if assert.Equal(t, len(entries), 2) {
+		assert.Equal(t, entries[0].Action, ActionCreate)
+		assert.Equal(t, entries[0].RouteTable, "rtb-2")
+		assert.Equal(t, entries[0].Reason, ReasonNoRoute)
+		assert.Equal(t, entries[0].NewTarget, "i-backup1")
+		assert.Equal(t, entries[1].Action, ActionDelete)
+		assert.Equal(t, entries[1].Reason, ReasonLocalHealthcheck)
+		assert.Equal(t, entries[1].PreviousTarget, "i-backup1")
+		assert.Equal(t, entries[1].Result, "ok")
+	}
+}
+
+func TestAuditNeverDeleteSkipped(t *testing.T) {
+	_, rtm, path := getAuditedSim(t)
+	tables, _ := rtm.GetRouteTables(context.Background())
+	rs := ManageRoutesSpec{
+		Cidr:            "0.0.0.0/0",
+		Instance:        "i-primary",
+		HealthcheckName: "service",
+		healthcheck:     &FakeHealthCheck{isHealthy: false},
+		NeverDelete:     true,
+	}
+	assert.Nil(t, rtm.ManageInstanceRoute(context.Background(), tables[0], rs, false))
+	entries := readAudit(t, path)
+	if assert.Equal(t, len(entries), 1) {
+		assert.Equal(t, entries[0].Action, ActionSkip)
+		assert.Equal(t, entries[0].Reason, ReasonLocalHealthcheck)
+		assert.Equal(t, entries[0].Result, "skipped")
+	}
+}
+
+func TestAuditDrain(t *testing.T) {
+	_, rtm, path := getAuditedSim(t)
+	tables, _ := rtm.GetRouteTables(context.Background())
+	d := &Drain{}
+	d.Start("spot interruption")
+	rs := ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-primary"}
+	rs.SetDrain(d)
+	assert.Nil(t, rtm.ManageInstanceRoute(context.Background(), tables[0], rs, false))
+	entries := readAudit(t, path)
+	if assert.Equal(t, len(entries), 1) {
+		assert.Equal(t, entries[0].Action, ActionDelete)
+		assert.Equal(t, entries[0].Reason, ReasonDrain)
+	}
+}
+
+type fakeRouteNotifier struct {
+	entries []AuditEntry
+}
+
+func (n *fakeRouteNotifier) RouteChanged(e AuditEntry) {
+	n.entries = append(n.entries, e)
+}
+
+func TestNotifyOnlyMadeChanges(t *testing.T) {
+	sim, rtm, _ := getAuditedSim(t)
+	n := &fakeRouteNotifier{}
+	rtm.Notifier = n
+	sim.SetInstanceState("i-primary", ec2type.InstanceStateNameStopped)
+	assert.NotNil(t, manageSimRoute(t, rtm, "i-backup1", true))
+	sim.FailNext("ReplaceRoute", errors.New("UnauthorizedOperation: not allowed"))
+	assert.NotNil(t, manageSimRoute(t, rtm, "i-backup1", false))
+	assert.Equal(t, len(n.entries), 0)
+	assert.Nil(t, manageSimRoute(t, rtm, "i-backup1", false))
+	if assert.Equal(t, len(n.entries), 1) {
+		assert.Equal(t, n.entries[0].Action, ActionReplace)
+		assert.Equal(t, n.entries[0].Reason, ReasonRouteBlackhole)
+		assert.Equal(t, n.entries[0].NewTarget, "i-backup1")
+	}
+}
+
+func TestAuditAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"action":"create"}`+"\n"), 0640))
+	audit, err := NewAuditLog(path, clock.NewFake(auditStart))
+	if !assert.Nil(t, err) {
+		return
+	}
+	audit.Record(AuditEntry{Action: ActionDelete}, nil)
+	assert.Nil(t, audit.Close())
+	entries := readAudit(t, path)
+	if assert.Equal(t, len(entries), 2) {
+		assert.Equal(t, entries[0].Action, ActionCreate)
+		assert.Equal(t, entries[1].Action, ActionDelete)
+	}
+}
+
+func TestAuditNil(t *testing.T) {
+	var audit *AuditLog
+	audit.Record(AuditEntry{Action: ActionDelete}, nil)
+	assert.Nil(t, audit.Close())
+}
@@ -0,0 +1,55 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+)
+
+type AutoScalingAPI interface {
+	CompleteLifecycleAction(context.Context, *autoscaling.CompleteLifecycleActionInput, ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error)
+	DescribeAutoScalingInstances(context.Context, *autoscaling.DescribeAutoScalingInstancesInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingInstancesOutput, error)
+}
+
+// Lifecycle completes Auto Scaling lifecycle actions, so that an instance being scaled
+// in is only terminated once it has handed its routes over.
+type Lifecycle struct {
+	conn AutoScalingAPI
+}
+
+// NewLifecycle talks to the Auto Scaling API, or to endpoint instead if it is set.
+func NewLifecycle(cfg aws.Config, endpoint string) *Lifecycle {
+	var opts []func(*autoscaling.Options)
+	if endpoint != "" {
+		opts = append(opts, autoscaling.WithEndpointResolver(autoscaling.EndpointResolverFromURL(endpoint)))
+	}
+	return &Lifecycle{conn: autoscaling.NewFromConfig(cfg, opts...)}
+}
+
+// GroupName finds the Auto Scaling group an instance is in.
+func (l *Lifecycle) GroupName(ctx context.Context, instanceID string) (string, error) {
+	out, err := l.conn.DescribeAutoScalingInstances(ctx, &autoscaling.DescribeAutoScalingInstancesInput{
+		InstanceIds: []string{instanceID},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(out.AutoScalingInstances) != 1 || out.AutoScalingInstances[0].AutoScalingGroupName == nil {
+		return "", errors.New(fmt.Sprintf("Instance %s is not in an Auto Scaling group", instanceID))
+	}
+	return *out.AutoScalingInstances[0].AutoScalingGroupName, nil
+}
+
+// Complete tells Auto Scaling to carry on with the lifecycle action for an instance.
+func (l *Lifecycle) Complete(ctx context.Context, group string, hook string, instanceID string) error {
+	_, err := l.conn.CompleteLifecycleAction(ctx, &autoscaling.CompleteLifecycleActionInput{
+		AutoScalingGroupName:  aws.String(group),
+		LifecycleHookName:     aws.String(hook),
+		InstanceId:            aws.String(instanceID),
+		LifecycleActionResult: aws.String("CONTINUE"),
+	})
+	return err
+}
@@ -0,0 +1,226 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+
+	"github.com/justenwalker/awsnycast/clock"
+)
+
+// Damping is BGP-style route flap damping for a manage_routes entry. Each time the route
+// in a route table moves to or from this instance it gets a penalty, which halves every
+// half_life. While the penalty is over suppress, we won't take the route from a healthy
+// instance (we still will when the route is missing or its instance has failed), until it
+// has decayed below reuse. Penalty is a pointer so that an explicit 0, which never
+// suppresses the route, isn't replaced by the default.
+type Damping struct {
+	Penalty     *float64 `yaml:"penalty"`
+	Suppress    float64  `yaml:"suppress"`
+	Reuse       float64  `yaml:"reuse"`
+	HalfLife    uint     `yaml:"half_life"`
+	MaxSuppress uint     `yaml:"max_suppress"`
+}
+
+func (d *Damping) Validate(name string, cidr string) error {
+	var result *multierror.Error
+	if d.Penalty == nil {
+		penalty := float64(1000)
+		d.Penalty = &penalty
+	}
+	if d.Suppress == 0 {
+		d.Suppress = 2000
+	}
+	if d.Reuse == 0 {
+		d.Reuse = 750
+	}
+	if d.HalfLife == 0 {
+		d.HalfLife = 900
+	}
+	if d.MaxSuppress == 0 {
+		d.MaxSuppress = 3600
+	}
+	if *d.Penalty < 0 || d.Reuse < 0 || d.Reuse >= d.Suppress {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s damping needs 0 <= reuse < suppress, and penalty >= 0", name, cidr)))
+	}
+	return result.ErrorOrNil()
+}
+
+// ceiling is the most penalty can be, so a route is never suppressed for more than
+// max_suppress after it stops flapping.
+func (d *Damping) ceiling() float64 {
+	return d.Reuse * math.Pow(2, float64(d.MaxSuppress)/float64(d.HalfLife))
+}
+
+// DampingStatus is the flap damping and hold state of a route in one route table.
+type DampingStatus struct {
+	Penalty    float64    `json:"penalty"`
+	Suppressed bool       `json:"suppressed"`
+	HeldUntil  *time.Time `json:"held_until,omitempty"`
+}
+
+// routeHistory is what has happened to a route in each route table, for damping and
+// min_hold_time. It is shared by all the copies of a ManageRoutesSpec.
+type routeHistory struct {
+	sync.Mutex
+	clock  clock.Clock
+	tables map[string]*routeTableHistory
+}
+
+type routeTableHistory struct {
+	owned      bool
+	ownedSince time.Time
+	penalty    float64
+	updated    time.Time
+	suppressed bool
+}
+
+func newRouteHistory() *routeHistory {
+	return &routeHistory{clock: clock.Real, tables: make(map[string]*routeTableHistory)}
+}
+
+// table is the history for a route table, which starts with whether we own it now. Must be
+// called with the lock held.
+func (h *routeHistory) table(rtb string, owned bool) *routeTableHistory {
+	t, ok := h.tables[rtb]
+	if !ok {
+		t = &routeTableHistory{owned: owned}
+		h.tables[rtb] = t
+	}
+	return t
+}
+
+// decay brings a route table's penalty up to now, and lifts suppression once it's below
+// reuse. Must be called with the lock held.
+func (h *routeHistory) decay(contextLogger *logrus.Entry, d *Damping, t *routeTableHistory, now time.Time) {
+	if t.penalty > 0 {
+		t.penalty = t.penalty * math.Pow(0.5, now.Sub(t.updated).Seconds()/float64(d.HalfLife))
+	}
+	t.updated = now
+	if t.suppressed && t.penalty < d.Reuse {
+		t.suppressed = false
+		contextLogger.WithFields(logrus.Fields{"penalty": t.penalty}).Info("Route has stopped flapping, no longer suppressed")
+	}
+}
+
+// observe records whether we own the route in a route table as we find it, so that moves
+// made by other instances count too.
+func (h *routeHistory) observe(contextLogger *logrus.Entry, d *Damping, rtb string, owned bool) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	_, known := h.tables[rtb]
+	if !known {
+		h.table(rtb, owned)
+	}
+	h.Unlock()
+	if known {
+		h.moved(contextLogger, d, rtb, owned)
+	}
+}
+
+// moved records the route moving to (or from) this instance in a route table, e.g. because
+// we took it or another instance replaced it.
+func (h *routeHistory) moved(contextLogger *logrus.Entry, d *Damping, rtb string, owned bool) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	now := h.clock.Now()
+	t := h.table(rtb, !owned)
+	if t.owned == owned {
+		return
+	}
+	t.owned = owned
+	t.ownedSince = time.Time{}
+	if owned {
+		t.ownedSince = now
+	}
+	if d == nil {
+		return
+	}
+	h.decay(contextLogger, d, t, now)
+	t.penalty = math.Min(t.penalty+*d.Penalty, d.ceiling())
+	if !t.suppressed && t.penalty > d.Suppress {
+		t.suppressed = true
+		contextLogger.WithFields(logrus.Fields{"penalty": t.penalty}).Warn("Route is flapping, suppressing taking it over")
+	}
+}
+
+// suppressed is true if flap damping stops us taking the route in a route table.
+func (h *routeHistory) suppressed(contextLogger *logrus.Entry, d *Damping, rtb string) bool {
+	if h == nil || d == nil {
+		return false
+	}
+	h.Lock()
+	defer h.Unlock()
+	t, ok := h.tables[rtb]
+	if !ok {
+		return false
+	}
+	h.decay(contextLogger, d, t, h.clock.Now())
+	return t.suppressed
+}
+
+// heldUntil is when we may give up the route in a route table, having taken it.
+func (h *routeHistory) heldUntil(rtb string, hold uint) time.Time {
+	if h == nil || hold == 0 {
+		return time.Time{}
+	}
+	h.Lock()
+	defer h.Unlock()
+	t, ok := h.tables[rtb]
+	if !ok || !t.owned || t.ownedSince.IsZero() {
+		return time.Time{}
+	}
+	return t.ownedSince.Add(time.Duration(hold) * time.Second)
+}
+
+// owns is whether we last saw (or left) the route pointing at us in a route table, and
+// whether we have seen that route table at all.
+func (h *routeHistory) owns(rtb string) (owned bool, known bool) {
+	if h == nil {
+		return false, false
+	}
+	h.Lock()
+	defer h.Unlock()
+	t, ok := h.tables[rtb]
+	if !ok {
+		return false, false
+	}
+	return t.owned, true
+}
+
+// status is the damping and hold state of the route in each route table we've seen.
+func (h *routeHistory) status(d *Damping, hold uint) map[string]DampingStatus {
+	status := make(map[string]DampingStatus)
+	if h == nil {
+		return status
+	}
+	h.Lock()
+	now := h.clock.Now()
+	for rtb, t := range h.tables {
+		s := DampingStatus{}
+		if d != nil {
+			h.decay(log.WithFields(logrus.Fields{"rtb": rtb}), d, t, now)
+			s.Penalty = math.Round(t.penalty)
+			s.Suppressed = t.suppressed
+		}
+		status[rtb] = s
+	}
+	h.Unlock()
+	for rtb, s := range status {
+		if until := h.heldUntil(rtb, hold); until.After(now) {
+			s.HeldUntil = &until
+			status[rtb] = s
+		}
+	}
+	return status
+}
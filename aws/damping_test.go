@@ -0,0 +1,158 @@
+package aws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+
+	"github.com/justenwalker/awsnycast/clock"
+	"github.com/justenwalker/awsnycast/ec2sim"
+)
+
+// getDampedSim is the failover sim, with i-backup1's route spec for 0.0.0.0/0 damped.
+func getDampedSim(t *testing.T, rs *ManageRoutesSpec) (*ec2sim.EC2, *RouteTableManagerEC2, *clock.Fake) {
+	sim := getSimFailover(t)
+	rtm := NewRouteTableManagerEC2WithAPI(sim)
+	c := clock.NewFake(auditStart)
+	rs.Cidr = "0.0.0.0/0"
+	rs.Instance = "i-backup1"
+	if rs.Damping != nil {
+		assert.Nil(t, rs.Damping.Validate("rtb-1", rs.Cidr))
+	}
+	rs.SetClock(c)
+	return sim, rtm, c
+}
+
+// manageDamped runs one pass of route management for rs.
+func manageDamped(t *testing.T, rtm *RouteTableManagerEC2, rs ManageRoutesSpec) {
+	tables, _ := rtm.GetRouteTables(context.Background())
+	assert.Nil(t, rtm.ManageInstanceRoute(context.Background(), tables[0], rs, false))
+}
+
+func penalty(p float64) *float64 {
+	return &p
+}
+
+func TestDampingValidate(t *testing.T) {
+	d := &Damping{}
+	assert.Nil(t, d.Validate("rtb-1", "0.0.0.0/0"))
+	assert.Equal(t, d, &Damping{Penalty: penalty(1000), Suppress: 2000, Reuse: 750, HalfLife: 900, MaxSuppress: 3600})
+	d = &Damping{Suppress: 500}
+	err := d.Validate("rtb-1", "0.0.0.0/0")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Route tables rtb-1, route 0.0.0.0/0 damping needs 0 <= reuse < suppress, and penalty >= 0")
+	}
+}
+
+func TestDampingValidateZeroPenalty(t *testing.T) {
+	var d Damping
+	assert.Nil(t, yaml.Unmarshal([]byte("penalty: 0\n"), &d))
+	assert.Nil(t, d.Validate("rtb-1", "0.0.0.0/0"))
+	assert.Equal(t, *d.Penalty, float64(0))
+
+	rs := ManageRoutesSpec{Damping: &d}
+	sim, rtm, _ := getDampedSim(t, &rs)
+	for i := 0; i < 3; i++ {
+		manageDamped(t, rtm, rs)
+		manageDamped(t, rtm, ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-primary"})
+	}
+	manageDamped(t, rtm, rs)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-backup1")
+	assert.Equal(t, rs.DampingStatus()["rtb-1"], DampingStatus{Penalty: 0, Suppressed: false})
+}
+
+func TestDampingSuppressesFlappingRoute(t *testing.T) {
+	rs := ManageRoutesSpec{Damping: &Damping{HalfLife: 60, MaxSuppress: 600}}
+	sim, rtm, c := getDampedSim(t, &rs)
+	other := ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-primary"}
+
+	manageDamped(t, rtm, rs) // First sight, then takes it: 1000
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-backup1")
+	manageDamped(t, rtm, other)
+	manageDamped(t, rtm, rs) // Lost it (2000), takes it back (3000)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-backup1")
+	assert.Equal(t, rs.DampingStatus(), map[string]DampingStatus{"rtb-1": {Penalty: 3000, Suppressed: true}})
+
+	manageDamped(t, rtm, other)
+	manageDamped(t, rtm, rs) // Lost it again (4000), and suppressed from taking it back
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-primary")
+	assert.Equal(t, len(sim.CallsTo("ReplaceRoute")), 4)
+
+	// Halves every minute: 4000 -> 2000 -> 1000 -> 707, under reuse
+	c.Advance(2 * time.Minute)
+	manageDamped(t, rtm, rs)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-primary")
+	c.Advance(30 * time.Second)
+	assert.Equal(t, rs.DampingStatus(), map[string]DampingStatus{"rtb-1": {Penalty: 707, Suppressed: false}})
+	manageDamped(t, rtm, rs)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-backup1")
+}
+
+func TestDampingPenaltyCeiling(t *testing.T) {
+	// Never suppressed for more than max_suppress: reuse * 2^(120/60) = 3000
+	rs := ManageRoutesSpec{Damping: &Damping{HalfLife: 60, MaxSuppress: 120}}
+	_, rtm, c := getDampedSim(t, &rs)
+	other := ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-primary"}
+	for i := 0; i < 5; i++ {
+		manageDamped(t, rtm, rs)
+		manageDamped(t, rtm, other)
+	}
+	manageDamped(t, rtm, rs)
+	assert.Equal(t, rs.DampingStatus()["rtb-1"], DampingStatus{Penalty: 3000, Suppressed: true})
+	c.Advance(121 * time.Second)
+	assert.Equal(t, rs.DampingStatus()["rtb-1"].Suppressed, false)
+}
+
+func TestDampingNeverSuppressesFailover(t *testing.T) {
+	rs := ManageRoutesSpec{Damping: &Damping{Penalty: penalty(3000)}}
+	sim, rtm, _ := getDampedSim(t, &rs)
+	manageDamped(t, rtm, rs)
+	assert.Equal(t, rs.DampingStatus()["rtb-1"].Suppressed, true)
+	manageDamped(t, rtm, ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-primary"})
+
+	rs.IfUnhealthy = true
+	sim.SetInstanceStatus("i-primary", ec2type.SummaryStatusImpaired, ec2type.SummaryStatusOk)
+	manageDamped(t, rtm, rs)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-backup1")
+}
+
+func TestMinHoldTime(t *testing.T) {
+	hc := &FakeHealthCheck{isHealthy: true}
+	rs := ManageRoutesSpec{MinHoldTime: 60, IfUnhealthy: true, HealthcheckName: "service", healthcheck: hc}
+	sim, rtm, c := getDampedSim(t, &rs)
+	_, err := sim.DeleteRoute(context.Background(), &ec2.DeleteRouteInput{RouteTableId: aws.String("rtb-1"), DestinationCidrBlock: aws.String("0.0.0.0/0")})
+	assert.Nil(t, err)
+	manageDamped(t, rtm, rs)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-backup1")
+
+	hc.isHealthy = false
+	c.Advance(59 * time.Second)
+	manageDamped(t, rtm, rs)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-backup1")
+	until := auditStart.Add(time.Minute)
+	assert.Equal(t, rs.DampingStatus(), map[string]DampingStatus{"rtb-1": {HeldUntil: &until}})
+
+	c.Advance(time.Second)
+	manageDamped(t, rtm, rs)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "")
+	assert.Equal(t, rs.DampingStatus(), map[string]DampingStatus{"rtb-1": {}})
+}
+
+func TestMinHoldTimeDoesNotStopDrain(t *testing.T) {
+	rs := ManageRoutesSpec{MinHoldTime: 60}
+	sim, rtm, _ := getDampedSim(t, &rs)
+	manageDamped(t, rtm, rs)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-backup1")
+
+	drain := &Drain{}
+	rs.SetDrain(drain)
+	drain.Start("shutting down")
+	manageDamped(t, rtm, rs)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "")
+}
@@ -0,0 +1,37 @@
+package aws
+
+import (
+	"sync"
+)
+
+// Drain is shared by every route, to hand them all over to other instances when this
+// one is about to go away. Once started it can't be stopped, as the instance is leaving.
+type Drain struct {
+	sync.Mutex
+	reason string
+}
+
+// Start begins draining, returning false if we were already draining.
+func (d *Drain) Start(reason string) bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.reason != "" {
+		return false
+	}
+	d.reason = reason
+	return true
+}
+
+// Reason is why we're draining, or empty if we're not.
+func (d *Drain) Reason() string {
+	if d == nil {
+		return ""
+	}
+	d.Lock()
+	defer d.Unlock()
+	return d.reason
+}
+
+func (d *Drain) Draining() bool {
+	return d.Reason() != ""
+}
@@ -0,0 +1,151 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// localAddresses returns every address configured on an interface on this machine.
+var localAddresses = func() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		switch a := addr.(type) {
+		case *net.IPNet:
+			ips = append(ips, a.IP)
+		case *net.IPAddr:
+			ips = append(ips, a.IP)
+		}
+	}
+	return ips, nil
+}
+
+// localAddressMissing is true when require_local_address is set and the route's address
+// isn't configured on any interface on this machine, meaning we would attract traffic
+// for it and drop it.
+func (r *ManageRoutesSpec) localAddressMissing() bool {
+	if !r.RequireLocalAddress {
+		return false
+	}
+	ip, _, err := net.ParseCIDR(r.Cidr)
+	if err != nil {
+		return true
+	}
+	ips, err := localAddresses()
+	if err != nil {
+		return true
+	}
+	for _, local := range ips {
+		if local.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// addLocalAddress configures an address on an interface, doing nothing if it is already there.
+var addLocalAddress = func(iface string, cidr string) error {
+	link, addr, err := netlinkAddr(iface, cidr)
+	if err != nil {
+		return err
+	}
+	return netlink.AddrReplace(link, addr)
+}
+
+// removeLocalAddress removes an address from an interface, doing nothing if it isn't there.
+var removeLocalAddress = func(iface string, cidr string) error {
+	link, addr, err := netlinkAddr(iface, cidr)
+	if err != nil {
+		return err
+	}
+	if err := netlink.AddrDel(link, addr); err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return err
+	}
+	return nil
+}
+
+func netlinkAddr(iface string, cidr string) (netlink.Link, *netlink.Addr, error) {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Could not find interface %s: %s", iface, err.Error()))
+	}
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return link, addr, nil
+}
+
+// ensureLocalAddress adds the route's address to the manage_local_address interface before
+// we take the route, so we never attract traffic we can't answer.
+func (r *ManageRoutesSpec) ensureLocalAddress(contextLogger *logrus.Entry, noop bool) error {
+	if r.ManageLocalAddress == "" {
+		return nil
+	}
+	contextLogger = contextLogger.WithFields(logrus.Fields{"interface": r.ManageLocalAddress})
+	if noop {
+		contextLogger.Debug("Not adding route address to local interface, as noop")
+		return nil
+	}
+	if err := addLocalAddress(r.ManageLocalAddress, r.Cidr); err != nil {
+		contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Warn("Error adding route address to local interface")
+		return err
+	}
+	contextLogger.Debug("Route address is on local interface")
+	return nil
+}
+
+// ownedElsewhere is true if this instance holds the route in a route table other than rtb.
+// What we have since seen or done to the route in a route table counts over the last poll's
+// copy of it, so that deleting the route from each route table in turn releases the address
+// after the last one.
+func (r *ManageRoutesSpec) ownedElsewhere(rtb string) bool {
+	for _, table := range r.routeTables() {
+		id := *(table.RouteTableId)
+		if id == rtb {
+			continue
+		}
+		if owned, known := r.history.owns(id); known {
+			if owned {
+				return true
+			}
+			continue
+		}
+		route := findRouteFromRouteTable(table, r.Cidr)
+		if route != nil && route.InstanceId != nil && *(route.InstanceId) == r.Instance {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseLocalAddress removes the route's address from the manage_local_address interface.
+func (r *ManageRoutesSpec) releaseLocalAddress(contextLogger *logrus.Entry, noop bool) {
+	if r.ManageLocalAddress == "" {
+		return
+	}
+	contextLogger = contextLogger.WithFields(logrus.Fields{"interface": r.ManageLocalAddress})
+	if noop {
+		contextLogger.Debug("Not removing route address from local interface, as noop")
+		return
+	}
+	if err := removeLocalAddress(r.ManageLocalAddress, r.Cidr); err != nil {
+		contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Warn("Error removing route address from local interface")
+		return
+	}
+	contextLogger.Info("Removed route address from local interface")
+}
+
+// ReleaseLocalAddress removes the route's address from the manage_local_address interface,
+// for use when the daemon stops.
+func (r *ManageRoutesSpec) ReleaseLocalAddress() {
+	r.releaseLocalAddress(log.WithFields(logrus.Fields{"cidr": r.Cidr}), false)
+}
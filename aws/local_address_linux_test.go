@@ -0,0 +1,59 @@
+package aws
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// inNetns runs f in a fresh network namespace, so we can add addresses without touching the host.
+func inNetns(t *testing.T, f func()) {
+	if os.Getuid() != 0 {
+		t.Skip("Need to be root to create a network namespace")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("Could not create a network namespace: %s", err.Error())
+	}
+	defer ns.Close()
+	defer netns.Set(orig)
+	f()
+}
+
+func TestNetlinkLocalAddress(t *testing.T) {
+	inNetns(t, func() {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.LinkSetUp(lo); err != nil {
+			t.Fatal(err)
+		}
+		s := ManageRoutesSpec{Cidr: "192.168.1.1/32", RequireLocalAddress: true}
+		assert.Equal(t, s.localAddressMissing(), true)
+
+		assert.Nil(t, addLocalAddress("lo", "192.168.1.1/32"))
+		assert.Nil(t, addLocalAddress("lo", "192.168.1.1/32")) // Already there is fine
+		assert.Equal(t, s.localAddressMissing(), false)
+
+		assert.Nil(t, removeLocalAddress("lo", "192.168.1.1/32"))
+		assert.Nil(t, removeLocalAddress("lo", "192.168.1.1/32")) // Already gone is fine
+		assert.Equal(t, s.localAddressMissing(), true)
+
+		err = addLocalAddress("nosuchif0", "192.168.1.1/32")
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "Could not find interface nosuchif0")
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/sirupsen/logrus"
+)
+
+// maxInstanceStatusIds is the most instance IDs DescribeInstanceStatus takes in one call.
+const maxInstanceStatusIds = 100
+
+// lookups batch what ManageInstanceRoute asks EC2 about instances during one pass over the
+// route tables: the status of every instance which holds a route we might take over, and the
+// network interfaces of our instances, are each described once, the first time they're needed,
+// rather than once per route.
+type lookups struct {
+	owners  []string
+	routers []string
+
+	statusOnce sync.Once
+	statuses   map[string]ec2type.InstanceStatus
+	statusErr  error
+
+	nicsOnce sync.Once
+	nics     map[string][]ec2type.NetworkInterface
+	nicsErr  error
+}
+
+type lookupsKey struct{}
+
+// WithLookups returns a context under which the instance status and network interface
+// lookups for the route tables rt and routes specs are batched.
+func WithLookups(ctx context.Context, rt []ec2type.RouteTable, specs []*ManageRoutesSpec) context.Context {
+	owners := make(map[string]bool)
+	routers := make(map[string]bool)
+	for _, rs := range specs {
+		if rs.networkInterfaceID() == "" {
+			routers[rs.Instance] = true
+		}
+		if !rs.IfUnhealthy {
+			continue
+		}
+		for _, rtb := range rt {
+			route := findRouteFromRouteTable(rtb, rs.Cidr)
+			if route != nil && route.InstanceId != nil && *route.InstanceId != rs.Instance && route.State == ec2type.RouteStateActive {
+				owners[*route.InstanceId] = true
+			}
+		}
+	}
+	return context.WithValue(ctx, lookupsKey{}, &lookups{owners: sortedKeys(owners), routers: sortedKeys(routers)})
+}
+
+func lookupsFrom(ctx context.Context) *lookups {
+	l, _ := ctx.Value(lookupsKey{}).(*lookups)
+	return l
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, s string) bool {
+	i := sort.SearchStrings(list, s)
+	return i < len(list) && list[i] == s
+}
+
+// instanceStatus is the status of the instance from the batch, and whether the batch has it.
+// An instance in the batch with no status isn't running.
+func (l *lookups) instanceStatus(ctx context.Context, conn EC2API, instanceID string) (status *ec2type.InstanceStatus, ok bool) {
+	if l == nil || !contains(l.owners, instanceID) {
+		return nil, false
+	}
+	l.statusOnce.Do(func() {
+		l.statuses = make(map[string]ec2type.InstanceStatus)
+		for start := 0; start < len(l.owners); start += maxInstanceStatusIds {
+			end := start + maxInstanceStatusIds
+			if end > len(l.owners) {
+				end = len(l.owners)
+			}
+			o, err := conn.DescribeInstanceStatus(ctx, &ec2.DescribeInstanceStatusInput{
+				IncludeAllInstances: aws.Bool(false),
+				InstanceIds:         l.owners[start:end],
+			})
+			if err != nil {
+				// e.g. one of them is long gone, so ask about each on its own instead
+				log.WithFields(logrus.Fields{"err": err.Error()}).Debug("Error describing instance statuses together")
+				l.statusErr = err
+				return
+			}
+			for _, is := range o.InstanceStatuses {
+				l.statuses[*is.InstanceId] = is
+			}
+		}
+	})
+	if l.statusErr != nil {
+		return nil, false
+	}
+	if is, found := l.statuses[instanceID]; found {
+		return &is, true
+	}
+	return nil, true
+}
+
+// networkInterfaces are the interfaces attached to the instance from the batch, and whether
+// the batch has them.
+func (l *lookups) networkInterfaces(ctx context.Context, conn EC2API, instanceID string) ([]ec2type.NetworkInterface, bool, error) {
+	if l == nil || !contains(l.routers, instanceID) {
+		return nil, false, nil
+	}
+	l.nicsOnce.Do(func() {
+		l.nics = make(map[string][]ec2type.NetworkInterface)
+		p := ec2.NewDescribeNetworkInterfacesPaginator(conn, &ec2.DescribeNetworkInterfacesInput{
+			Filters: []ec2type.Filter{
+				{Name: aws.String("attachment.instance-id"), Values: l.routers},
+			},
+		})
+		for p.HasMorePages() {
+			out, err := p.NextPage(ctx)
+			if err != nil {
+				l.nicsErr = err
+				return
+			}
+			for _, nic := range out.NetworkInterfaces {
+				if nic.Attachment != nil && nic.Attachment.InstanceId != nil {
+					l.nics[*nic.Attachment.InstanceId] = append(l.nics[*nic.Attachment.InstanceId], nic)
+				}
+			}
+		}
+	})
+	return l.nics[instanceID], true, l.nicsErr
+}
+
+// deviceIndex is the attachment device index of a network interface, as a string to
+// compare with network_interface.
+func deviceIndex(nic ec2type.NetworkInterface) string {
+	if nic.Attachment == nil || nic.Attachment.DeviceIndex == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d", *nic.Attachment.DeviceIndex)
+}
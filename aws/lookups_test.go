@@ -0,0 +1,105 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/justenwalker/awsnycast/ec2sim"
+)
+
+// getSimLookups has 0.0.0.0/0 in three route tables: to a healthy i-primary in rtb-1,
+// and to an impaired i-other in rtb-2 and rtb-3.
+func getSimLookups(t *testing.T) *ec2sim.EC2 {
+	sim := getSimFailover(t)
+	sim.AddRouteTable("rtb-2", "vpc-1", "10.0.0.0/16", nil)
+	sim.AddRouteTable("rtb-3", "vpc-1", "10.0.0.0/16", nil)
+	sim.AddInstance(ec2sim.Instance{ID: "i-other", PrivateIP: "10.0.0.4", InstanceStatus: ec2type.SummaryStatusImpaired})
+	assert.Nil(t, sim.AddRoute("rtb-2", "0.0.0.0/0", "i-other"))
+	assert.Nil(t, sim.AddRoute("rtb-3", "0.0.0.0/0", "i-other"))
+	return sim
+}
+
+// manageLookups runs one pass for i-backup1 over all the route tables, with lookups batched.
+func manageLookups(t *testing.T, sim *ec2sim.EC2) {
+	rtm := NewRouteTableManagerEC2WithAPI(sim)
+	tables, err := rtm.GetRouteTables(context.Background())
+	assert.Nil(t, err)
+	rs := &ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-backup1", IfUnhealthy: true}
+	ctx := WithLookups(context.Background(), tables, []*ManageRoutesSpec{rs})
+	sim.ResetCalls()
+	for _, rtb := range tables {
+		assert.Nil(t, rtm.ManageInstanceRoute(ctx, rtb, *rs, false))
+	}
+}
+
+func TestLookupsBatched(t *testing.T) {
+	sim := getSimLookups(t)
+	manageLookups(t, sim)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-primary")
+	assert.Equal(t, sim.RouteTarget("rtb-2", "0.0.0.0/0"), "i-backup1")
+	assert.Equal(t, sim.RouteTarget("rtb-3", "0.0.0.0/0"), "i-backup1")
+	if calls := sim.CallsTo("DescribeInstanceStatus"); assert.Equal(t, len(calls), 1) {
+		assert.Equal(t, calls[0].(*ec2.DescribeInstanceStatusInput).InstanceIds, []string{"i-other", "i-primary"})
+	}
+	assert.Equal(t, len(sim.CallsTo("DescribeNetworkInterfaces")), 1)
+	assert.Equal(t, len(sim.CallsTo("ReplaceRoute")), 2)
+}
+
+func TestLookupsBatchFailsFallsBack(t *testing.T) {
+	sim := getSimLookups(t)
+	sim.FailNext("DescribeInstanceStatus", errors.New("InvalidInstanceID.NotFound"))
+	manageLookups(t, sim)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-primary")
+	assert.Equal(t, sim.RouteTarget("rtb-2", "0.0.0.0/0"), "i-backup1")
+	calls := sim.CallsTo("DescribeInstanceStatus")
+	if assert.Equal(t, len(calls), 4) {
+		for i, id := range []string{"i-primary", "i-other", "i-other"} {
+			assert.Equal(t, calls[i+1].(*ec2.DescribeInstanceStatusInput).InstanceIds, []string{id})
+		}
+	}
+}
+
+func TestLookupsNotUsedOutsideBatch(t *testing.T) {
+	sim := getSimLookups(t)
+	rtm := NewRouteTableManagerEC2WithAPI(sim)
+	tables, _ := rtm.GetRouteTables(context.Background())
+	// The batch doesn't know about i-backup2, so it is asked about on its own
+	ctx := WithLookups(context.Background(), tables, []*ManageRoutesSpec{{Cidr: "0.0.0.0/0", Instance: "i-backup1", IfUnhealthy: true}})
+	sim.ResetCalls()
+	rs := ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-backup2", IfUnhealthy: true}
+	assert.Nil(t, rtm.ManageInstanceRoute(ctx, tables[1], rs, false))
+	assert.Equal(t, sim.RouteTarget("rtb-2", "0.0.0.0/0"), "i-backup2")
+	if calls := sim.CallsTo("DescribeNetworkInterfaces"); assert.Equal(t, len(calls), 1) {
+		assert.Equal(t, calls[0].(*ec2.DescribeNetworkInterfacesInput).Filters[0].Values, []string{"i-backup2"})
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	w := NewWorkers(2)
+	var running, most, ran int32
+	w.Run(10, func(i int) {
+		now := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if now <= m || atomic.CompareAndSwapInt32(&most, m, now) {
+				break
+			}
+		}
+		time.Sleep(2 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&ran, 1)
+	})
+	assert.Equal(t, ran, int32(10))
+	assert.Equal(t, most, int32(2))
+
+	var order []int
+	Workers(nil).Run(3, func(i int) { order = append(order, i) })
+	assert.Equal(t, order, []int{0, 1, 2})
+}
@@ -5,15 +5,20 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/hashicorp/go-multierror"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 
+	"github.com/justenwalker/awsnycast/clock"
 	"github.com/justenwalker/awsnycast/healthcheck"
 	"github.com/justenwalker/awsnycast/instancemetadata"
+	"github.com/justenwalker/awsnycast/tracing"
 )
 
 type ManageRoutesSpec struct {
@@ -29,19 +34,51 @@ type ManageRoutesSpec struct {
 	ec2RouteTables            []ec2type.RouteTable                `yaml:"-"`
 	Manager                   RouteTableManager                   `yaml:"-"`
 	NeverDelete               bool                                `yaml:"never_delete"`
+	RequireLocalAddress       bool                                `yaml:"require_local_address"`
+	ManageLocalAddress        string                              `yaml:"manage_local_address"`
+	NetworkInterface          string                              `yaml:"network_interface"`
+	resolvedInterface         string                              `yaml:"-"`
+	drain                     *Drain                              `yaml:"-"`
 	myIPAddress               string                              `yaml:"-"`
 	RunBeforeReplaceRoute     []string                            `yaml:"run_before_replace_route"`
 	RunAfterReplaceRoute      []string                            `yaml:"run_after_replace_route"`
 	RunBeforeDeleteRoute      []string                            `yaml:"run_before_delete_route"`
 	RunAfterDeleteRoute       []string                            `yaml:"run_after_delete_route"`
+	MinHoldTime               uint                                `yaml:"min_hold_time"`
+	Damping                   *Damping                            `yaml:"damping"`
+	history                   *routeHistory                       `yaml:"-"`
+	clock                     clock.Clock                         `yaml:"-"`
+	reevaluations             chan healthcheckEvent               `yaml:"-"`
+	listener                  *healthcheckListener                `yaml:"-"`
 }
 
+// healthcheckEvent is a change to one of a route's healthchecks.
+type healthcheckEvent struct {
+	healthy bool
+	remote  bool
+}
+
+// healthcheckListener is a running StartHealthcheckListener. It is shared by all the
+// copies of a ManageRoutesSpec, so any of them can stop it, as many times as they like.
+type healthcheckListener struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// reevaluateDelay is how long to wait after a healthcheck changes before reevaluating
+// the route, so that a burst of changes only causes one reevaluation.
+var reevaluateDelay = 500 * time.Millisecond
+
 func (r *ManageRoutesSpec) Validate(meta instancemetadata.InstanceMetadata, manager RouteTableManager, name string, healthchecks map[string]*healthcheck.Healthcheck, remotehealthchecks map[string]*healthcheck.Healthcheck) error {
 	r.myIPAddress = meta.IPAddress
 	var result *multierror.Error
 	r.Manager = manager
 	r.ec2RouteTables = make([]ec2type.RouteTable, 0)
 	r.remotehealthchecks = make(map[string]*healthcheck.Healthcheck)
+	if r.history == nil {
+		r.history = newRouteHistory()
+	}
 	if r.Cidr == "" {
 		result = multierror.Append(result, errors.New(fmt.Sprintf("cidr is not defined in %s", name)))
 	} else {
@@ -50,6 +87,8 @@ func (r *ManageRoutesSpec) Validate(meta instancemetadata.InstanceMetadata, mana
 		}
 		if _, _, err := net.ParseCIDR(r.Cidr); err != nil {
 			result = multierror.Append(result, errors.New(fmt.Sprintf("Could not parse %s in %s", err.Error(), name)))
+		} else if vpcCidr := insideCidr(r.Cidr, meta.VPCCIDRs); vpcCidr != "" {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s overlaps the VPC CIDR %s", name, r.Cidr, vpcCidr)))
 		}
 	}
 	if r.Instance == "" {
@@ -58,6 +97,28 @@ func (r *ManageRoutesSpec) Validate(meta instancemetadata.InstanceMetadata, mana
 	if r.Instance == "SELF" {
 		r.InstanceIsSelf = true
 		r.Instance = meta.Instance
+		if meta.Instance == "" {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s is for instance SELF, but the instance metadata has no instance_id", name, r.Cidr)))
+		}
+	}
+	if r.NetworkInterface != "" {
+		if err := r.resolveNetworkInterface(meta, name); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	if r.RequireLocalAddress {
+		result = multierror.Append(result, r.localAddressErrors(name, "require_local_address")...)
+	}
+	if r.ManageLocalAddress != "" {
+		result = multierror.Append(result, r.localAddressErrors(name, "manage_local_address")...)
+		if r.RequireLocalAddress {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s cannot have both require_local_address and manage_local_address", name, r.Cidr)))
+		}
+	}
+	if r.Damping != nil {
+		if err := r.Damping.Validate(name, r.Cidr); err != nil {
+			result = multierror.Append(result, err)
+		}
 	}
 	if r.HealthcheckName != "" {
 		if hc, ok := healthchecks[r.HealthcheckName]; ok {
@@ -76,20 +137,156 @@ func (r *ManageRoutesSpec) Validate(meta instancemetadata.InstanceMetadata, mana
 	return result.ErrorOrNil()
 }
 
+// resolveNetworkInterface checks network_interface is an ENI ID or device index. For our own
+// instance we look it up in the instance metadata, so we don't have to ask the EC2 API.
+func (r *ManageRoutesSpec) resolveNetworkInterface(meta instancemetadata.InstanceMetadata, name string) error {
+	isID := strings.HasPrefix(r.NetworkInterface, "eni-")
+	if _, err := strconv.Atoi(r.NetworkInterface); err != nil && !isID {
+		return errors.New(fmt.Sprintf("Route tables %s, route %s network_interface '%s' must be an ENI ID or a device index", name, r.Cidr, r.NetworkInterface))
+	}
+	if !r.InstanceIsSelf || (isID && len(meta.Interfaces) == 0) {
+		return nil
+	}
+	i, ok := meta.Interface(r.NetworkInterface)
+	if !ok {
+		return errors.New(fmt.Sprintf("Route tables %s, route %s cannot find network_interface '%s' on this instance", name, r.Cidr, r.NetworkInterface))
+	}
+	r.resolvedInterface = i.ID
+	return nil
+}
+
+// networkInterfaceID is the ENI ID chosen with network_interface, if we know it without asking EC2.
+func (r *ManageRoutesSpec) networkInterfaceID() string {
+	if r.resolvedInterface != "" {
+		return r.resolvedInterface
+	}
+	if strings.HasPrefix(r.NetworkInterface, "eni-") {
+		return r.NetworkInterface
+	}
+	return ""
+}
+
+// localAddressErrors checks a route is one we can look for on (or add to) a local interface.
+func (r *ManageRoutesSpec) localAddressErrors(name string, option string) []error {
+	errs := make([]error, 0)
+	if !r.InstanceIsSelf {
+		errs = append(errs, errors.New(fmt.Sprintf("Route tables %s, route %s can only %s for instance SELF", name, r.Cidr, option)))
+	}
+	if _, ipnet, err := net.ParseCIDR(r.Cidr); err == nil {
+		if ones, bits := ipnet.Mask.Size(); ones != bits {
+			errs = append(errs, errors.New(fmt.Sprintf("Route tables %s, route %s can only %s for a single address", name, r.Cidr, option)))
+		}
+	}
+	return errs
+}
+
+// LocalHealthy is the state of this route's healthcheck, or true if it has none. The route
+// is never healthy if require_local_address is set and the address is missing, or while
+// we're draining.
+func (r *ManageRoutesSpec) LocalHealthy() bool {
+	if r.localAddressMissing() || r.drain.Draining() {
+		return false
+	}
+	if r.healthcheck == nil {
+		return true
+	}
+	return r.healthcheck.IsHealthy()
+}
+
+// SetDrain shares the instance's drain state with this route.
+func (r *ManageRoutesSpec) SetDrain(d *Drain) {
+	r.drain = d
+}
+
+// SetClock sets the clock used for min_hold_time, damping and reevaluateDelay.
+func (r *ManageRoutesSpec) SetClock(c clock.Clock) {
+	if r.history == nil {
+		r.history = newRouteHistory()
+	}
+	r.history.clock = c
+	r.clock = c
+}
+
+// DampingStatus is the flap damping and min_hold_time state of this route in each route
+// table, if either is set.
+func (r *ManageRoutesSpec) DampingStatus() map[string]DampingStatus {
+	if r.Damping == nil && r.MinHoldTime == 0 {
+		return nil
+	}
+	return r.history.status(r.Damping, r.MinHoldTime)
+}
+
+// heldUntil is when min_hold_time is up for the route in a route table we took it in, or
+// zero if it already is.
+func (r *ManageRoutesSpec) heldUntil(rtb string) time.Time {
+	until := r.history.heldUntil(rtb, r.MinHoldTime)
+	if until.IsZero() || !until.After(r.history.clock.Now()) {
+		return time.Time{}
+	}
+	return until
+}
+
+// OwnedRouteTables returns the IDs of the route tables in which this route currently points at our instance.
+func (r *ManageRoutesSpec) OwnedRouteTables() []string {
+	owned := make([]string, 0)
+	for _, rtb := range r.routeTables() {
+		route := findRouteFromRouteTable(rtb, r.Cidr)
+		if route != nil && route.InstanceId != nil && *(route.InstanceId) == r.Instance {
+			owned = append(owned, *(rtb.RouteTableId))
+		}
+	}
+	return owned
+}
+
+// StartHealthcheckListener reevaluates the route whenever its local or remote healthchecks
+// change.
 func (r *ManageRoutesSpec) StartHealthcheckListener(noop bool) {
+	l := r.listener
+	if l == nil || l.stopped() {
+		l = &healthcheckListener{stop: make(chan struct{}), done: make(chan struct{})}
+		r.listener = l
+		go r.runReevaluations(r.reevaluationQueue(), l, noop)
+	}
 	if r.healthcheck == nil {
 		return
 	}
 	go func() {
 		c := r.healthcheck.GetListener()
 		for {
-			r.handleHealthcheckResult(context.TODO(), <-c, false, noop)
+			select {
+			case res := <-c:
+				r.healthcheckChanged(res, false)
+			case <-l.stop:
+				return
+			}
 		}
 	}()
 	return
 }
 
-func (r *ManageRoutesSpec) handleHealthcheckResult(ctx context.Context, res bool, remote bool, noop bool) {
+// StopHealthcheckListener stops reevaluating the route, waiting for a reevaluation which
+// has already started to finish. It does nothing if the listener isn't running.
+func (r *ManageRoutesSpec) StopHealthcheckListener() {
+	l := r.listener
+	if l == nil {
+		return
+	}
+	l.stopOnce.Do(func() { close(l.stop) })
+	<-l.done
+}
+
+func (l *healthcheckListener) stopped() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// healthcheckChanged asks for the route to be reevaluated. If a reevaluation is already
+// pending, this change replaces the one it was asked for with.
+func (r *ManageRoutesSpec) healthcheckChanged(res bool, remote bool) {
 	resText := "FAILED"
 	if res {
 		resText = "PASSED"
@@ -98,36 +295,150 @@ func (r *ManageRoutesSpec) handleHealthcheckResult(ctx context.Context, res bool
 	if remote {
 		typeText = "remote"
 	}
-	contextLogger := log.WithFields(log.Fields{
+	contextLogger := log.WithFields(logrus.Fields{
 		"healtcheck_status": resText,
 		"healthcheck_name":  r.HealthcheckName,
 		"healthcheck_type":  typeText,
 		"route_cidr":        r.Cidr,
 	})
 	contextLogger.Info("Healthcheck status change, reevaluating current routes")
-	for _, rtb := range r.ec2RouteTables {
-		innerLogger := contextLogger.WithFields(log.Fields{
-			"rtb": rtb.RouteTableId,
+	reevaluations := r.reevaluationQueue()
+	for {
+		select {
+		case reevaluations <- healthcheckEvent{healthy: res, remote: remote}:
+			return
+		default:
+			contextLogger.Debug("Reevaluation already pending")
+			select {
+			case <-reevaluations:
+			default:
+			}
+		}
+	}
+}
+
+// runReevaluations waits for reevaluateDelay after a healthcheck change, so that any more
+// changes in that time are handled by the same reevaluation.
+func (r *ManageRoutesSpec) runReevaluations(reevaluations chan healthcheckEvent, l *healthcheckListener, noop bool) {
+	c := r.clock
+	if c == nil {
+		c = clock.Real
+	}
+	defer close(l.done)
+	for {
+		var ev healthcheckEvent
+		select {
+		case ev = <-reevaluations:
+		case <-l.stop:
+			return
+		}
+		select {
+		case <-c.After(reevaluateDelay):
+		case <-l.stop:
+			return
+		}
+		select {
+		case ev = <-reevaluations:
+		default:
+		}
+		r.handleHealthcheckResult(context.TODO(), ev.healthy, ev.remote, noop)
+	}
+}
+
+// handleHealthcheckResult reevaluates the route in each route table. The last poll's copy
+// of a route table may be out of date, so each is described again first, under its lock
+// so that the poll loop can't change it at the same time.
+func (r *ManageRoutesSpec) handleHealthcheckResult(ctx context.Context, res bool, remote bool, noop bool) {
+	ctx, span := tracing.Start(ctx, "handleHealthcheckResult",
+		tracing.Healthcheck.String(r.HealthcheckName), tracing.Cidr.String(r.Cidr),
+		tracing.Healthy.Bool(res), tracing.Remote.Bool(remote))
+	defer span.End()
+	if m, ok := r.Manager.(*RouteTableManagerEC2); ok {
+		ctx = m.Safety.StartRun(ctx)
+	}
+	spec := r.snapshot()
+	for _, rtb := range spec.ec2RouteTables {
+		id := *rtb.RouteTableId
+		contextLogger := log.WithFields(logrus.Fields{
+			"rtb":        id,
+			"route_cidr": r.Cidr,
 		})
-		innerLogger.Debug("Working for one route table")
-		if err := r.Manager.ManageInstanceRoute(ctx, rtb, *r, noop); err != nil {
-			innerLogger.WithFields(log.Fields{"err": err.Error()}).Warn("error")
+		contextLogger.Debug("Working for one route table")
+		unlock := r.Manager.LockRouteTables(id)
+		current, err := r.Manager.GetRouteTable(ctx, id)
+		if err != nil {
+			contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Warn("Could not describe route table, not reevaluating it")
+		} else if err := r.Manager.ManageInstanceRoute(ctx, current, spec, noop); err != nil {
+			contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Warn("error")
 		}
+		unlock()
 	}
 }
 
 func (r *ManageRoutesSpec) UpdateEc2RouteTables(ctx context.Context, rt []ec2type.RouteTable) {
 	log.Debug(fmt.Sprintf("manange routes: %+v", rt))
+	specLock.Lock()
 	r.ec2RouteTables = rt
+	specLock.Unlock()
 	r.UpdateRemoteHealthchecks(ctx)
 }
 
+// specLock guards ec2RouteTables, remotehealthchecks and reevaluations, which the poll
+// loop and healthchecks change while reevaluations and the status output read them. Specs
+// are copied by value, so it is shared by all of them.
+var specLock sync.RWMutex
+
+// routeTables is the last poll's copy of the route tables this route is managed in.
+func (r *ManageRoutesSpec) routeTables() []ec2type.RouteTable {
+	specLock.RLock()
+	defer specLock.RUnlock()
+	return r.ec2RouteTables
+}
+
+// snapshot is a copy of the spec to pass to ManageInstanceRoute from outside the poll loop.
+func (r *ManageRoutesSpec) snapshot() ManageRoutesSpec {
+	specLock.RLock()
+	defer specLock.RUnlock()
+	return *r
+}
+
+// reevaluationQueue holds the healthcheck change waiting for a reevaluation. It is made
+// by whichever of StartHealthcheckListener and the healthchecks gets to it first, so that
+// changes before the listener starts wait for it rather than being lost.
+func (r *ManageRoutesSpec) reevaluationQueue() chan healthcheckEvent {
+	specLock.Lock()
+	defer specLock.Unlock()
+	if r.reevaluations == nil {
+		r.reevaluations = make(chan healthcheckEvent, 1)
+	}
+	return r.reevaluations
+}
+
+// remoteHealthcheck is the remote healthcheck running against the instance with ip.
+func (r *ManageRoutesSpec) remoteHealthcheck(ip string) (*healthcheck.Healthcheck, bool) {
+	specLock.RLock()
+	defer specLock.RUnlock()
+	hc, ok := r.remotehealthchecks[ip]
+	return hc, ok
+}
+
 var eniToIP map[string]string
 
+// eniToIPLock guards eniToIP, as route tables are run concurrently.
+var eniToIPLock sync.RWMutex
+
 func init() {
 	eniToIP = make(map[string]string)
 }
 
+// eniIP is the private IP address of a network interface we have looked up.
+func eniIP(nicID string) (string, bool) {
+	eniToIPLock.RLock()
+	defer eniToIPLock.RUnlock()
+	ip, ok := eniToIP[nicID]
+	return ip, ok
+}
+
 func (r *ManageRoutesSpec) UpdateRemoteHealthchecks(ctx context.Context) {
 	if r.RemoteHealthcheckName == "" {
 		return
@@ -139,7 +450,7 @@ func (r *ManageRoutesSpec) UpdateRemoteHealthchecks(ctx context.Context) {
 		if route != nil && route.NetworkInterfaceId != nil {
 			nicID := *route.NetworkInterfaceId
 			routeEnis = append(routeEnis, nicID)
-			if _, ok := eniToIP[nicID]; !ok {
+			if _, ok := eniIP(nicID); !ok {
 				eniIdsToFetch = append(eniIdsToFetch, nicID)
 			}
 		}
@@ -150,37 +461,43 @@ func (r *ManageRoutesSpec) UpdateRemoteHealthchecks(ctx context.Context) {
 			log.Error("Error " + err.Error())
 			return
 		}
+		eniToIPLock.Lock()
 		for _, iface := range out.NetworkInterfaces {
 			eniToIP[*iface.NetworkInterfaceId] = *iface.PrivateIpAddress
 		}
+		eniToIPLock.Unlock()
 	}
+	eniToIPLock.RLock()
 	log.Debug(fmt.Sprintf("ENI %+v", eniToIP))
+	eniToIPLock.RUnlock()
 	healthchecks := make(map[string]bool)
 	for ip, _ := range r.remotehealthchecks {
 		healthchecks[ip] = false
 	}
 	for _, eniId := range routeEnis {
-		ip := eniToIP[eniId]
-		contextLogger := log.WithFields(log.Fields{"ip": ip})
+		ip, _ := eniIP(eniId)
+		contextLogger := log.WithFields(logrus.Fields{"ip": ip})
 		healthchecks[ip] = true
 		if ip == r.myIPAddress {
 			contextLogger.Debug("Skipping starting a remote healthcheck on myself")
 			continue
 		}
 		if _, ok := r.remotehealthchecks[ip]; !ok {
-			hc, err := r.remotehealthchecktemplate.NewWithDestination(ip)
+			hc, err := r.remotehealthchecktemplate.NewWithDestinationForRoute(ip, r.Cidr)
 			if err != nil {
 				contextLogger.Error(err.Error())
 			} else {
+				specLock.Lock()
 				r.remotehealthchecks[ip] = hc
-				r.remotehealthchecks[ip].Run(true)
+				specLock.Unlock()
+				hc.Run(true)
 				contextLogger.Debug(fmt.Sprintf("New healthcheck being run"))
 				go func() {
 					c := hc.GetListener()
 					for {
 						res := <-c
-						contextLogger.WithFields(log.Fields{"result": res}).Debug("Got result from remote healthchecl")
-						r.handleHealthcheckResult(ctx, res, true, false)
+						contextLogger.WithFields(logrus.Fields{"result": res}).Debug("Got result from remote healthchecl")
+						r.healthcheckChanged(res, true)
 					}
 				}()
 			}
@@ -190,8 +507,30 @@ func (r *ManageRoutesSpec) UpdateRemoteHealthchecks(ctx context.Context) {
 		if v {
 			continue
 		}
-		log.WithFields(log.Fields{"ip": ip}).Debug("Stopping healthcheck")
+		log.WithFields(logrus.Fields{"ip": ip}).Debug("Stopping healthcheck")
 		r.remotehealthchecks[ip].Stop()
+		specLock.Lock()
 		delete(r.remotehealthchecks, ip)
+		specLock.Unlock()
+	}
+}
+
+// insideCidr is the first of cidrs which cidr is (or is inside), if any.
+func insideCidr(cidr string, cidrs []string) string {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ""
+	}
+	ones, _ := n.Mask.Size()
+	for _, c := range cidrs {
+		_, outer, err := net.ParseCIDR(c)
+		if err != nil {
+			continue
+		}
+		outerOnes, _ := outer.Mask.Size()
+		if outer.Contains(n.IP) && ones >= outerOnes && len(outer.IP) == len(n.IP) {
+			return c
+		}
 	}
+	return ""
 }
@@ -0,0 +1,49 @@
+package aws
+
+import (
+	"sort"
+	"sync"
+)
+
+// RouteTableLocks stop the poll loop and healthcheck triggered reevaluations from
+// deciding what to do with the same route table at once. The zero value is ready to use.
+type RouteTableLocks struct {
+	mu     sync.Mutex
+	tables map[string]*sync.Mutex
+}
+
+// Lock locks each of the route tables, in order so that callers locking more than one
+// can't deadlock, and returns a func which unlocks them again.
+func (l *RouteTableLocks) Lock(ids ...string) func() {
+	sorted := make([]string, 0, len(ids))
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			sorted = append(sorted, id)
+		}
+	}
+	sort.Strings(sorted)
+	locks := make([]*sync.Mutex, len(sorted))
+	l.mu.Lock()
+	if l.tables == nil {
+		l.tables = make(map[string]*sync.Mutex)
+	}
+	for i, id := range sorted {
+		m, ok := l.tables[id]
+		if !ok {
+			m = &sync.Mutex{}
+			l.tables[id] = m
+		}
+		locks[i] = m
+	}
+	l.mu.Unlock()
+	for _, m := range locks {
+		m.Lock()
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
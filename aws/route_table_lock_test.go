@@ -0,0 +1,158 @@
+package aws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/justenwalker/awsnycast/clock"
+	"github.com/justenwalker/awsnycast/ec2sim"
+	"github.com/justenwalker/awsnycast/testhelpers"
+	"github.com/justenwalker/awsnycast/tracing"
+)
+
+// waitFor polls until cond is true, or fails the test after a few seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// getReevaluatedSpec is a spec for i-backup1 to always hold 0.0.0.0/0 in the failover
+// sim, which last saw the route tables as they are now.
+func getReevaluatedSpec(t *testing.T) (*ec2sim.EC2, *ManageRoutesSpec) {
+	sim := getSimFailover(t)
+	rtm := NewRouteTableManagerEC2WithAPI(sim)
+	tables, err := rtm.GetRouteTables(context.Background())
+	assert.Nil(t, err)
+	rs := &ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-backup1", Manager: rtm, ec2RouteTables: tables}
+	return sim, rs
+}
+
+func TestLockRouteTables(t *testing.T) {
+	rtm := NewRouteTableManagerEC2WithAPI(nil)
+	unlock := rtm.LockRouteTables("rtb-lock-2", "rtb-lock-1", "rtb-lock-2")
+	locked := make(chan bool)
+	go func() {
+		rtm.LockRouteTables("rtb-lock-1")()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+		t.Fatal("locked a route table which was already locked")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// Others aren't held up, nor are other managers
+	rtm.LockRouteTables("rtb-lock-3")()
+	NewRouteTableManagerEC2WithAPI(nil).LockRouteTables("rtb-lock-1")()
+	unlock()
+	<-locked
+}
+
+func TestHealthcheckChangesCoalesced(t *testing.T) {
+	sim, rs := getReevaluatedSpec(t)
+	c := clock.NewFake(auditStart)
+	rs.SetClock(c)
+	rs.StartHealthcheckListener(false)
+	sim.ResetCalls()
+
+	rs.healthcheckChanged(false, false)
+	waitFor(t, func() bool { return c.Waiting() == 1 })
+	rs.healthcheckChanged(true, false)
+	rs.healthcheckChanged(false, true)
+	c.Advance(reevaluateDelay)
+	waitFor(t, func() bool { return sim.RouteTarget("rtb-1", "0.0.0.0/0") == "i-backup1" })
+	assert.Equal(t, c.Waiting(), 0)
+	assert.Equal(t, len(sim.CallsTo("DescribeRouteTables")), 1)
+	assert.Equal(t, len(sim.CallsTo("ReplaceRoute")), 1)
+}
+
+func TestHealthcheckChangesUseLatest(t *testing.T) {
+	sr := testhelpers.RecordSpans(t)
+	_, rs := getReevaluatedSpec(t)
+	c := clock.NewFake(auditStart)
+	rs.SetClock(c)
+	// Changes before the listener starts wait for it
+	rs.healthcheckChanged(true, false)
+	rs.StartHealthcheckListener(false)
+	waitFor(t, func() bool { return c.Waiting() == 1 })
+	rs.healthcheckChanged(true, false)
+	rs.healthcheckChanged(false, true)
+	c.Advance(reevaluateDelay)
+	waitFor(t, func() bool {
+		return len(sr.Ended()) > 0 && sr.Ended()[len(sr.Ended())-1].Name() == "handleHealthcheckResult"
+	})
+	rs.StopHealthcheckListener()
+	attrs := sr.Ended()[len(sr.Ended())-1].Attributes()
+	assert.Contains(t, attrs, tracing.Healthy.Bool(false))
+	assert.Contains(t, attrs, tracing.Remote.Bool(true))
+}
+
+func TestStopHealthcheckListener(t *testing.T) {
+	sim, rs := getReevaluatedSpec(t)
+	c := clock.NewFake(auditStart)
+	rs.SetClock(c)
+	rs.StartHealthcheckListener(false)
+	sim.ResetCalls()
+
+	rs.healthcheckChanged(false, false)
+	waitFor(t, func() bool { return c.Waiting() == 1 })
+	rs.StopHealthcheckListener()
+	rs.StopHealthcheckListener()        // Stopping again does nothing
+	rs.healthcheckChanged(false, false) // Doesn't block
+	c.Advance(reevaluateDelay)
+	assert.Equal(t, len(sim.CallsTo("DescribeRouteTables")), 0)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-primary")
+
+	// It can be started again, and picks up the pending change
+	rs.StartHealthcheckListener(false)
+	defer rs.StopHealthcheckListener()
+	waitFor(t, func() bool { return c.Waiting() == 1 })
+	c.Advance(reevaluateDelay)
+	waitFor(t, func() bool { return sim.RouteTarget("rtb-1", "0.0.0.0/0") == "i-backup1" })
+}
+
+func TestHandleHealthcheckResultRefreshesRouteTable(t *testing.T) {
+	sim, rs := getReevaluatedSpec(t)
+	rs.Cidr = "192.168.0.0/24"
+	rs.IfUnhealthy = true
+	// Since we last looked, another instance has created the route
+	assert.Nil(t, sim.AddRoute("rtb-1", "192.168.0.0/24", "i-primary"))
+	rs.handleHealthcheckResult(context.Background(), true, false, false)
+	if calls := sim.CallsTo("DescribeRouteTables"); assert.Equal(t, len(calls), 2) {
+		assert.Equal(t, calls[1].(*ec2.DescribeRouteTablesInput).RouteTableIds, []string{"rtb-1"})
+	}
+	assert.Equal(t, len(sim.CallsTo("CreateRoute")), 0)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "192.168.0.0/24"), "i-primary")
+}
+
+func TestHandleHealthcheckResultWaitsForLock(t *testing.T) {
+	sim, rs := getReevaluatedSpec(t)
+	unlock := rs.Manager.LockRouteTables("rtb-1")
+	done := make(chan bool)
+	go func() {
+		rs.handleHealthcheckResult(context.Background(), true, false, false)
+		done <- true
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, len(sim.CallsTo("DescribeRouteTables")), 1)
+	unlock()
+	<-done
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-backup1")
+}
+
+func TestHandleHealthcheckResultRouteTableGone(t *testing.T) {
+	sim, rs := getReevaluatedSpec(t)
+	rs.ec2RouteTables = append(rs.ec2RouteTables, ec2type.RouteTable{RouteTableId: aws.String("rtb-gone")})
+	rs.handleHealthcheckResult(context.Background(), true, false, false)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-backup1")
+}
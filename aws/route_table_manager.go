@@ -3,15 +3,22 @@ package aws
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os/exec"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 
 	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/justenwalker/awsnycast/logging"
+	"github.com/justenwalker/awsnycast/tracing"
 )
 
+var log = logging.For("aws")
+
 var errNICNotFound = errors.New("nic with source dest check disabled was not found")
 
 type EC2API interface {
@@ -22,59 +29,112 @@ type EC2API interface {
 	DescribeNetworkInterfaces(context.Context, *ec2.DescribeNetworkInterfacesInput, ...func(*ec2.Options)) (*ec2.DescribeNetworkInterfacesOutput, error)
 	DescribeInstanceAttribute(context.Context, *ec2.DescribeInstanceAttributeInput, ...func(*ec2.Options)) (*ec2.DescribeInstanceAttributeOutput, error)
 	DescribeInstanceStatus(context.Context, *ec2.DescribeInstanceStatusInput, ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error)
+	DescribeInstances(context.Context, *ec2.DescribeInstancesInput, ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
 }
 
 type RouteTableManager interface {
 	GetRouteTables(ctx context.Context) ([]ec2type.RouteTable, error)
+	GetRouteTable(ctx context.Context, id string) (ec2type.RouteTable, error)
 	ManageInstanceRoute(context.Context, ec2type.RouteTable, ManageRoutesSpec, bool) error
-	InstanceIsRouter(context.Context, string) bool
+	InstanceIsRouter(context.Context, string) (bool, error)
+	// LockRouteTables locks route tables against being worked on elsewhere at the same
+	// time, returning a func which unlocks them.
+	LockRouteTables(ids ...string) func()
+}
+
+// PeerHealth is what other AWSnycast instances have told us about themselves (e.g. via gossip).
+type PeerHealth interface {
+	// PeerRouteHealthy returns whether the instance says it is healthy for the cidr,
+	// and whether we know anything about it at all.
+	PeerRouteHealthy(instance string, cidr string) (healthy bool, known bool)
+}
+
+// RouteNotifier is told about each change made to a route, e.g. to send a webhook.
+type RouteNotifier interface {
+	RouteChanged(AuditEntry)
 }
 
 type RouteTableManagerEC2 struct {
 	Region                 string
+	Peers                  PeerHealth
+	Audit                  *AuditLog
+	Notifier               RouteNotifier
+	Safety                 *Safety
 	conn                   EC2API
 	srcdstcheckForInstance map[string]bool
+	locks                  *RouteTableLocks
 }
 
-func NewRouteTableManagerEC2(cfg aws.Config) *RouteTableManagerEC2 {
+// NewRouteTableManagerEC2 talks to the EC2 API, or to endpoint instead if it is set.
+func NewRouteTableManagerEC2(cfg aws.Config, endpoint string) *RouteTableManagerEC2 {
 	r := RouteTableManagerEC2{
 		srcdstcheckForInstance: map[string]bool{},
+		locks:                  &RouteTableLocks{},
+	}
+	var opts []func(*ec2.Options)
+	if endpoint != "" {
+		opts = append(opts, ec2.WithEndpointResolver(ec2.EndpointResolverFromURL(endpoint)))
 	}
-	r.conn = ec2.NewFromConfig(cfg)
+	r.conn = tracedEC2{ec2.NewFromConfig(cfg, opts...)}
 	return &r
 }
 
-// InstanceIsRouter when source destination check is disabled on any interface.
-func (r RouteTableManagerEC2) InstanceIsRouter(ctx context.Context, instanceID string) bool {
+// NewRouteTableManagerEC2WithAPI uses conn rather than the real EC2 API, e.g. to run
+// against the ec2sim simulator in tests.
+func NewRouteTableManagerEC2WithAPI(conn EC2API) *RouteTableManagerEC2 {
+	return &RouteTableManagerEC2{
+		conn:                   tracedEC2{conn},
+		srcdstcheckForInstance: map[string]bool{},
+		locks:                  &RouteTableLocks{},
+	}
+}
+
+// LockRouteTables locks the route tables for this manager. A manager which wasn't made
+// by one of the constructors has nothing to share its locks with, so doesn't lock.
+func (r RouteTableManagerEC2) LockRouteTables(ids ...string) func() {
+	if r.locks == nil {
+		return func() {}
+	}
+	return r.locks.Lock(ids...)
+}
+
+// InstanceIsRouter when source destination check is disabled on any interface. The error
+// is for when we couldn't find out, e.g. because the API call failed.
+func (r RouteTableManagerEC2) InstanceIsRouter(ctx context.Context, instanceID string) (bool, error) {
 	if v, ok := r.srcdstcheckForInstance[instanceID]; ok {
-		return v
+		return v, nil
 	}
 
 	if _, err := r.routerInterface(ctx, instanceID); err != nil {
-		switch err {
-		case errNICNotFound:
-			return false
-		default:
-			panic(err)
+		if err == errNICNotFound {
+			return false, nil
 		}
+		return false, err
 	}
 
 	r.srcdstcheckForInstance[instanceID] = true
-	return true
+	return true, nil
 }
 
 func (r RouteTableManagerEC2) routerInterface(ctx context.Context, instanceID string) (nicID string, err error) {
-	out, err := r.conn.DescribeNetworkInterfaces(ctx, &ec2.DescribeNetworkInterfacesInput{
-		Filters: []ec2type.Filter{
-			{Name: aws.String("attachment.instance-id"), Values: []string{instanceID}},
-		},
-	})
+	nics, ok, err := lookupsFrom(ctx).networkInterfaces(ctx, r.conn, instanceID)
 	if err != nil {
 		return "", err
 	}
+	if !ok {
+		out, err := r.conn.DescribeNetworkInterfaces(ctx, &ec2.DescribeNetworkInterfacesInput{
+			Filters: []ec2type.Filter{
+				{Name: aws.String("attachment.instance-id"), Values: []string{instanceID}},
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+		nics = out.NetworkInterfaces
+	}
 
 	// Search all interfaces for a disabled source check.
-	for _, nic := range out.NetworkInterfaces {
+	for _, nic := range nics {
 		if !*nic.SourceDestCheck {
 			return *nic.NetworkInterfaceId, nil
 		}
@@ -83,9 +143,54 @@ func (r RouteTableManagerEC2) routerInterface(ctx context.Context, instanceID st
 	return "", errNICNotFound
 }
 
-func (r RouteTableManagerEC2) ManageInstanceRoute(ctx context.Context, rtb ec2type.RouteTable, rs ManageRoutesSpec, noop bool) error {
+// routeInterface picks the ENI to send a route to: the one chosen with network_interface if
+// set, otherwise the first with source/destination checking disabled.
+func (r RouteTableManagerEC2) routeInterface(ctx context.Context, rs ManageRoutesSpec) (string, error) {
+	if id := rs.networkInterfaceID(); id != "" {
+		return id, nil
+	}
+	if rs.NetworkInterface == "" {
+		return r.routerInterface(ctx, rs.Instance)
+	}
+	if nics, ok, err := lookupsFrom(ctx).networkInterfaces(ctx, r.conn, rs.Instance); ok {
+		if err != nil {
+			return "", err
+		}
+		for _, nic := range nics {
+			if deviceIndex(nic) == rs.NetworkInterface {
+				return *nic.NetworkInterfaceId, nil
+			}
+		}
+		return "", errors.New(fmt.Sprintf("instance %s has no network interface with device index %s", rs.Instance, rs.NetworkInterface))
+	}
+	out, err := r.conn.DescribeNetworkInterfaces(ctx, &ec2.DescribeNetworkInterfacesInput{
+		Filters: []ec2type.Filter{
+			{Name: aws.String("attachment.instance-id"), Values: []string{rs.Instance}},
+			{Name: aws.String("attachment.device-index"), Values: []string{rs.NetworkInterface}},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(out.NetworkInterfaces) == 0 {
+		return "", errors.New(fmt.Sprintf("instance %s has no network interface with device index %s", rs.Instance, rs.NetworkInterface))
+	}
+	return *out.NetworkInterfaces[0].NetworkInterfaceId, nil
+}
+
+func (r RouteTableManagerEC2) ManageInstanceRoute(ctx context.Context, rtb ec2type.RouteTable, rs ManageRoutesSpec, noop bool) (err error) {
+	ctx, span := tracing.Start(ctx, "ManageInstanceRoute",
+		tracing.RouteTable.String(*rtb.RouteTableId), tracing.Cidr.String(rs.Cidr), tracing.Instance.String(rs.Instance))
+	decision := "none"
+	defer func() {
+		span.SetAttributes(tracing.Decision.String(decision))
+		tracing.End(span, err)
+	}()
+	if rs.HealthcheckName != "" {
+		span.SetAttributes(tracing.Healthcheck.String(rs.HealthcheckName))
+	}
 	route := findRouteFromRouteTable(rtb, rs.Cidr)
-	contextLogger := log.WithFields(log.Fields{
+	contextLogger := log.WithFields(logrus.Fields{
 		"vpc":         *(rtb.VpcId),
 		"rtb":         *(rtb.RouteTableId),
 		"noop":        noop,
@@ -93,52 +198,105 @@ func (r RouteTableManagerEC2) ManageInstanceRoute(ctx context.Context, rtb ec2ty
 		"my_instance": rs.Instance,
 	})
 	if rs.HealthcheckName != "" {
-		contextLogger = contextLogger.WithFields(log.Fields{
+		contextLogger = contextLogger.WithFields(logrus.Fields{
 			"healthcheck":         rs.HealthcheckName,
 			"healthcheck_healthy": rs.healthcheck.IsHealthy(),
 			"healthcheck_ready":   rs.healthcheck.CanPassYet(),
 		})
 	}
 	if rs.RemoteHealthcheckName != "" {
-		contextLogger = contextLogger.WithFields(log.Fields{
+		contextLogger = contextLogger.WithFields(logrus.Fields{
 			"remote_healthcheck": rs.RemoteHealthcheckName,
 		})
 	}
+	if route != nil {
+		rs.history.observe(contextLogger, rs.Damping, *rtb.RouteTableId, route.InstanceId != nil && *(route.InstanceId) == rs.Instance)
+	}
 	if route != nil {
 		if route.InstanceId != nil {
-			contextLogger = contextLogger.WithFields(log.Fields{
+			contextLogger = contextLogger.WithFields(logrus.Fields{
 				"instance_id": *(route.InstanceId),
 			})
 			if *(route.InstanceId) == rs.Instance {
-				if rs.HealthcheckName != "" && !rs.healthcheck.IsHealthy() && rs.healthcheck.CanPassYet() {
+				addressMissing := rs.localAddressMissing()
+				drainReason := rs.drain.Reason()
+				if drainReason != "" || addressMissing || (rs.HealthcheckName != "" && !rs.healthcheck.IsHealthy() && rs.healthcheck.CanPassYet()) {
+					entry := AuditEntry{
+						RouteTable:     *rtb.RouteTableId,
+						Cidr:           rs.Cidr,
+						Action:         ActionDelete,
+						PreviousTarget: routeTarget(*route),
+						Reason:         ReasonLocalHealthcheck,
+						DryRun:         noop,
+					}
+					if drainReason != "" {
+						contextLogger = contextLogger.WithFields(logrus.Fields{"drain_reason": drainReason})
+						entry.Reason = ReasonDrain
+					} else if addressMissing {
+						entry.Reason = ReasonAddressMissing
+					} else if until := rs.heldUntil(*rtb.RouteTableId); !until.IsZero() {
+						contextLogger.WithFields(logrus.Fields{"held_until": until.UTC().Format(time.RFC3339)}).Info("Healthcheck unhealthy, but within min_hold_time - keeping route")
+						decision = "keep_hold"
+						return nil
+					}
 					if rs.NeverDelete {
-						contextLogger.Info("Healthcheck unhealthy, but set to never_delete - ignoring")
+						entry.Action = ActionSkip
+						r.record(entry, nil)
+						if drainReason != "" {
+							contextLogger.Warn("Draining, but set to never_delete - ignoring")
+						} else if addressMissing {
+							contextLogger.Warn("Route address is not configured on any local interface, but set to never_delete - ignoring")
+						} else {
+							contextLogger.Info("Healthcheck unhealthy, but set to never_delete - ignoring")
+						}
+						decision = "never_delete"
+						return nil
+					}
+					if r.refused(contextLogger, entry, r.Safety.limit(ctx, noop)) {
+						decision = "refused"
 						return nil
 					}
-					contextLogger.Info("Healthcheck unhealthy: deleting route")
+					if drainReason != "" {
+						contextLogger.Warn("Draining: deleting route")
+					} else if addressMissing {
+						contextLogger.Warn("Route address is not configured on any local interface: deleting route")
+					} else {
+						contextLogger.Info("Healthcheck unhealthy: deleting route")
+					}
 					if len(rs.RunBeforeDeleteRoute) > 0 {
 						cmd := rs.RunBeforeDeleteRoute[0]
 						if err := exec.Command(cmd, rs.RunBeforeDeleteRoute[1:]...).Run(); err != nil {
-							contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("RunBeforeDeleteRoute failed")
+							contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Debug("RunBeforeDeleteRoute failed")
 						}
 					}
-					if err := r.DeleteInstanceRoute(ctx, rtb.RouteTableId, *route, rs.Cidr, rs.Instance, noop); err != nil {
+					decision = "delete"
+					err := r.DeleteInstanceRoute(ctx, rtb.RouteTableId, *route, rs.Cidr, rs.Instance, noop)
+					r.record(entry, err)
+					if err != nil {
 						return err
 					}
+					if !noop {
+						rs.history.moved(contextLogger, rs.Damping, *rtb.RouteTableId, false)
+					}
+					if !rs.ownedElsewhere(*rtb.RouteTableId) {
+						rs.releaseLocalAddress(contextLogger, noop)
+					}
 					if len(rs.RunAfterDeleteRoute) > 0 {
 						cmd := rs.RunAfterDeleteRoute[0]
 						if err := exec.Command(cmd, rs.RunAfterDeleteRoute[1:]...).Run(); err != nil {
-							contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("RunAfterDeleteRoute failed")
+							contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Debug("RunAfterDeleteRoute failed")
 						}
 					}
 					return nil
 				}
 				contextLogger.Debug("Currently routed by this instance, doing nothing")
-				return nil
+				decision = "keep"
+				return rs.ensureLocalAddress(contextLogger, noop)
 			}
 			contextLogger.Debug("Not routed by my instance - evaluate for replacement")
 		}
 
+		decision = "evaluate_replace"
 		if err := r.ReplaceInstanceRoute(ctx, rtb.RouteTableId, *route, rs, noop); err != nil {
 			return err
 		}
@@ -146,22 +304,93 @@ func (r RouteTableManagerEC2) ManageInstanceRoute(ctx context.Context, rtb ec2ty
 	}
 
 	// These is no pre-existing route
+	if rs.drain.Draining() {
+		contextLogger.Info("Draining: not creating route")
+		decision = "skip_draining"
+		return nil
+	}
+	if rs.localAddressMissing() {
+		contextLogger.Warn("Route address is not configured on any local interface: not creating route")
+		decision = "skip_address_missing"
+		return nil
+	}
 	if rs.HealthcheckName != "" && !rs.healthcheck.IsHealthy() {
 		if rs.healthcheck.CanPassYet() {
 			contextLogger.Info("Healthcheck unhealthy: not creating route")
 		} else {
 			contextLogger.Debug("Healthcheck cannot be healthy yet: not creating route")
 		}
+		decision = "skip_unhealthy"
 		return nil
 	}
 
+	entry := AuditEntry{
+		RouteTable: *rtb.RouteTableId,
+		Cidr:       rs.Cidr,
+		Action:     ActionCreate,
+		NewTarget:  rs.Instance,
+		Reason:     ReasonNoRoute,
+		DryRun:     noop,
+	}
+	if r.refused(contextLogger, entry, r.Safety.protect(rs.Cidr, nil)) || r.refused(contextLogger, entry, r.Safety.limit(ctx, noop)) {
+		decision = "refused"
+		return nil
+	}
+	if err := rs.ensureLocalAddress(contextLogger, noop); err != nil {
+		return err
+	}
 	opts := getCreateRouteInput(rtb, rs.Cidr, rs.Instance, noop)
+	if rs.NetworkInterface != "" {
+		nicID, err := r.routeInterface(ctx, rs)
+		if err != nil {
+			return err
+		}
+		opts.InstanceId = nil
+		opts.NetworkInterfaceId = aws.String(nicID)
+		contextLogger = contextLogger.WithFields(logrus.Fields{"network_interface": nicID})
+	}
 
 	contextLogger.Info("Creating route to my instance")
-	if _, err := r.conn.CreateRoute(ctx, &opts); err != nil {
-		return err
+	decision = "create"
+	_, err = r.conn.CreateRoute(ctx, &opts)
+	if opts.NetworkInterfaceId != nil {
+		entry.NetworkInterface = *opts.NetworkInterfaceId
 	}
-	return nil
+	r.record(entry, err)
+	if err == nil && !noop {
+		rs.history.moved(contextLogger, rs.Damping, *rtb.RouteTableId, true)
+	}
+	return err
+}
+
+// record puts a change to a route (or a failed attempt at one) in the audit log, and
+// tells the notifier about it if it was made.
+func (r RouteTableManagerEC2) record(entry AuditEntry, err error) {
+	r.Audit.Record(entry, err)
+	if r.Notifier != nil && err == nil && entry.Action != ActionSkip {
+		r.Notifier.RouteChanged(entry)
+	}
+}
+
+// refused is true if err is the safety limits stopping a change, which is recorded as
+// refused rather than made.
+func (r RouteTableManagerEC2) refused(contextLogger *logrus.Entry, entry AuditEntry, err error) bool {
+	if err == nil {
+		return false
+	}
+	r.record(entry, err)
+	contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Warn("Not changing route, as the safety limits stop it")
+	return true
+}
+
+// routeTarget is what a route points at.
+func routeTarget(route ec2type.Route) string {
+	for _, target := range []*string{route.InstanceId, route.NetworkInterfaceId, route.GatewayId, route.NatGatewayId, route.TransitGatewayId, route.VpcPeeringConnectionId} {
+		if target != nil {
+			return *target
+		}
+	}
+	return ""
 }
 
 func findRouteFromRouteTable(rtb ec2type.RouteTable, cidr string) *ec2type.Route {
@@ -180,14 +409,14 @@ func (r RouteTableManagerEC2) DeleteInstanceRoute(ctx context.Context, routeTabl
 		DryRun:               aws.Bool(noop),
 	}
 	_, err := r.conn.DeleteRoute(ctx, params)
-	contextLogger := log.WithFields(log.Fields{
+	contextLogger := log.WithFields(logrus.Fields{
 		"cidr": cidr,
 		"rtb":  *routeTableId,
 	})
 	if err != nil {
 		// Print the error, cast err to awserr.Error to get the Code and
 		// Message from an error.
-		contextLogger.WithFields(log.Fields{
+		contextLogger.WithFields(logrus.Fields{
 			"err": err.Error(),
 		}).Warn("Error deleting route")
 		return err
@@ -196,16 +425,16 @@ func (r RouteTableManagerEC2) DeleteInstanceRoute(ctx context.Context, routeTabl
 	return nil
 }
 
-func (r RouteTableManagerEC2) checkRemoteHealthCheck(contextLogger *log.Entry, route ec2type.Route, rs ManageRoutesSpec) bool {
-	contextLogger = contextLogger.WithFields(log.Fields{
+func (r RouteTableManagerEC2) checkRemoteHealthCheck(contextLogger *logrus.Entry, route ec2type.Route, rs ManageRoutesSpec) bool {
+	contextLogger = contextLogger.WithFields(logrus.Fields{
 		"remote_healthcheck": rs.RemoteHealthcheckName,
 		"current_eni":        *(route.NetworkInterfaceId),
 	})
 	contextLogger.Info("Has remote healthcheck ")
-	if ip, ok := eniToIP[*route.NetworkInterfaceId]; ok {
-		contextLogger = contextLogger.WithFields(log.Fields{"current_ip": ip})
-		if hc, ok := rs.remotehealthchecks[ip]; ok {
-			contextLogger = contextLogger.WithFields(log.Fields{
+	if ip, ok := eniIP(*route.NetworkInterfaceId); ok {
+		contextLogger = contextLogger.WithFields(logrus.Fields{"current_ip": ip})
+		if hc, ok := rs.remoteHealthcheck(ip); ok {
+			contextLogger = contextLogger.WithFields(logrus.Fields{
 				"healthcheck_healthy": hc.IsHealthy(),
 				"healthcheck_ready":   hc.CanPassYet(),
 			})
@@ -232,36 +461,101 @@ func (r RouteTableManagerEC2) checkRemoteHealthCheck(contextLogger *log.Entry, r
 	return true
 }
 
-func (r RouteTableManagerEC2) ReplaceInstanceRoute(ctx context.Context, routeTableId *string, route ec2type.Route, rs ManageRoutesSpec, noop bool) error {
+// peerReportsUnhealthy is true if the instance currently holding the route has told us
+// it is unhealthy for it, or has left or died, which is a reason to take over straight away.
+func (r RouteTableManagerEC2) peerReportsUnhealthy(contextLogger *logrus.Entry, route ec2type.Route, cidr string) bool {
+	if r.Peers == nil || route.InstanceId == nil {
+		return false
+	}
+	healthy, known := r.Peers.PeerRouteHealthy(*(route.InstanceId), cidr)
+	if !known {
+		return false
+	}
+	if healthy {
+		contextLogger.Debug("Current route owner reports itself healthy via gossip")
+		return false
+	}
+	contextLogger.Info("Current route owner reports itself unhealthy via gossip (or has gone away) - replacing")
+	return true
+}
+
+// InstanceIPsByTag returns the private IP addresses of all running instances with a tag.
+func (r RouteTableManagerEC2) InstanceIPsByTag(ctx context.Context, key string, value string) ([]string, error) {
+	ips := make([]string, 0)
+	p := ec2.NewDescribeInstancesPaginator(r.conn, &ec2.DescribeInstancesInput{
+		Filters: []ec2type.Filter{
+			{Name: aws.String("tag:" + key), Values: []string{value}},
+			{Name: aws.String("instance-state-name"), Values: []string{"running"}},
+		},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range out.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.PrivateIpAddress != nil {
+					ips = append(ips, *instance.PrivateIpAddress)
+				}
+			}
+		}
+	}
+	return ips, nil
+}
+
+func (r RouteTableManagerEC2) ReplaceInstanceRoute(ctx context.Context, routeTableId *string, route ec2type.Route, rs ManageRoutesSpec, noop bool) (err error) {
+	ctx, span := tracing.Start(ctx, "ReplaceInstanceRoute", tracing.RouteTable.String(*routeTableId), tracing.Cidr.String(rs.Cidr))
+	decision := "none"
+	defer func() {
+		span.SetAttributes(tracing.Decision.String(decision))
+		tracing.End(span, err)
+	}()
 	cidr := rs.Cidr
 	instance := rs.Instance
 	ifUnhealthy := rs.IfUnhealthy
-	contextLogger := log.WithFields(log.Fields{
+	contextLogger := log.WithFields(logrus.Fields{
 		"cidr":                cidr,
 		"rtb":                 *routeTableId,
 		"instance_id":         instance,
 		"current_route_state": route.State,
 	})
 	if route.InstanceId != nil {
-		contextLogger = contextLogger.WithFields(log.Fields{"current_instance_id": *(route.InstanceId)})
+		contextLogger = contextLogger.WithFields(logrus.Fields{"current_instance_id": *(route.InstanceId)})
+	}
+	entry := AuditEntry{
+		RouteTable:     *routeTableId,
+		Cidr:           cidr,
+		Action:         ActionReplace,
+		PreviousTarget: routeTarget(route),
+		NewTarget:      instance,
+		Reason:         ReasonManual,
+		DryRun:         noop,
 	}
+	reason := ReasonManual
 	if ifUnhealthy {
-		if route.State == ec2type.RouteStateActive {
+		if route.State == ec2type.RouteStateActive && route.InstanceId == nil {
+			contextLogger.Debug("Not replacing route, as current route is active and not to an instance")
+			decision = "keep_not_instance"
+			return nil
+		}
+		if route.State == ec2type.RouteStateActive && !r.peerReportsUnhealthy(contextLogger, route, cidr) {
+			reason = ReasonInstanceImpaired
 			if rs.RemoteHealthcheckName != "" {
 				if !r.checkRemoteHealthCheck(contextLogger, route, rs) {
+					decision = "keep_remote_healthy"
 					return nil
 				}
+				reason = ReasonRemoteHealthcheck
 			}
-			o, err := r.conn.DescribeInstanceStatus(ctx, &ec2.DescribeInstanceStatusInput{
-				IncludeAllInstances: aws.Bool(false),
-				InstanceIds:         []string{*(route.InstanceId)},
-			})
+			statuses, err := r.instanceStatuses(ctx, *(route.InstanceId))
 			if err != nil {
-				contextLogger.WithFields(log.Fields{"err": err.Error()}).Error("Error trying to DescribeInstanceStatus, not replacing route")
+				contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Error("Error trying to DescribeInstanceStatus, not replacing route")
+				decision = "keep_status_unknown"
 				return nil
 			}
-			if len(o.InstanceStatuses) == 1 {
-				is := o.InstanceStatuses[0]
+			if len(statuses) == 1 {
+				is := statuses[0]
 				instanceHealthOK := true
 				if is.InstanceStatus.Status == ec2type.SummaryStatusImpaired {
 					instanceHealthOK = false
@@ -270,63 +564,121 @@ func (r RouteTableManagerEC2) ReplaceInstanceRoute(ctx context.Context, routeTab
 				if is.SystemStatus.Status == ec2type.SummaryStatusImpaired {
 					systemHealthOK = false
 				}
-				contextLogger = contextLogger.WithFields(log.Fields{"instanceHealthOK": instanceHealthOK, "systemHealthOK": systemHealthOK})
+				contextLogger = contextLogger.WithFields(logrus.Fields{"instanceHealthOK": instanceHealthOK, "systemHealthOK": systemHealthOK})
 				if instanceHealthOK && systemHealthOK {
 					contextLogger.Info("Not replacing route, as current route is active and instance is healthy")
+					decision = "keep_owner_healthy"
 					return nil
 				}
 			} else {
 				contextLogger.Error("Did not get 1 instance for DescribeInstanceStatus - assuming instance has been terminated")
+				if reason != ReasonRemoteHealthcheck {
+					reason = ReasonInstanceGone
+				}
 			}
-		} else {
+		} else if route.State != ec2type.RouteStateActive {
 			contextLogger.Info("Current route is not active - replacing")
+			reason = ReasonRouteBlackhole
+		} else {
+			reason = ReasonPeerUnhealthy
 		}
 	}
 	if rs.HealthcheckName != "" && !rs.healthcheck.IsHealthy() && rs.healthcheck.CanPassYet() {
 		contextLogger.Info("Not replacing route, as local healthcheck is failing")
+		decision = "skip_unhealthy"
+		return nil
+	}
+	if rs.localAddressMissing() {
+		contextLogger.Warn("Not replacing route, as route address is not configured on any local interface")
+		decision = "skip_address_missing"
 		return nil
 	}
+	if rs.drain.Draining() {
+		contextLogger.Info("Not replacing route, as we are draining")
+		decision = "skip_draining"
+		return nil
+	}
+	if (reason == ReasonManual || reason == ReasonRemoteHealthcheck || reason == ReasonPeerUnhealthy) && rs.history.suppressed(contextLogger, rs.Damping, *routeTableId) {
+		contextLogger.WithFields(logrus.Fields{"reason": reason}).Warn("Not replacing route, as it is flapping and damping suppresses it")
+		decision = "skip_suppressed"
+		return nil
+	}
+	entry.Reason = reason
+	if r.refused(contextLogger, entry, r.Safety.protect(cidr, &route)) || r.refused(contextLogger, entry, r.Safety.limit(ctx, noop)) {
+		decision = "refused"
+		return nil
+	}
+	if err := rs.ensureLocalAddress(contextLogger, noop); err != nil {
+		return err
+	}
 	if len(rs.RunBeforeReplaceRoute) > 0 {
 		cmd := rs.RunBeforeReplaceRoute[0]
 		if err := exec.Command(cmd, rs.RunBeforeReplaceRoute[1:]...).Run(); err != nil {
-			contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("RunBeforeReplaceRoute failed")
+			contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Debug("RunBeforeReplaceRoute failed")
 		}
 	}
 
-	nicID, err := r.routerInterface(ctx, instance)
+	decision = "replace"
+	nicID, err := r.routeInterface(ctx, rs)
 	if err != nil {
 		if err != nil {
-			contextLogger.WithFields(log.Fields{
+			r.record(entry, err)
+			contextLogger.WithFields(logrus.Fields{
 				"err": err.Error(),
 			}).Warn("Error replacing route")
 			return err
 		}
 	}
-	if _, err = r.conn.ReplaceRoute(ctx, &ec2.ReplaceRouteInput{
+	entry.NetworkInterface = nicID
+	_, err = r.conn.ReplaceRoute(ctx, &ec2.ReplaceRouteInput{
 		DestinationCidrBlock: aws.String(cidr),
 		RouteTableId:         routeTableId,
 		NetworkInterfaceId:   aws.String(nicID),
 		DryRun:               aws.Bool(noop),
-	}); err != nil {
-		contextLogger.WithFields(log.Fields{
+	})
+	r.record(entry, err)
+	if err != nil {
+		contextLogger.WithFields(logrus.Fields{
 			"err": err.Error(),
 		}).Warn("Error replacing route")
 		return err
 	}
 	contextLogger.Info("Replaced route")
+	if !noop {
+		rs.history.moved(contextLogger, rs.Damping, *routeTableId, true)
+	}
 	if len(rs.RunAfterReplaceRoute) > 0 {
 		cmd := rs.RunAfterReplaceRoute[0]
 		if err := exec.Command(cmd, rs.RunAfterReplaceRoute[1:]...).Run(); err != nil {
-			contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("RunAfterReplaceRoute failed")
+			contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Debug("RunAfterReplaceRoute failed")
 		}
 	}
 	return nil
 }
 
+// instanceStatuses describes the status of an instance which holds a route, from this pass's
+// batch if it is in it.
+func (r RouteTableManagerEC2) instanceStatuses(ctx context.Context, instanceID string) ([]ec2type.InstanceStatus, error) {
+	if is, ok := lookupsFrom(ctx).instanceStatus(ctx, r.conn, instanceID); ok {
+		if is == nil {
+			return []ec2type.InstanceStatus{}, nil
+		}
+		return []ec2type.InstanceStatus{*is}, nil
+	}
+	o, err := r.conn.DescribeInstanceStatus(ctx, &ec2.DescribeInstanceStatusInput{
+		IncludeAllInstances: aws.Bool(false),
+		InstanceIds:         []string{instanceID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o.InstanceStatuses, nil
+}
+
 func (r RouteTableManagerEC2) GetRouteTables(ctx context.Context) ([]ec2type.RouteTable, error) {
 	resp, err := r.conn.DescribeRouteTables(ctx, &ec2.DescribeRouteTablesInput{})
 	if err != nil {
-		log.WithFields(log.Fields{
+		log.WithFields(logrus.Fields{
 			"err": err.Error(),
 		}).Warn("Error on DescribeRouteTables")
 		return []ec2type.RouteTable{}, err
@@ -334,6 +686,22 @@ func (r RouteTableManagerEC2) GetRouteTables(ctx context.Context) ([]ec2type.Rou
 	return resp.RouteTables, nil
 }
 
+// GetRouteTable describes a single route table again, to get its current routes.
+func (r RouteTableManagerEC2) GetRouteTable(ctx context.Context, id string) (ec2type.RouteTable, error) {
+	resp, err := r.conn.DescribeRouteTables(ctx, &ec2.DescribeRouteTablesInput{RouteTableIds: []string{id}})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"rtb": id,
+			"err": err.Error(),
+		}).Warn("Error on DescribeRouteTables")
+		return ec2type.RouteTable{}, err
+	}
+	if len(resp.RouteTables) != 1 {
+		return ec2type.RouteTable{}, errors.New(fmt.Sprintf("Route table %s not found", id))
+	}
+	return resp.RouteTables[0], nil
+}
+
 func getCreateRouteInput(rtb ec2type.RouteTable, cidr string, instance string, noop bool) ec2.CreateRouteInput {
 	return ec2.CreateRouteInput{
 		RouteTableId:         rtb.RouteTableId,
@@ -0,0 +1,170 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+
+	"github.com/justenwalker/awsnycast/clock"
+)
+
+// Safety is the top level 'safety' key: limits on the changes RouteTableManagerEC2 will
+// make to routes, so that a bad config can't wreck the route tables. Even without one,
+// routes to internet, VPN and transit gateways are never changed.
+type Safety struct {
+	ProtectedCidrs      []string `yaml:"protected_cidrs"`
+	AllowGatewayTargets bool     `yaml:"allow_gateway_targets"`
+	MaxChangesPerRun    int      `yaml:"max_changes_per_run"`
+	MaxChangesPerMinute int      `yaml:"max_changes_per_minute"`
+	Cooldown            uint     `yaml:"cooldown"`
+
+	clock clock.Clock
+	sync.Mutex
+	recent    []time.Time
+	openUntil time.Time
+}
+
+// RefusedError is a change to a route which the safety limits stopped.
+type RefusedError struct {
+	Reason string
+}
+
+func (e RefusedError) Error() string {
+	return "refused: " + e.Reason
+}
+
+func (s *Safety) Validate() error {
+	var result *multierror.Error
+	for i, cidr := range s.ProtectedCidrs {
+		if !strings.Contains(cidr, "/") {
+			s.ProtectedCidrs[i] = cidr + "/32"
+		}
+		if _, _, err := net.ParseCIDR(s.ProtectedCidrs[i]); err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Could not parse safety protected_cidrs %s", err.Error())))
+		}
+	}
+	if s.MaxChangesPerRun < 0 || s.MaxChangesPerMinute < 0 {
+		result = multierror.Append(result, errors.New("safety max_changes_per_run and max_changes_per_minute cannot be negative"))
+	}
+	if s.Cooldown == 0 {
+		s.Cooldown = 300
+	}
+	return result.ErrorOrNil()
+}
+
+func (s *Safety) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+func (s *Safety) now() time.Time {
+	if s.clock == nil {
+		return clock.Real.Now()
+	}
+	return s.clock.Now()
+}
+
+// Protects is true if cidr is (or is inside) one of the protected_cidrs.
+func (s *Safety) Protects(cidr string) bool {
+	if s == nil {
+		return false
+	}
+	return insideCidr(cidr, s.ProtectedCidrs) != ""
+}
+
+type runChangesKey struct{}
+
+// StartRun returns a context for a pass over the route tables (a poll, or a reevaluation
+// after a healthcheck changes), with its own count of changes for max_changes_per_run.
+// Changes made outside of one only count towards max_changes_per_minute.
+func (s *Safety) StartRun(ctx context.Context) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, runChangesKey{}, new(int))
+}
+
+// BreakerOpen is true while changes are stopped, after going over a limit.
+func (s *Safety) BreakerOpen() bool {
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.now().Before(s.openUntil)
+}
+
+// gatewayTarget is the internet, VPN or transit gateway (or the VPC's local route) a
+// route points at, if it does.
+func gatewayTarget(route *ec2type.Route) string {
+	if route == nil {
+		return ""
+	}
+	if route.TransitGatewayId != nil {
+		return *route.TransitGatewayId
+	}
+	if route.GatewayId != nil {
+		return *route.GatewayId // igw-, vgw- or local
+	}
+	return ""
+}
+
+// protect refuses any change to a protected CIDR, or to a route (currently route, or nil
+// if there isn't one yet) pointing at a gateway unless allow_gateway_targets is set.
+func (s *Safety) protect(cidr string, route *ec2type.Route) error {
+	if s.Protects(cidr) {
+		return RefusedError{fmt.Sprintf("%s is in safety protected_cidrs", cidr)}
+	}
+	if target := gatewayTarget(route); target == "local" || (target != "" && (s == nil || !s.AllowGatewayTargets)) {
+		return RefusedError{fmt.Sprintf("route points at gateway %s", target)}
+	}
+	return nil
+}
+
+// limit counts a change about to be made in the run ctx is for. Going over
+// max_changes_per_run or max_changes_per_minute opens the breaker, which refuses all
+// changes for the cooldown. With noop, nothing is changed, so nothing is counted.
+func (s *Safety) limit(ctx context.Context, noop bool) error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	now := s.now()
+	if now.Before(s.openUntil) {
+		return RefusedError{fmt.Sprintf("too many route changes, stopped until %s", s.openUntil.UTC().Format(time.RFC3339))}
+	}
+	if noop {
+		return nil
+	}
+	runChanges, ok := ctx.Value(runChangesKey{}).(*int)
+	if !ok {
+		runChanges = new(int)
+	}
+	recent := s.recent[:0]
+	for _, t := range s.recent {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	s.recent = recent
+	if (s.MaxChangesPerRun > 0 && *runChanges >= s.MaxChangesPerRun) || (s.MaxChangesPerMinute > 0 && len(s.recent) >= s.MaxChangesPerMinute) {
+		s.openUntil = now.Add(time.Duration(s.Cooldown) * time.Second)
+		log.WithFields(logrus.Fields{
+			"changes_this_run":       *runChanges,
+			"changes_in_last_minute": len(s.recent),
+			"until":                  s.openUntil.UTC().Format(time.RFC3339),
+		}).Error("Too many route changes, stopping all changes")
+		return RefusedError{fmt.Sprintf("too many route changes, stopped until %s", s.openUntil.UTC().Format(time.RFC3339))}
+	}
+	*runChanges++
+	s.recent = append(s.recent, now)
+	return nil
+}
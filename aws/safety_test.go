@@ -0,0 +1,198 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/justenwalker/awsnycast/clock"
+	"github.com/justenwalker/awsnycast/ec2sim"
+)
+
+func getSafeSim(t *testing.T, s *Safety) (*ec2sim.EC2, *RouteTableManagerEC2, string, *clock.Fake) {
+	c := clock.NewFake(auditStart)
+	if s != nil {
+		assert.Nil(t, s.Validate())
+		s.SetClock(c)
+	}
+	sim, rtm, path := getAuditedSim(t)
+	rtm.Safety = s
+	return sim, rtm, path, c
+}
+
+func TestSafetyValidate(t *testing.T) {
+	s := &Safety{ProtectedCidrs: []string{"10.0.0.0/16", "192.168.0.1", "nonsense"}, MaxChangesPerRun: -1}
+	err := s.Validate()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Could not parse safety protected_cidrs invalid CIDR address: nonsense")
+		assert.Contains(t, err.Error(), "safety max_changes_per_run and max_changes_per_minute cannot be negative")
+	}
+	assert.Equal(t, s.ProtectedCidrs[1], "192.168.0.1/32")
+	assert.Equal(t, s.Cooldown, uint(300))
+}
+
+func TestSafetyProtects(t *testing.T) {
+	s := &Safety{ProtectedCidrs: []string{"10.0.0.0/16", "192.168.0.1/32"}}
+	assert.Nil(t, s.Validate())
+	assert.Equal(t, s.Protects("10.0.0.0/16"), true)
+	assert.Equal(t, s.Protects("10.0.5.0/24"), true)
+	assert.Equal(t, s.Protects("192.168.0.1/32"), true)
+	assert.Equal(t, s.Protects("10.0.0.0/8"), false)
+	assert.Equal(t, s.Protects("0.0.0.0/0"), false)
+	assert.Equal(t, s.Protects("192.168.0.2/32"), false)
+	var none *Safety
+	assert.Equal(t, none.Protects("10.0.0.0/16"), false)
+}
+
+func TestSafetyProtectedCidrNotCreated(t *testing.T) {
+	sim, rtm, path, _ := getSafeSim(t, &Safety{ProtectedCidrs: []string{"192.168.0.0/16"}})
+	sim.AddRouteTable("rtb-2", "vpc-1", "10.0.0.0/16", nil)
+	tables, _ := rtm.GetRouteTables(context.Background())
+	assert.Nil(t, rtm.ManageInstanceRoute(context.Background(), tables[1], ManageRoutesSpec{Cidr: "192.168.0.0/24", Instance: "i-backup1"}, false))
+	assert.Equal(t, len(sim.CallsTo("CreateRoute")), 0)
+	entries := readAudit(t, path)
+	if assert.Equal(t, len(entries), 1) {
+		assert.Equal(t, entries[0].Action, ActionCreate)
+		assert.Equal(t, entries[0].Result, "refused")
+		assert.Equal(t, entries[0].Error, "refused: 192.168.0.0/24 is in safety protected_cidrs")
+	}
+}
+
+func TestSafetyGatewayRouteNotReplaced(t *testing.T) {
+	for _, gw := range []string{"igw-1234", "vgw-1234", "tgw-1234"} {
+		sim := getSimFailover(t)
+		rtm := NewRouteTableManagerEC2WithAPI(sim)
+		assert.Nil(t, sim.AddRoute("rtb-1", "192.168.0.0/16", gw))
+		tables, _ := rtm.GetRouteTables(context.Background())
+		rs := ManageRoutesSpec{Cidr: "192.168.0.0/16", Instance: "i-backup1", IfUnhealthy: true}
+		assert.Nil(t, rtm.ManageInstanceRoute(context.Background(), tables[0], rs, false))
+		assert.Equal(t, sim.RouteTarget("rtb-1", "192.168.0.0/16"), gw)
+		assert.Equal(t, len(sim.CallsTo("ReplaceRoute")), 0)
+		assert.Equal(t, len(sim.CallsTo("DescribeInstanceStatus")), 0)
+	}
+}
+
+func TestSafetyGatewayRouteReplacedIfAllowed(t *testing.T) {
+	sim, rtm, _, _ := getSafeSim(t, &Safety{AllowGatewayTargets: true})
+	assert.Nil(t, sim.AddRoute("rtb-1", "192.168.0.0/16", "igw-1234"))
+	tables, _ := rtm.GetRouteTables(context.Background())
+	assert.Nil(t, rtm.ManageInstanceRoute(context.Background(), tables[0], ManageRoutesSpec{Cidr: "192.168.0.0/16", Instance: "i-backup1"}, false))
+	assert.Equal(t, sim.RouteTarget("rtb-1", "192.168.0.0/16"), "i-backup1")
+}
+
+// manageSimRoutes takes over count routes (192.168.<n>.0/24) for i-backup1.
+// Each call is a run of its own.
+func manageSimRoutes(t *testing.T, sim *ec2sim.EC2, rtm *RouteTableManagerEC2, count int) {
+	ctx := rtm.Safety.StartRun(context.Background())
+	tables, _ := rtm.GetRouteTables(ctx)
+	for i := 0; i < count; i++ {
+		rs := ManageRoutesSpec{Cidr: fmt.Sprintf("192.168.%d.0/24", i), Instance: "i-backup1"}
+		assert.Nil(t, rtm.ManageInstanceRoute(ctx, tables[0], rs, false))
+	}
+}
+
+func TestSafetyMaxChangesPerRun(t *testing.T) {
+	sim, rtm, path, c := getSafeSim(t, &Safety{MaxChangesPerRun: 2, Cooldown: 60})
+	manageSimRoutes(t, sim, rtm, 3)
+	assert.Equal(t, len(sim.CallsTo("CreateRoute")), 2)
+	assert.Equal(t, rtm.Safety.BreakerOpen(), true)
+	entries := readAudit(t, path)
+	if assert.Equal(t, len(entries), 3) {
+		assert.Equal(t, entries[2].Cidr, "192.168.2.0/24")
+		assert.Equal(t, entries[2].Result, "refused")
+		assert.Equal(t, entries[2].Error, "refused: too many route changes, stopped until 2016-01-01T00:01:00Z")
+	}
+
+	// The breaker stays open for the cooldown, even in a new run
+	c.Advance(59 * time.Second)
+	manageSimRoutes(t, sim, rtm, 3)
+	assert.Equal(t, len(sim.CallsTo("CreateRoute")), 2)
+
+	c.Advance(time.Second)
+	assert.Equal(t, rtm.Safety.BreakerOpen(), false)
+	manageSimRoutes(t, sim, rtm, 3)
+	assert.Equal(t, len(sim.CallsTo("CreateRoute")), 3)
+	assert.Equal(t, sim.RouteTarget("rtb-1", "192.168.2.0/24"), "i-backup1")
+}
+
+func TestSafetyMaxChangesPerMinute(t *testing.T) {
+	sim, rtm, _, c := getSafeSim(t, &Safety{MaxChangesPerMinute: 2})
+	tables, _ := rtm.GetRouteTables(context.Background())
+	change := func(cidr string) {
+		rs := ManageRoutesSpec{Cidr: cidr, Instance: "i-backup1"}
+		assert.Nil(t, rtm.ManageInstanceRoute(context.Background(), tables[0], rs, false))
+	}
+	change("192.168.0.0/24")
+	c.Advance(30 * time.Second)
+	change("192.168.1.0/24")
+	c.Advance(31 * time.Second) // The first has dropped out of the last minute
+	change("192.168.2.0/24")
+	assert.Equal(t, rtm.Safety.BreakerOpen(), false)
+	change("192.168.3.0/24")
+	assert.Equal(t, rtm.Safety.BreakerOpen(), true)
+	assert.Equal(t, len(sim.CallsTo("CreateRoute")), 3)
+}
+
+func TestSafetyBreakerStopsDeletes(t *testing.T) {
+	sim, rtm, _, _ := getSafeSim(t, &Safety{MaxChangesPerRun: 1})
+	sim.SetInstanceStatus("i-primary", ec2type.SummaryStatusImpaired, ec2type.SummaryStatusOk)
+	ctx := rtm.Safety.StartRun(context.Background())
+	tables, _ := rtm.GetRouteTables(ctx)
+	assert.Nil(t, rtm.ManageInstanceRoute(ctx, tables[0], ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-backup1", IfUnhealthy: true}, false))
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-backup1")
+
+	tables, _ = rtm.GetRouteTables(ctx)
+	rs := ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-backup1", HealthcheckName: "service", healthcheck: &FakeHealthCheck{isHealthy: false}}
+	assert.Nil(t, rtm.ManageInstanceRoute(ctx, tables[0], rs, false))
+	assert.Equal(t, sim.RouteTarget("rtb-1", "0.0.0.0/0"), "i-backup1")
+	assert.Equal(t, len(sim.CallsTo("DeleteRoute")), 0)
+}
+
+func TestSafetyNoopNotCounted(t *testing.T) {
+	sim, rtm, _, _ := getSafeSim(t, &Safety{MaxChangesPerRun: 1, MaxChangesPerMinute: 1})
+	ctx := rtm.Safety.StartRun(context.Background())
+	tables, _ := rtm.GetRouteTables(ctx)
+	for i := 0; i < 3; i++ {
+		rs := ManageRoutesSpec{Cidr: fmt.Sprintf("192.168.%d.0/24", i), Instance: "i-backup1"}
+		rtm.ManageInstanceRoute(ctx, tables[0], rs, true) // DryRun errors, as it would have succeeded
+	}
+	assert.Equal(t, rtm.Safety.BreakerOpen(), false)
+	assert.Nil(t, rtm.ManageInstanceRoute(ctx, tables[0], ManageRoutesSpec{Cidr: "192.168.0.0/24", Instance: "i-backup1"}, false))
+	assert.Equal(t, sim.RouteTarget("rtb-1", "192.168.0.0/24"), "i-backup1")
+}
+
+func TestSafetyGatewayRouteKeptIsNotRefused(t *testing.T) {
+	sim, rtm, path, _ := getSafeSim(t, &Safety{})
+	assert.Nil(t, sim.AddRoute("rtb-1", "192.168.0.0/16", "igw-1234"))
+	tables, _ := rtm.GetRouteTables(context.Background())
+	rs := ManageRoutesSpec{Cidr: "192.168.0.0/16", Instance: "i-backup1", IfUnhealthy: true}
+	assert.Nil(t, rtm.ManageInstanceRoute(context.Background(), tables[0], rs, false))
+	assert.Equal(t, len(readAudit(t, path)), 0)
+
+	// Without if_unhealthy, we would replace it
+	rs.IfUnhealthy = false
+	assert.Nil(t, rtm.ManageInstanceRoute(context.Background(), tables[0], rs, false))
+	entries := readAudit(t, path)
+	if assert.Equal(t, len(entries), 1) {
+		assert.Equal(t, entries[0].Action, ActionReplace)
+		assert.Equal(t, entries[0].Error, "refused: route points at gateway igw-1234")
+	}
+	assert.Equal(t, sim.RouteTarget("rtb-1", "192.168.0.0/16"), "igw-1234")
+}
+
+func TestSafetyHealthcheckRunHasItsOwnBudget(t *testing.T) {
+	sim, rs := getReevaluatedSpec(t)
+	rtm := rs.Manager.(*RouteTableManagerEC2)
+	rtm.Safety = &Safety{MaxChangesPerRun: 1}
+	assert.Nil(t, rtm.Safety.Validate())
+	sim.AddRouteTable("rtb-2", "vpc-1", "10.0.0.0/16", nil)
+	assert.Nil(t, sim.AddRoute("rtb-2", "0.0.0.0/0", "i-primary"))
+	rs.ec2RouteTables, _ = rtm.GetRouteTables(context.Background())
+	rs.handleHealthcheckResult(context.Background(), true, false, false)
+	assert.Equal(t, len(sim.CallsTo("ReplaceRoute")), 1)
+	assert.Equal(t, rtm.Safety.BreakerOpen(), true)
+}
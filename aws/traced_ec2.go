@@ -0,0 +1,95 @@
+package aws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/justenwalker/awsnycast/tracing"
+)
+
+// tracedEC2 makes a span of each EC2 API call, so that traces show how long each took.
+type tracedEC2 struct {
+	EC2API
+}
+
+func startEC2Span(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, semconv.RPCSystemKey.String("aws-api"), semconv.RPCServiceKey.String("EC2"), semconv.RPCMethodKey.String(method))
+	return tracing.Start(ctx, "EC2."+method, attrs...)
+}
+
+func routeAttrs(rtb *string, cidr *string) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, 2)
+	if rtb != nil {
+		attrs = append(attrs, tracing.RouteTable.String(*rtb))
+	}
+	if cidr != nil {
+		attrs = append(attrs, tracing.Cidr.String(*cidr))
+	}
+	return attrs
+}
+
+func (t tracedEC2) CreateRoute(ctx context.Context, in *ec2.CreateRouteInput, opts ...func(*ec2.Options)) (*ec2.CreateRouteOutput, error) {
+	ctx, span := startEC2Span(ctx, "CreateRoute", routeAttrs(in.RouteTableId, in.DestinationCidrBlock)...)
+	out, err := t.EC2API.CreateRoute(ctx, in, opts...)
+	tracing.End(span, err)
+	return out, err
+}
+
+func (t tracedEC2) ReplaceRoute(ctx context.Context, in *ec2.ReplaceRouteInput, opts ...func(*ec2.Options)) (*ec2.ReplaceRouteOutput, error) {
+	ctx, span := startEC2Span(ctx, "ReplaceRoute", routeAttrs(in.RouteTableId, in.DestinationCidrBlock)...)
+	out, err := t.EC2API.ReplaceRoute(ctx, in, opts...)
+	tracing.End(span, err)
+	return out, err
+}
+
+func (t tracedEC2) DescribeRouteTables(ctx context.Context, in *ec2.DescribeRouteTablesInput, opts ...func(*ec2.Options)) (*ec2.DescribeRouteTablesOutput, error) {
+	ctx, span := startEC2Span(ctx, "DescribeRouteTables")
+	out, err := t.EC2API.DescribeRouteTables(ctx, in, opts...)
+	tracing.End(span, err)
+	return out, err
+}
+
+func (t tracedEC2) DeleteRoute(ctx context.Context, in *ec2.DeleteRouteInput, opts ...func(*ec2.Options)) (*ec2.DeleteRouteOutput, error) {
+	ctx, span := startEC2Span(ctx, "DeleteRoute", routeAttrs(in.RouteTableId, in.DestinationCidrBlock)...)
+	out, err := t.EC2API.DeleteRoute(ctx, in, opts...)
+	tracing.End(span, err)
+	return out, err
+}
+
+func (t tracedEC2) DescribeNetworkInterfaces(ctx context.Context, in *ec2.DescribeNetworkInterfacesInput, opts ...func(*ec2.Options)) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	ctx, span := startEC2Span(ctx, "DescribeNetworkInterfaces")
+	out, err := t.EC2API.DescribeNetworkInterfaces(ctx, in, opts...)
+	tracing.End(span, err)
+	return out, err
+}
+
+func (t tracedEC2) DescribeInstanceAttribute(ctx context.Context, in *ec2.DescribeInstanceAttributeInput, opts ...func(*ec2.Options)) (*ec2.DescribeInstanceAttributeOutput, error) {
+	ctx, span := startEC2Span(ctx, "DescribeInstanceAttribute")
+	if in.InstanceId != nil {
+		span.SetAttributes(tracing.Instance.String(*in.InstanceId))
+	}
+	out, err := t.EC2API.DescribeInstanceAttribute(ctx, in, opts...)
+	tracing.End(span, err)
+	return out, err
+}
+
+func (t tracedEC2) DescribeInstanceStatus(ctx context.Context, in *ec2.DescribeInstanceStatusInput, opts ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error) {
+	ctx, span := startEC2Span(ctx, "DescribeInstanceStatus")
+	if len(in.InstanceIds) == 1 {
+		span.SetAttributes(tracing.Instance.String(in.InstanceIds[0]))
+	}
+	out, err := t.EC2API.DescribeInstanceStatus(ctx, in, opts...)
+	tracing.End(span, err)
+	return out, err
+}
+
+func (t tracedEC2) DescribeInstances(ctx context.Context, in *ec2.DescribeInstancesInput, opts ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	ctx, span := startEC2Span(ctx, "DescribeInstances")
+	out, err := t.EC2API.DescribeInstances(ctx, in, opts...)
+	tracing.End(span, err)
+	return out, err
+}
@@ -0,0 +1,39 @@
+package aws
+
+import "sync"
+
+// Workers bound how many routes are being worked on at once, across everything
+// sharing them. A nil Workers runs everything one at a time.
+type Workers chan struct{}
+
+// NewWorkers allows n things to run at once.
+func NewWorkers(n int) Workers {
+	if n < 1 {
+		n = 1
+	}
+	return make(Workers, n)
+}
+
+// Run calls f with each of 0 to n-1, as many at once as there are free workers, and
+// waits for them all to finish.
+func (w Workers) Run(n int, f func(i int)) {
+	if w == nil {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		w <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-w
+				wg.Done()
+			}()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
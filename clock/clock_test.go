@@ -0,0 +1,55 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func fired(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFakeAfter(t *testing.T) {
+	f := NewFake(start)
+	c := f.After(2 * time.Second)
+	assert.Equal(t, f.Waiting(), 1)
+	f.Advance(time.Second)
+	assert.False(t, fired(c))
+	f.Advance(time.Second)
+	assert.True(t, fired(c))
+	assert.Equal(t, f.Waiting(), 0)
+	assert.Equal(t, f.Now(), start.Add(2*time.Second))
+	assert.True(t, fired(f.After(0)))
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(start)
+	ticker := f.NewTicker(time.Second)
+	f.Advance(time.Second)
+	assert.Equal(t, <-ticker.Chan(), start.Add(time.Second))
+	// Ticks nobody reads are dropped
+	f.Advance(3 * time.Second)
+	assert.Equal(t, <-ticker.Chan(), start.Add(2*time.Second))
+	assert.False(t, fired(ticker.Chan()))
+	ticker.Stop()
+	f.Advance(time.Second)
+	assert.False(t, fired(ticker.Chan()))
+	assert.Equal(t, f.Waiting(), 0)
+}
+
+func TestReal(t *testing.T) {
+	ticker := Real.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	<-ticker.Chan()
+	<-Real.After(time.Millisecond)
+	assert.False(t, Real.Now().IsZero())
+}
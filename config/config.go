@@ -4,20 +4,131 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
 
 	"github.com/hashicorp/go-multierror"
 	"gopkg.in/yaml.v2"
 
 	"github.com/justenwalker/awsnycast/aws"
+	"github.com/justenwalker/awsnycast/gossip"
 	"github.com/justenwalker/awsnycast/healthcheck"
 	"github.com/justenwalker/awsnycast/instancemetadata"
+	"github.com/justenwalker/awsnycast/logging"
+	"github.com/justenwalker/awsnycast/notify"
+	"github.com/justenwalker/awsnycast/tracing"
 )
 
+var log = logging.For("config")
+
 type Config struct {
 	PollTime                   uint                                `yaml:"poll_time"`
 	Healthchecks               map[string]*healthcheck.Healthcheck `yaml:"healthchecks"`
 	RemoteHealthcheckTemplates map[string]*healthcheck.Healthcheck `yaml:"remote_healthchecks"`
 	RouteTables                map[string]*RouteTable              `yaml:"routetables"`
+	Gossip                     *gossip.Config                      `yaml:"gossip"`
+	Status                     *StatusConfig                       `yaml:"status"`
+	Metadata                   *instancemetadata.Static            `yaml:"metadata"`
+	Spot                       *SpotConfig                         `yaml:"spot"`
+	AutoScaling                *AutoScalingConfig                  `yaml:"autoscaling"`
+	AWS                        *AWSConfig                          `yaml:"aws"`
+	Tracing                    *tracing.Config                     `yaml:"tracing"`
+	Audit                      *AuditConfig                        `yaml:"audit"`
+	Notifications              map[string]*notify.Webhook          `yaml:"notifications"`
+	Safety                     *aws.Safety                         `yaml:"safety"`
+	StartupFailure             string                              `yaml:"startup_failure"`
+	Parallelism                int                                 `yaml:"parallelism"`
+	Logging                    logging.Config                      `yaml:",inline"`
+}
+
+// What to do if the first run over the route tables fails: exit (the default), or keep
+// running and try again every poll_time.
+const (
+	StartupExit        = "exit"
+	StartupKeepRunning = "keep_running"
+)
+
+// StatusConfig is where the daemon serves its current state as JSON, for people and for
+// the peer_status of other instances' remote healthchecks.
+type StatusConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+// AuditConfig is where to append a JSON line for every change made to a route.
+type AuditConfig struct {
+	Path string `yaml:"path"`
+}
+
+// SpotConfig watches the metadata service for notice that this (spot) instance is about
+// to be interrupted, and drains its routes to other instances when it is.
+type SpotConfig struct {
+	Interval         float64 `yaml:"interval"`
+	DrainOnRebalance bool    `yaml:"drain_on_rebalance"`
+}
+
+// AutoScalingConfig drains routes when the instance's Auto Scaling group is terminating it
+// (or moving it to a warm pool), and completes the lifecycle action once they're handed over.
+type AutoScalingConfig struct {
+	LifecycleHook string  `yaml:"lifecycle_hook"`
+	GroupName     string  `yaml:"group_name"`
+	Interval      float64 `yaml:"interval"`
+	DrainTimeout  float64 `yaml:"drain_timeout"`
+	Endpoint      string  `yaml:"endpoint"`
+}
+
+func (a *AutoScalingConfig) Validate() error {
+	var result *multierror.Error
+	if a.LifecycleHook == "" {
+		result = multierror.Append(result, errors.New("autoscaling needs a lifecycle_hook"))
+	}
+	if a.Interval < 0 || a.DrainTimeout < 0 {
+		result = multierror.Append(result, errors.New("autoscaling interval and drain_timeout cannot be negative"))
+	}
+	if a.Interval == 0 {
+		a.Interval = 5
+	}
+	if a.DrainTimeout == 0 {
+		a.DrainTimeout = 60
+	}
+	return result.ErrorOrNil()
+}
+
+// AWSConfig is how the AWS APIs are reached: through a VPC interface endpoint or a proxy,
+// or at a local stand-in (e.g. LocalStack or moto) for testing.
+type AWSConfig struct {
+	EC2Endpoint string `yaml:"ec2_endpoint"`
+	CABundle    string `yaml:"ca_bundle"`
+	Proxy       string `yaml:"proxy"`
+	RetryMode   string `yaml:"retry_mode"`
+	MaxAttempts int    `yaml:"max_attempts"`
+}
+
+func (a *AWSConfig) Validate() error {
+	var result *multierror.Error
+	if a.EC2Endpoint != "" {
+		if u, err := url.Parse(a.EC2Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("aws ec2_endpoint '%s' is not an http or https URL", a.EC2Endpoint)))
+		}
+	}
+	if a.Proxy != "" {
+		if u, err := url.Parse(a.Proxy); err != nil || u.Scheme == "" || u.Host == "" {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("aws proxy '%s' is not a URL", a.Proxy)))
+		}
+	}
+	if a.RetryMode == "" {
+		a.RetryMode = "standard"
+	}
+	if a.RetryMode != "standard" && a.RetryMode != "adaptive" {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("aws retry_mode '%s' is not standard or adaptive", a.RetryMode)))
+	}
+	if a.MaxAttempts < 0 {
+		result = multierror.Append(result, errors.New("aws max_attempts cannot be negative"))
+	}
+	if a.MaxAttempts == 0 {
+		a.MaxAttempts = 3
+	}
+	return result.ErrorOrNil()
 }
 
 func New(filename string, im instancemetadata.InstanceMetadata, manager aws.RouteTableManager) (*Config, error) {
@@ -26,6 +137,12 @@ func New(filename string, im instancemetadata.InstanceMetadata, manager aws.Rout
 	if err != nil {
 		return c, err
 	}
+	if isTemplate(filename) {
+		data, err = renderTemplate(filename, data, im)
+		if err != nil {
+			return c, err
+		}
+	}
 	err = yaml.Unmarshal(data, &c)
 	if err == nil {
 		err = c.Validate(im, manager)
@@ -33,6 +150,69 @@ func New(filename string, im instancemetadata.InstanceMetadata, manager aws.Rout
 	return c, err
 }
 
+// readEarly reads top level keys of the config file that are needed before the rest of it
+// can be, without any instance metadata. If the file is a template, those keys can't use it.
+func readEarly(filename string, out interface{}, keys ...string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if isTemplate(filename) {
+		data, err = untemplatedKeys(data, keys...)
+		if err != nil {
+			return err
+		}
+	}
+	return yaml.Unmarshal(data, out)
+}
+
+// StaticMetadata reads just the metadata key from a config file, as we need instance
+// metadata before the rest of the config can be validated.
+func StaticMetadata(filename string) (*instancemetadata.Static, error) {
+	var c struct {
+		Metadata *instancemetadata.Static `yaml:"metadata"`
+	}
+	if err := readEarly(filename, &c, "metadata"); err != nil {
+		return nil, err
+	}
+	return c.Metadata, nil
+}
+
+// AWS reads the aws key from a config file, which is needed to talk to EC2 before the
+// rest of the config (which is checked against EC2) can be. It's never nil.
+func AWS(filename string, im instancemetadata.InstanceMetadata) (*AWSConfig, error) {
+	var c struct {
+		AWS *AWSConfig `yaml:"aws"`
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if isTemplate(filename) {
+		data, err = renderTemplate(filename, data, im)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if c.AWS == nil {
+		c.AWS = &AWSConfig{}
+	}
+	return c.AWS, c.AWS.Validate()
+}
+
+// Logging reads the log_* keys from a config file, so that logging can be set up before
+// anything else is done.
+func Logging(filename string) (*logging.Config, error) {
+	var c logging.Config
+	if err := readEarly(filename, &c, "log_format", "log_file", "log_syslog", "log_levels"); err != nil {
+		return nil, err
+	}
+	return &c, c.Validate()
+}
+
 func (c *Config) Validate(im instancemetadata.InstanceMetadata, manager aws.RouteTableManager) error {
 	if c.PollTime == 0 {
 		c.PollTime = 300 // Default to every 5m
@@ -63,6 +243,9 @@ func (c *Config) Validate(im instancemetadata.InstanceMetadata, manager aws.Rout
 	} else {
 		c.Healthchecks = make(map[string]*healthcheck.Healthcheck)
 	}
+	if err := c.resolveHealthcheckDependencies(); err != nil {
+		result = multierror.Append(result, err)
+	}
 	if c.RemoteHealthcheckTemplates != nil {
 		for k, v := range c.RemoteHealthcheckTemplates {
 			if err := v.Validate(k, true); err != nil {
@@ -72,5 +255,105 @@ func (c *Config) Validate(im instancemetadata.InstanceMetadata, manager aws.Rout
 	} else {
 		c.RemoteHealthcheckTemplates = make(map[string]*healthcheck.Healthcheck)
 	}
+	if c.Gossip != nil {
+		if err := c.Gossip.Validate(); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	if c.Status != nil {
+		if _, _, err := net.SplitHostPort(c.Status.Listen); err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Could not parse status listen address '%s': %s", c.Status.Listen, err.Error())))
+		}
+	}
+	if c.Spot != nil {
+		if c.Spot.Interval < 0 {
+			result = multierror.Append(result, errors.New("spot interval cannot be negative"))
+		}
+		if c.Spot.Interval == 0 {
+			c.Spot.Interval = 5
+		}
+	}
+	if c.AutoScaling != nil {
+		if err := c.AutoScaling.Validate(); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	if c.AWS != nil {
+		if err := c.AWS.Validate(); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	if c.Audit != nil && c.Audit.Path == "" {
+		result = multierror.Append(result, errors.New("audit needs a path"))
+	}
+	for _, name := range sortedNotificationNames(c.Notifications) {
+		if c.Notifications[name] == nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("notification %s needs a url", name)))
+			continue
+		}
+		if err := c.Notifications[name].Validate(name); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	if c.Tracing != nil {
+		if err := c.Tracing.Validate(); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	if c.Safety != nil {
+		if err := c.Safety.Validate(); err != nil {
+			result = multierror.Append(result, err)
+		} else {
+			result = multierror.Append(result, c.protectedRouteErrors()...)
+		}
+	}
+	if c.Parallelism < 0 {
+		result = multierror.Append(result, errors.New("parallelism cannot be negative"))
+	}
+	if c.Parallelism == 0 {
+		c.Parallelism = 4
+	}
+	if c.StartupFailure == "" {
+		c.StartupFailure = StartupExit
+	}
+	if c.StartupFailure != StartupExit && c.StartupFailure != StartupKeepRunning {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("startup_failure '%s' is not exit or keep_running", c.StartupFailure)))
+	}
+	if err := c.Logging.Validate(); err != nil {
+		result = multierror.Append(result, err)
+	}
 	return result.ErrorOrNil()
 }
+
+// RouteTableNames are the names of the route tables, in order.
+func (c *Config) RouteTableNames() []string {
+	names := make([]string, 0, len(c.RouteTables))
+	for name := range c.RouteTables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// protectedRouteErrors are for managed routes which the safety protected_cidrs would
+// never let us change.
+func (c *Config) protectedRouteErrors() []error {
+	errs := make([]error, 0)
+	for name, rt := range c.RouteTables {
+		for _, rs := range rt.ManageRoutes {
+			if c.Safety.Protects(rs.Cidr) {
+				errs = append(errs, errors.New(fmt.Sprintf("Route tables %s, route %s is in safety protected_cidrs", name, rs.Cidr)))
+			}
+		}
+	}
+	return errs
+}
+
+func sortedNotificationNames(notifications map[string]*notify.Webhook) []string {
+	names := make([]string, 0, len(notifications))
+	for name := range notifications {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -4,16 +4,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	a "github.com/aws/aws-sdk-go-v2/aws"
 	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
-	a "github.com/aws/aws-sdk-go/aws"
 	"github.com/hashicorp/go-multierror"
 
 	"github.com/justenwalker/awsnycast/aws"
 	"github.com/justenwalker/awsnycast/healthcheck"
 	"github.com/justenwalker/awsnycast/instancemetadata"
+	"github.com/justenwalker/awsnycast/notify"
 	"github.com/justenwalker/awsnycast/testhelpers"
+	"github.com/justenwalker/awsnycast/tracing"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -32,24 +39,41 @@ func init() {
 }
 
 type FakeRouteTableManager struct {
+	sync.Mutex
 	Error            error
 	RouteTable       ec2type.RouteTable
 	ManageRoutesSpec aws.ManageRoutesSpec
 	Noop             bool
+	FailRouteTable   string
+	Managed          []string
 }
 
-func (r *FakeRouteTableManager) InstanceIsRouter(context.Context, string) bool {
-	return true
+func (r *FakeRouteTableManager) InstanceIsRouter(context.Context, string) (bool, error) {
+	return true, nil
+}
+
+func (r *FakeRouteTableManager) LockRouteTables(...string) func() {
+	return func() {}
 }
 
 func (r *FakeRouteTableManager) GetRouteTables(context.Context) ([]ec2type.RouteTable, error) {
 	return nil, nil
 }
 
+func (r *FakeRouteTableManager) GetRouteTable(ctx context.Context, id string) (ec2type.RouteTable, error) {
+	return ec2type.RouteTable{RouteTableId: &id}, nil
+}
+
 func (r *FakeRouteTableManager) ManageInstanceRoute(ctx context.Context, rtb ec2type.RouteTable, rs aws.ManageRoutesSpec, noop bool) error {
+	r.Lock()
+	defer r.Unlock()
 	r.RouteTable = rtb
 	r.ManageRoutesSpec = rs
 	r.Noop = noop
+	r.Managed = append(r.Managed, *rtb.RouteTableId)
+	if *rtb.RouteTableId == r.FailRouteTable {
+		return errors.New("Test error")
+	}
 	return r.Error
 }
 
@@ -71,6 +95,95 @@ func TestLoadConfigFailsValidation(t *testing.T) {
 	testhelpers.CheckOneMultiError(t, err, "Route tables a, route 0.0.0.0/0 cannot find healthcheck 'public'")
 }
 
+func TestStaticMetadata(t *testing.T) {
+	s, err := StaticMetadata("../tests/static_metadata.yaml")
+	if assert.Nil(t, err) && assert.NotNil(t, s) {
+		assert.Equal(t, s.Region, "us-west-1")
+	}
+	s, err = StaticMetadata("../tests/awsnycast.yaml")
+	assert.Nil(t, err)
+	assert.Nil(t, s)
+}
+
+func TestLoadConfigStaticMetadataExplicitInstances(t *testing.T) {
+	c, err := New("../tests/static_metadata.yaml", instancemetadata.InstanceMetadata{Region: "us-west-1"}, rtm)
+	if assert.Nil(t, err) {
+		routes := c.RouteTables["a"].ManageRoutes
+		assert.Equal(t, routes[0].Instance, "i-1234")
+		assert.Equal(t, routes[1].Instance, "i-5678")
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	im := instancemetadata.InstanceMetadata{VPC: "vpc-1234", Tags: map[string]string{"cluster": "edge"}}
+	out, err := renderTemplate("test.yaml", []byte(`vpc: {{ .VPC }} cluster: {{ index .Tags "cluster" }} missing: "{{ index .Tags "nope" }}"`), im)
+	assert.Nil(t, err)
+	assert.Equal(t, string(out), `vpc: vpc-1234 cluster: edge missing: ""`)
+	_, err = renderTemplate("test.yaml", []byte("{{ .Tags.nope }}"), im)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "map has no entry for key")
+	}
+	_, err = renderTemplate("test.yaml", []byte("{{ .Nope }}"), im)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Could not render config template")
+	}
+	_, err = renderTemplate("test.yaml", []byte("{{ .VPC "), im)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Could not parse config template")
+	}
+}
+
+func writeConfig(t *testing.T, name string, data string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestTemplateOptIn(t *testing.T) {
+	im := instancemetadata.InstanceMetadata{Region: "us-west-1", Tags: map[string]string{"cluster": "edge"}}
+	data := "aws:\n    ec2_endpoint: 'https://{{ .Region }}.example.com'\n"
+	// Only files ending in .tmpl are templates
+	_, err := AWS(writeConfig(t, "awsnycast.yaml", data), im)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "https://{{ .Region }}.example.com")
+	}
+	settings, err := AWS(writeConfig(t, "awsnycast.yaml.tmpl", data), im)
+	if assert.Nil(t, err) {
+		assert.Equal(t, settings.EC2Endpoint, "https://us-west-1.example.com")
+	}
+}
+
+func TestReadEarlyTemplate(t *testing.T) {
+	filename := writeConfig(t, "awsnycast.yaml.tmpl", `---
+log_format: json
+metadata:
+    region: us-west-1
+routetables:
+    a:
+        find:
+            type: by_tag
+            config:
+                key: cluster
+                value: {{ .Tags.cluster }}
+`)
+	c, err := Logging(filename)
+	if assert.Nil(t, err) {
+		assert.Equal(t, c.Format, "json")
+	}
+	s, err := StaticMetadata(filename)
+	if assert.Nil(t, err) && assert.NotNil(t, s) {
+		assert.Equal(t, s.Region, "us-west-1")
+	}
+
+	filename = writeConfig(t, "awsnycast.yaml.tmpl", "log_format: json\nlog_levels:\n    '{{ .Region }}': debug\n")
+	_, err = Logging(filename)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Config key 'log_levels' is read before instance metadata is fetched, so cannot use templating")
+	}
+}
+
 func TestLoadConfigHealthchecks(t *testing.T) {
 	c, err := New("../tests/awsnycast.yaml", tim, rtm)
 	assert.Nil(t, err, "Loading config failed")
@@ -495,7 +608,7 @@ func TestUpdateEc2RouteTablesFindRouteTablesInAWS(t *testing.T) {
 	assert.Nil(t, rt.UpdateEc2RouteTables(ctx, awsRt))
 }
 
-func TestRunEc2Updates(t *testing.T) {
+func TestManageRoute(t *testing.T) {
 	ctx := context.Background()
 	rt := &RouteTable{
 		ManageRoutes: []*aws.ManageRoutesSpec{&aws.ManageRoutesSpec{Cidr: "127.0.0.1"}},
@@ -513,17 +626,88 @@ func TestRunEc2Updates(t *testing.T) {
 		},
 	})
 	frtm := &FakeRouteTableManager{}
-	if assert.Nil(t, rt.RunEc2Updates(ctx, frtm, true)) {
+	errs := rt.ManageRoute(ctx, frtm, 0, true)
+	assert.Equal(t, errs, []error{nil})
+	if assert.Nil(t, rt.Ec2UpdatesError([][]error{errs})) {
 		assert.Equal(t, *(frtm.RouteTable.RouteTableId), "rtb-9696cffe")
 		assert.Equal(t, frtm.ManageRoutesSpec.Cidr, "127.0.0.1/32")
 	}
 	frtm.Error = errors.New("Test error")
-	err = rt.RunEc2Updates(ctx, frtm, true)
+	err = rt.Ec2UpdatesError([][]error{rt.ManageRoute(ctx, frtm, 0, true)})
 	if assert.NotNil(t, err) {
 		assert.Equal(t, err.Error(), "Test error")
 	}
 }
 
+func TestManageRouteIsolatesErrors(t *testing.T) {
+	rt := &RouteTable{
+		ManageRoutes: []*aws.ManageRoutesSpec{{Cidr: "0.0.0.0/0", Instance: "i-1234"}},
+		ec2RouteTables: []ec2type.RouteTable{
+			{RouteTableId: a.String("rtb-1"), VpcId: a.String("vpc-1")},
+			{RouteTableId: a.String("rtb-2"), VpcId: a.String("vpc-1")},
+			{RouteTableId: a.String("rtb-3"), VpcId: a.String("vpc-1")},
+		},
+	}
+	// Run one at a time, the first route table failing doesn't stop the others being run
+	frtm := &FakeRouteTableManager{FailRouteTable: "rtb-1"}
+	errs := rt.ManageRoute(context.Background(), frtm, 0, true)
+	assert.Equal(t, len(errs), 3)
+	assert.Nil(t, errs[1])
+	assert.Nil(t, errs[2])
+	err := rt.Ec2UpdatesError([][]error{errs})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Test error")
+	}
+	assert.Equal(t, frtm.Managed, []string{"rtb-1", "rtb-2", "rtb-3"})
+}
+
+// concurrentRouteTableManager counts how many routes are being managed at once, in all
+// and for each cidr.
+type concurrentRouteTableManager struct {
+	FakeRouteTableManager
+	running map[string]int
+	most    map[string]int
+	all     int
+	mostAll int
+}
+
+func (r *concurrentRouteTableManager) ManageInstanceRoute(ctx context.Context, rtb ec2type.RouteTable, rs aws.ManageRoutesSpec, noop bool) error {
+	r.Lock()
+	r.running[rs.Cidr]++
+	r.all++
+	if r.running[rs.Cidr] > r.most[rs.Cidr] {
+		r.most[rs.Cidr] = r.running[rs.Cidr]
+	}
+	if r.all > r.mostAll {
+		r.mostAll = r.all
+	}
+	r.Unlock()
+	time.Sleep(2 * time.Millisecond)
+	r.Lock()
+	r.running[rs.Cidr]--
+	r.all--
+	r.Unlock()
+	return nil
+}
+
+func TestManageRouteOneRouteTableAtATime(t *testing.T) {
+	rt := &RouteTable{
+		ManageRoutes: []*aws.ManageRoutesSpec{{Cidr: "0.0.0.0/0"}, {Cidr: "10.0.0.0/8"}, {Cidr: "192.168.0.0/16"}},
+		ec2RouteTables: []ec2type.RouteTable{
+			{RouteTableId: a.String("rtb-1")},
+			{RouteTableId: a.String("rtb-2")},
+			{RouteTableId: a.String("rtb-3")},
+		},
+	}
+	frtm := &concurrentRouteTableManager{running: make(map[string]int), most: make(map[string]int)}
+	// As the daemon runs them, each route on a worker of its own
+	aws.NewWorkers(3).Run(len(rt.ManageRoutes), func(i int) {
+		assert.Equal(t, rt.ManageRoute(context.Background(), frtm, i, true), []error{nil, nil, nil})
+	})
+	assert.Equal(t, frtm.most, map[string]int{"0.0.0.0/0": 1, "10.0.0.0/8": 1, "192.168.0.0/16": 1})
+	assert.Equal(t, frtm.mostAll, 3)
+}
+
 func TestRouteTableFindSpecAndNoFilters(t *testing.T) {
 	c := make(map[string]interface{})
 	_, err := RouteTableFindSpec{Config: c, Type: "and"}.GetFilter()
@@ -645,3 +829,235 @@ func TestGetFiltersListForSpecInnerFails(t *testing.T) {
 		}
 	}
 }
+
+func getCompositeConfig(checks map[string][]interface{}) *Config {
+	u := make([]*aws.ManageRoutesSpec, 1)
+	u[0] = &aws.ManageRoutesSpec{
+		Cidr: "127.0.0.1",
+	}
+	r := make(map[string]*RouteTable)
+	r["a"] = &RouteTable{
+		Find:         RouteTableFindSpec{Type: "by_tag", Config: make(map[string]interface{})},
+		ManageRoutes: u,
+	}
+	hcs := make(map[string]*healthcheck.Healthcheck)
+	hcs["ping"] = &healthcheck.Healthcheck{Type: "ping", Destination: "127.0.0.1"}
+	for name, deps := range checks {
+		conf := make(map[string]interface{})
+		conf["checks"] = deps
+		hcs[name] = &healthcheck.Healthcheck{Type: "composite", Config: conf}
+	}
+	return &Config{
+		RouteTables:  r,
+		Healthchecks: hcs,
+	}
+}
+
+func TestConfigValidateCompositeHealthcheck(t *testing.T) {
+	c := getCompositeConfig(map[string][]interface{}{
+		"both":  {"ping", "inner"},
+		"inner": {"ping"},
+	})
+	if assert.Nil(t, c.Validate(tim, rtm)) {
+		order := c.HealthchecksInOrder()
+		if assert.Equal(t, len(order), 3) {
+			assert.Equal(t, order[0], c.Healthchecks["ping"])
+			assert.Equal(t, order[1], c.Healthchecks["inner"])
+			assert.Equal(t, order[2], c.Healthchecks["both"])
+		}
+		for _, h := range order {
+			assert.Nil(t, h.Setup())
+		}
+	}
+}
+
+func TestConfigValidateCompositeHealthcheckMissing(t *testing.T) {
+	c := getCompositeConfig(map[string][]interface{}{
+		"both": {"ping", "doesnotexist"},
+	})
+	err := c.Validate(tim, rtm)
+	testhelpers.CheckOneMultiError(t, err, "Healthcheck both cannot find healthcheck 'doesnotexist'")
+}
+
+func TestConfigValidateCompositeHealthcheckCycle(t *testing.T) {
+	c := getCompositeConfig(map[string][]interface{}{
+		"a": {"ping", "b"},
+		"b": {"c"},
+		"c": {"b"},
+	})
+	err := c.Validate(tim, rtm)
+	testhelpers.CheckOneMultiError(t, err, "Healthcheck dependency cycle: b -> c -> b")
+	assert.Equal(t, len(c.HealthchecksInOrder()), 4)
+}
+
+func TestConfigValidateCompositeRemoteHealthcheck(t *testing.T) {
+	c := getCompositeConfig(map[string][]interface{}{})
+	c.RemoteHealthcheckTemplates = make(map[string]*healthcheck.Healthcheck)
+	c.RemoteHealthcheckTemplates["remote"] = &healthcheck.Healthcheck{Type: "composite"}
+	err := c.Validate(tim, rtm)
+	testhelpers.CheckOneMultiError(t, err, "Remote healthcheck remote cannot be of type composite")
+}
+
+func TestAutoScalingConfigValidate(t *testing.T) {
+	a := &AutoScalingConfig{LifecycleHook: "drain"}
+	assert.Nil(t, a.Validate())
+	assert.Equal(t, a.Interval, float64(5))
+	assert.Equal(t, a.DrainTimeout, float64(60))
+}
+
+func TestAutoScalingConfigValidateFails(t *testing.T) {
+	a := &AutoScalingConfig{Interval: -1}
+	err := a.Validate()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, len(err.(*multierror.Error).Errors), 2)
+	}
+}
+
+func TestAWSConfigValidate(t *testing.T) {
+	a := &AWSConfig{EC2Endpoint: "https://vpce-1234.ec2.us-east-1.vpce.amazonaws.com", Proxy: "http://proxy:3128"}
+	assert.Nil(t, a.Validate())
+	assert.Equal(t, a.RetryMode, "standard")
+	assert.Equal(t, a.MaxAttempts, 3)
+}
+
+func TestAWSConfigValidateFails(t *testing.T) {
+	a := &AWSConfig{EC2Endpoint: "localhost:4566", Proxy: "proxy", RetryMode: "sometimes", MaxAttempts: -1}
+	err := a.Validate()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, len(err.(*multierror.Error).Errors), 4)
+		assert.Equal(t, err.(*multierror.Error).Errors[0].Error(), "aws ec2_endpoint 'localhost:4566' is not an http or https URL")
+	}
+}
+
+func TestAWSNoKey(t *testing.T) {
+	a, err := AWS("../tests/awsnycast.yaml", tim)
+	if assert.Nil(t, err) {
+		assert.Equal(t, a.EC2Endpoint, "")
+		assert.Equal(t, a.MaxAttempts, 3)
+	}
+}
+
+func TestLogging(t *testing.T) {
+	f, err := ioutil.TempFile("", "awsnycast-logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("log_format: json\nlog_levels:\n    aws: debug\nroutetables: {}\n")
+	f.Close()
+	c, err := Logging(f.Name())
+	if assert.Nil(t, err) {
+		assert.Equal(t, c.Format, "json")
+		assert.Equal(t, c.Levels["aws"], "debug")
+		assert.Nil(t, c.File)
+	}
+}
+
+func TestLoggingNoKeys(t *testing.T) {
+	c, err := Logging("../tests/awsnycast.yaml")
+	if assert.Nil(t, err) {
+		assert.Equal(t, c.Format, "text")
+	}
+}
+
+func TestConfigValidateTracing(t *testing.T) {
+	c := &Config{Tracing: &tracing.Config{Endpoint: "collector:4318"}}
+	err := c.Validate(instancemetadata.InstanceMetadata{}, &aws.RouteTableManagerEC2{})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "tracing endpoint 'collector:4318' is not an http or https URL")
+	}
+}
+
+func TestConfigValidateAuditNeedsPath(t *testing.T) {
+	c := &Config{Audit: &AuditConfig{}}
+	err := c.Validate(instancemetadata.InstanceMetadata{}, &aws.RouteTableManagerEC2{})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "audit needs a path")
+	}
+}
+
+func TestConfigValidateNotifications(t *testing.T) {
+	c := &Config{Notifications: map[string]*notify.Webhook{
+		"slack": {URL: "https://hooks.slack.com/services/T0/B0/X", Format: "slack"},
+		"pager": {Format: "pagerduty"},
+		"empty": nil,
+	}}
+	err := c.Validate(instancemetadata.InstanceMetadata{}, &aws.RouteTableManagerEC2{})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "notification empty needs a url")
+		assert.Contains(t, err.Error(), "notification pager needs a routing_key for pagerduty")
+		assert.NotContains(t, err.Error(), "notification slack")
+	}
+	assert.Equal(t, c.Notifications["slack"].QueueSize, 100)
+}
+
+func TestConfigValidateSafety(t *testing.T) {
+	c := &Config{
+		RouteTables: map[string]*RouteTable{
+			"a": {
+				Find:         RouteTableFindSpec{Type: "by_tag", Config: map[string]interface{}{"key": "Name", "value": "private a"}},
+				ManageRoutes: []*aws.ManageRoutesSpec{{Cidr: "192.168.1.1", Instance: "i-1234"}, {Cidr: "0.0.0.0/0", Instance: "i-1234"}},
+			},
+		},
+		Safety: &aws.Safety{ProtectedCidrs: []string{"192.168.0.0/16"}},
+	}
+	err := c.Validate(instancemetadata.InstanceMetadata{Instance: "i-1234"}, &aws.RouteTableManagerEC2{})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, len(err.(*multierror.Error).Errors), 1)
+		assert.Contains(t, err.Error(), "Route tables a, route 192.168.1.1/32 is in safety protected_cidrs")
+	}
+}
+
+func TestConfigValidateStartupFailure(t *testing.T) {
+	c := &Config{
+		RouteTables: map[string]*RouteTable{
+			"a": {
+				Find:         RouteTableFindSpec{Type: "by_tag", Config: map[string]interface{}{"key": "Name", "value": "private a"}},
+				ManageRoutes: []*aws.ManageRoutesSpec{{Cidr: "0.0.0.0/0", Instance: "i-1234"}},
+			},
+			"b": {
+				Find:         RouteTableFindSpec{Type: "by_tag", Config: map[string]interface{}{"key": "Name", "value": "private b"}},
+				ManageRoutes: []*aws.ManageRoutesSpec{{Cidr: "0.0.0.0/0", Instance: "i-1234"}},
+			},
+		},
+	}
+	assert.Nil(t, c.Validate(instancemetadata.InstanceMetadata{Instance: "i-1234"}, &aws.RouteTableManagerEC2{}))
+	assert.Equal(t, c.StartupFailure, StartupExit)
+	assert.Equal(t, c.RouteTableNames(), []string{"a", "b"})
+	c.StartupFailure = "retry"
+	err := c.Validate(instancemetadata.InstanceMetadata{Instance: "i-1234"}, &aws.RouteTableManagerEC2{})
+	testhelpers.CheckOneMultiError(t, err, "startup_failure 'retry' is not exit or keep_running")
+}
+
+func TestConfigValidateParallelism(t *testing.T) {
+	c := &Config{
+		RouteTables: map[string]*RouteTable{
+			"a": {
+				Find:         RouteTableFindSpec{Type: "by_tag", Config: map[string]interface{}{"key": "Name", "value": "private a"}},
+				ManageRoutes: []*aws.ManageRoutesSpec{{Cidr: "0.0.0.0/0", Instance: "i-1234"}},
+			},
+		},
+	}
+	assert.Nil(t, c.Validate(instancemetadata.InstanceMetadata{Instance: "i-1234"}, &aws.RouteTableManagerEC2{}))
+	assert.Equal(t, c.Parallelism, 4)
+	c.Parallelism = -1
+	err := c.Validate(instancemetadata.InstanceMetadata{Instance: "i-1234"}, &aws.RouteTableManagerEC2{})
+	testhelpers.CheckOneMultiError(t, err, "parallelism cannot be negative")
+}
+
+func TestEc2UpdatesErrorEveryRouteTable(t *testing.T) {
+	rt := &RouteTable{
+		ManageRoutes: []*aws.ManageRoutesSpec{{Cidr: "0.0.0.0/0", Instance: "i-1234"}},
+		ec2RouteTables: []ec2type.RouteTable{
+			{RouteTableId: a.String("rtb-1"), VpcId: a.String("vpc-1")},
+			{RouteTableId: a.String("rtb-2"), VpcId: a.String("vpc-1")},
+			{RouteTableId: a.String("rtb-3"), VpcId: a.String("vpc-1")},
+		},
+	}
+	frtm := &FakeRouteTableManager{Error: errors.New("Test error")}
+	err := rt.Ec2UpdatesError([][]error{rt.ManageRoute(context.Background(), frtm, 0, true)})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "3 error(s) occurred")
+		assert.Contains(t, err.Error(), "rtb-2: Test error")
+	}
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/justenwalker/awsnycast/healthcheck"
+)
+
+// resolveHealthcheckDependencies hands each composite healthcheck the healthchecks
+// it refers to, failing on unknown names or reference cycles.
+func (c *Config) resolveHealthcheckDependencies() error {
+	var result *multierror.Error
+	for _, name := range sortedHealthcheckNames(c.Healthchecks) {
+		h := c.Healthchecks[name]
+		deps, err := h.DependencyNames()
+		if err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Healthcheck %s: %s", name, err.Error())))
+			continue
+		}
+		resolved := make([]*healthcheck.Healthcheck, 0, len(deps))
+		for _, dep := range deps {
+			if d, ok := c.Healthchecks[dep]; ok {
+				resolved = append(resolved, d)
+			} else {
+				result = multierror.Append(result, errors.New(fmt.Sprintf("Healthcheck %s cannot find healthcheck '%s'", name, dep)))
+			}
+		}
+		if len(resolved) == len(deps) {
+			h.SetDependencies(resolved)
+		}
+	}
+	if _, err := c.healthcheckOrder(); err != nil {
+		result = multierror.Append(result, err)
+	}
+	return result.ErrorOrNil()
+}
+
+// HealthchecksInOrder returns every healthcheck, ordered so that each one comes after
+// the healthchecks it depends on. Healthchecks should be Setup and Run in this order.
+func (c *Config) HealthchecksInOrder() []*healthcheck.Healthcheck {
+	order, err := c.healthcheckOrder()
+	if err != nil { // Validate refuses cycles, so this is only hit on unvalidated config
+		order = sortedHealthcheckNames(c.Healthchecks)
+	}
+	hcs := make([]*healthcheck.Healthcheck, len(order))
+	for i, name := range order {
+		hcs[i] = c.Healthchecks[name]
+	}
+	return hcs
+}
+
+func (c *Config) healthcheckOrder() ([]string, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	order := make([]string, 0, len(c.Healthchecks))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			for i, n := range path {
+				if n == name {
+					path = path[i:]
+					break
+				}
+			}
+			return errors.New(fmt.Sprintf("Healthcheck dependency cycle: %s", strings.Join(append(path, name), " -> ")))
+		}
+		h, ok := c.Healthchecks[name]
+		if !ok { // Unknown names are reported by resolveHealthcheckDependencies
+			return nil
+		}
+		state[name] = visiting
+		deps, _ := h.DependencyNames()
+		for _, dep := range deps {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range sortedHealthcheckNames(c.Healthchecks) {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+func sortedHealthcheckNames(healthchecks map[string]*healthcheck.Healthcheck) []string {
+	names := make([]string, 0, len(healthchecks))
+	for name := range healthchecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
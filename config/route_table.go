@@ -7,7 +7,7 @@ import (
 
 	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/hashicorp/go-multierror"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 
 	"github.com/justenwalker/awsnycast/aws"
 	"github.com/justenwalker/awsnycast/healthcheck"
@@ -39,20 +39,42 @@ func (r *RouteTable) UpdateEc2RouteTables(ctx context.Context, rt []ec2type.Rout
 	return nil
 }
 
-func (r *RouteTable) RunEc2Updates(ctx context.Context, manager aws.RouteTableManager, noop bool) error {
-	for _, rtb := range r.ec2RouteTables {
-		contextLogger := log.WithFields(log.Fields{
-			"rtb": *(rtb.RouteTableId),
+// ManageRoute manages the i'th route in each of the route tables found, one after another,
+// as the route's history and local address aren't safe to change from more than one at
+// once. It returns the error (if any) from each route table.
+func (r *RouteTable) ManageRoute(ctx context.Context, manager aws.RouteTableManager, i int, noop bool) []error {
+	manageRoute := r.ManageRoutes[i]
+	errs := make([]error, len(r.ec2RouteTables))
+	for j, rtb := range r.ec2RouteTables {
+		contextLogger := log.WithFields(logrus.Fields{
+			"rtb":  *(rtb.RouteTableId),
+			"cidr": manageRoute.Cidr,
 		})
-		contextLogger.Debug("Finder found route table")
-		for _, manageRoute := range r.ManageRoutes {
-			contextLogger.WithFields(log.Fields{"cidr": manageRoute.Cidr}).Debug("Trying to manage route")
-			if err := manager.ManageInstanceRoute(ctx, rtb, *manageRoute, noop); err != nil {
-				return err
+		contextLogger.Debug("Trying to manage route")
+		errs[j] = manager.ManageInstanceRoute(ctx, rtb, *manageRoute, noop)
+	}
+	return errs
+}
+
+// Ec2UpdatesError sums up what ManageRoute returned for each route: a route table failed
+// with the first error from any route in it. Just the error if only one route table
+// failed, otherwise which failed how.
+func (r *RouteTable) Ec2UpdatesError(results [][]error) error {
+	var failed []error
+	var result *multierror.Error
+	for j, rtb := range r.ec2RouteTables {
+		for _, errs := range results {
+			if j < len(errs) && errs[j] != nil {
+				failed = append(failed, errs[j])
+				result = multierror.Append(result, errors.New(fmt.Sprintf("%s: %s", *(rtb.RouteTableId), errs[j].Error())))
+				break
 			}
 		}
 	}
-	return nil
+	if len(failed) == 1 {
+		return failed[0]
+	}
+	return result.ErrorOrNil()
 }
 
 func (r *RouteTable) Validate(meta instancemetadata.InstanceMetadata, manager aws.RouteTableManager, name string, healthchecks map[string]*healthcheck.Healthcheck, remotehealthchecks map[string]*healthcheck.Healthcheck) error {
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/justenwalker/awsnycast/instancemetadata"
+)
+
+// templateSuffix marks a config file as a template, e.g. /etc/awsnycast.yaml.tmpl. Other
+// config files are read as they are.
+const templateSuffix = ".tmpl"
+
+func isTemplate(filename string) bool {
+	return strings.HasSuffix(filename, templateSuffix)
+}
+
+// renderTemplate expands Go template syntax in a config file, so it can refer to this
+// instance's metadata, e.g. {{ .VPC }} or {{ .Tags.cluster }}. Referring to metadata
+// which doesn't exist is an error.
+func renderTemplate(filename string, data []byte, im instancemetadata.InstanceMetadata) ([]byte, error) {
+	t, err := template.New(filepath.Base(filename)).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not parse config template: %s", err.Error()))
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, im); err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not render config template: %s", err.Error()))
+	}
+	return out.Bytes(), nil
+}
+
+var topLevelKey = regexp.MustCompile(`^([A-Za-z0-9_]+)\s*:`)
+
+// untemplatedKeys returns just the top level keys given from a config template, for the
+// keys we read before we have any instance metadata to render it with. It is an error for
+// them to use templating.
+func untemplatedKeys(data []byte, keys ...string) ([]byte, error) {
+	wanted := make(map[string]bool)
+	for _, k := range keys {
+		wanted[k] = true
+	}
+	var out bytes.Buffer
+	key := ""
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if m := topLevelKey.FindStringSubmatch(line); m != nil {
+			key = m[1]
+		}
+		if !wanted[key] {
+			continue
+		}
+		if strings.Contains(line, "{{") {
+			return nil, errors.New(fmt.Sprintf("Config key '%s' is read before instance metadata is fetched, so cannot use templating", key))
+		}
+		out.WriteString(line)
+	}
+	return out.Bytes(), nil
+}
@@ -1,66 +1,197 @@
 package daemon
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
-	log "github.com/sirupsen/logrus"
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
 
 	"github.com/justenwalker/awsnycast/aws"
+	"github.com/justenwalker/awsnycast/clock"
 	"github.com/justenwalker/awsnycast/config"
+	"github.com/justenwalker/awsnycast/gossip"
 	"github.com/justenwalker/awsnycast/instancemetadata"
+	"github.com/justenwalker/awsnycast/logging"
+	"github.com/justenwalker/awsnycast/notify"
+	"github.com/justenwalker/awsnycast/systemd"
+	"github.com/justenwalker/awsnycast/tracing"
 )
 
+var log = logging.For("daemon")
+
 type Daemon struct {
 	oneShot           bool
 	noop              bool
 	ConfigFile        string
 	Version           string
 	Debug             bool
+	LocalSyslog       bool
 	Config            *config.Config
 	MetadataFetcher   instancemetadata.MetadataFetcher
+	MetadataOptions   instancemetadata.Options
+	StaticMetadata    *instancemetadata.Static
 	RouteTableManager aws.RouteTableManager
+	Lifecycle         *aws.Lifecycle
+	Clock             clock.Clock
 	quitChan          chan bool
 	loopQuitChan      chan bool
 	FetchWait         time.Duration
+	StartupAttempts   int
+	StartupBackoff    time.Duration
+	gossip            *gossip.Node
+	statusServer      *http.Server
+	drain             *aws.Drain
+	spotQuitChan      chan bool
+	lifecycleQuitChan chan bool
+	stopTracing       func(context.Context) error
+	audit             *aws.AuditLog
+	notifier          *notify.Notifier
+	sdNotify          *systemd.Notifier
+	ready             bool
+	runLock           sync.Mutex
+	routeTableIDs     []string
+	workers           aws.Workers
+	statusLock        sync.Mutex
+	routeTableStatus  map[string]RouteTableStatus
 	instancemetadata.InstanceMetadata
 }
 
-func (d *Daemon) setupMetadataFetcher() {
-	if d.MetadataFetcher == nil {
-		d.MetadataFetcher = instancemetadata.New(d.Debug)
+// setupMetadataFetcher uses static metadata from the command line or config file if
+// there is any, otherwise the instance metadata service.
+func (d *Daemon) setupMetadataFetcher() error {
+	if d.MetadataFetcher != nil {
+		return nil
+	}
+	static := d.StaticMetadata
+	if static == nil {
+		s, err := config.StaticMetadata(d.ConfigFile)
+		if err != nil {
+			return err
+		}
+		static = s
+	}
+	if static != nil {
+		if err := static.Validate(); err != nil {
+			return err
+		}
+		d.MetadataFetcher = *static
+		return nil
+	}
+	d.MetadataOptions.Debug = d.Debug
+	d.MetadataFetcher = instancemetadata.NewWithOptions(d.MetadataOptions)
+	return nil
+}
+
+// awsConfig is how to talk to AWS, from the aws key of the config file (which is read by
+// itself, as the rest of the config can't be checked until we can talk to EC2).
+func (d *Daemon) awsConfig() (awsv2.Config, *config.AWSConfig, error) {
+	settings, err := config.AWS(d.ConfigFile, d.InstanceMetadata)
+	if err != nil {
+		return awsv2.Config{}, nil, err
+	}
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRetryMode(awsv2.RetryMode(settings.RetryMode)),
+		awsconfig.WithRetryMaxAttempts(settings.MaxAttempts),
+	}
+	if settings.Proxy != "" {
+		proxy, err := url.Parse(settings.Proxy)
+		if err != nil {
+			return awsv2.Config{}, nil, err
+		}
+		opts = append(opts, awsconfig.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			tr.Proxy = http.ProxyURL(proxy)
+		})))
+	}
+	if settings.CABundle != "" {
+		bundle, err := ioutil.ReadFile(settings.CABundle)
+		if err != nil {
+			return awsv2.Config{}, nil, errors.New(fmt.Sprintf("Could not read aws ca_bundle: %s", err.Error()))
+		}
+		opts = append(opts, awsconfig.WithCustomCABundle(bytes.NewReader(bundle)))
+	}
+	mw := middleware.AddUserAgentKey(fmt.Sprintf("awsnycast/%s", d.Version))
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return cfg, nil, err
+	}
+	cfg.APIOptions = append(cfg.APIOptions, mw)
+	if d.Region != "" {
+		cfg.Region = d.Region
+	}
+	if d.Debug {
+		cfg.ClientLogMode = awsv2.LogRequest | awsv2.LogResponseWithBody
+	}
+	return cfg, settings, nil
+}
+
+// setupLogging is done first, from just the log_* keys of the config file, so that the
+// rest of Setup logs where it's been told to.
+func (d *Daemon) setupLogging() error {
+	c, err := config.Logging(d.ConfigFile)
+	if err != nil {
+		return err
 	}
+	c.LocalSyslog = d.LocalSyslog
+	return logging.Configure(*c, d.Debug)
 }
 
 func (d *Daemon) Setup() error {
-	d.setupMetadataFetcher()
-	im, err := instancemetadata.FetchMetadata(d.MetadataFetcher)
+	return d.setup(context.Background())
+}
+
+// setup gets everything ready to run. Instance metadata and AWS credentials are retried
+// (see retryStartup), as they may not be available yet just after the instance boots.
+func (d *Daemon) setup(ctx context.Context) error {
+	if d.Clock == nil {
+		d.Clock = clock.Real
+	}
+	d.sdNotify = systemd.New()
+	if err := d.setupLogging(); err != nil {
+		return err
+	}
+	if err := d.setupMetadataFetcher(); err != nil {
+		return err
+	}
+	err := d.retryStartup(ctx, "instance metadata", func() error {
+		im, err := instancemetadata.FetchMetadata(d.MetadataFetcher)
+		d.InstanceMetadata = im
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	d.InstanceMetadata = im
 
 	if d.RouteTableManager == nil {
-		mw := middleware.AddUserAgentKey(fmt.Sprintf("awsnycast/%s", d.Version))
-		cfg, err := awsconfig.LoadDefaultConfig(context.Background())
+		cfg, settings, err := d.awsConfig()
 		if err != nil {
 			return err
 		}
-		cfg.APIOptions = append(cfg.APIOptions, mw)
-		if d.Region != "" {
-			cfg.Region = d.Region
-		}
-		if d.Debug {
-			cfg.ClientLogMode = awsv2.LogRequest | awsv2.LogResponseWithBody
+		if cfg.Credentials != nil {
+			err := d.retryStartup(ctx, "AWS credentials", func() error {
+				_, err := cfg.Credentials.Retrieve(ctx)
+				return err
+			})
+			if err != nil {
+				return err
+			}
 		}
-		cfg.RetryMode = awsv2.RetryModeStandard
-		cfg.RetryMaxAttempts = 3
-		d.RouteTableManager = aws.NewRouteTableManagerEC2(cfg)
+		d.RouteTableManager = aws.NewRouteTableManagerEC2(cfg, settings.EC2Endpoint)
 	}
 
 	config, err := config.New(d.ConfigFile, d.InstanceMetadata, d.RouteTableManager)
@@ -68,16 +199,101 @@ func (d *Daemon) Setup() error {
 		return err
 	}
 	d.Config = config
+	d.workers = aws.NewWorkers(config.Parallelism)
 
 	if d.FetchWait == 0 {
 		d.FetchWait = time.Second * time.Duration(config.PollTime)
 	}
 
-	return setupHealthchecks(d.Config)
+	if d.Config.AutoScaling != nil && d.Lifecycle == nil {
+		cfg, _, err := d.awsConfig()
+		if err != nil {
+			return err
+		}
+		d.Lifecycle = aws.NewLifecycle(cfg, d.Config.AutoScaling.Endpoint)
+	}
+
+	if d.Config.Tracing != nil {
+		stop, err := tracing.Setup(*d.Config.Tracing,
+			semconv.ServiceVersionKey.String(d.Version),
+			semconv.CloudRegionKey.String(d.Region),
+			semconv.HostIDKey.String(d.Instance),
+		)
+		if err != nil {
+			return err
+		}
+		d.stopTracing = stop
+	}
+
+	if d.Config.Audit != nil {
+		if err := d.setupAudit(); err != nil {
+			return err
+		}
+	}
+
+	if len(d.Config.Notifications) > 0 {
+		d.setupNotifications()
+	}
+
+	if d.Config.Safety != nil {
+		d.setupSafety()
+	}
+
+	d.drain = &aws.Drain{}
+	for _, rt := range d.Config.RouteTables {
+		for _, rs := range rt.ManageRoutes {
+			rs.SetDrain(d.drain)
+			rs.SetClock(d.Clock)
+		}
+	}
+
+	if err := setupHealthchecks(d.Config, d.Clock); err != nil {
+		return err
+	}
+	return d.setupGossip()
+}
+
+// setupAudit records the changes the route table manager makes to routes.
+func (d *Daemon) setupAudit() error {
+	m, ok := d.RouteTableManager.(*aws.RouteTableManagerEC2)
+	if !ok {
+		return nil
+	}
+	audit, err := aws.NewAuditLog(d.Config.Audit.Path, d.Clock)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not open audit log: %s", err.Error()))
+	}
+	d.audit = audit
+	m.Audit = audit
+	return nil
 }
 
-func setupHealthchecks(c *config.Config) error {
-	for _, v := range c.Healthchecks {
+// setupSafety limits the changes the route table manager makes to routes.
+func (d *Daemon) setupSafety() {
+	d.Config.Safety.SetClock(d.Clock)
+	if m, ok := d.RouteTableManager.(*aws.RouteTableManagerEC2); ok {
+		m.Safety = d.Config.Safety
+	}
+}
+
+// setupNotifications sends webhooks as healthchecks (local and remote) change state, and
+// as routes are changed.
+func (d *Daemon) setupNotifications() {
+	d.notifier = notify.New(d.Config.Notifications, d.Instance, d.Clock)
+	if m, ok := d.RouteTableManager.(*aws.RouteTableManagerEC2); ok {
+		m.Notifier = d.notifier
+	}
+	for name, hc := range d.Config.Healthchecks {
+		hc.SetNotifier(name, d.notifier)
+	}
+	for name, hc := range d.Config.RemoteHealthcheckTemplates {
+		hc.SetNotifier(name, d.notifier)
+	}
+}
+
+func setupHealthchecks(c *config.Config, clk clock.Clock) error {
+	for _, v := range c.HealthchecksInOrder() {
+		v.SetClock(clk)
 		err := v.Setup()
 		if err != nil {
 			return err
@@ -88,7 +304,7 @@ func setupHealthchecks(c *config.Config) error {
 
 func (d *Daemon) runHealthChecks() {
 	log.Debug("Starting healthchecks")
-	for _, v := range d.Config.Healthchecks {
+	for _, v := range d.Config.HealthchecksInOrder() {
 		v.Run(d.Debug)
 	}
 	for _, configRouteTables := range d.Config.RouteTables {
@@ -100,80 +316,351 @@ func (d *Daemon) runHealthChecks() {
 }
 
 func (d *Daemon) stopHealthChecks() {
-	for _, v := range d.Config.Healthchecks {
-		v.Stop()
+	for _, configRouteTables := range d.Config.RouteTables {
+		for _, mr := range configRouteTables.ManageRoutes {
+			mr.StopHealthcheckListener()
+		}
+	}
+	hcs := d.Config.HealthchecksInOrder()
+	for i := len(hcs) - 1; i >= 0; i-- {
+		hcs[i].Stop()
+	}
+}
+
+// releaseLocalAddresses removes every manage_local_address address as we stop.
+func (d *Daemon) releaseLocalAddresses() {
+	for _, rt := range d.Config.RouteTables {
+		for _, rs := range rt.ManageRoutes {
+			rs.ReleaseLocalAddress()
+		}
+	}
+}
+
+// Drain hands all our routes over to other instances, as this one is going away. Our
+// routes are deleted, and reported unhealthy to peers over gossip and status.
+func (d *Daemon) Drain(reason string) {
+	if !d.drain.Start(reason) {
+		return
+	}
+	log.WithFields(logrus.Fields{"reason": reason}).Warn("Draining all routes")
+	if err := d.RunRouteTables(context.Background()); err != nil {
+		log.WithFields(logrus.Fields{"err": err.Error()}).Warn("Error in drain route table run")
 	}
 }
 
 func (d *Daemon) RunOneRouteTable(ctx context.Context, rt []ec2type.RouteTable, name string, configRouteTable *config.RouteTable) error {
-	if err := configRouteTable.UpdateEc2RouteTables(ctx, rt); err != nil {
-		return err
+	return d.runRouteTables(ctx, rt, []string{name}, []*config.RouteTable{configRouteTable})[0]
+}
+
+// runRouteTables runs each of the route tables, returning how each went. Every route of
+// every route table takes a worker from the workers, which bound how much is changed at
+// once, and goes through its AWS route tables one after another.
+func (d *Daemon) runRouteTables(ctx context.Context, rt []ec2type.RouteTable, names []string, configRouteTables []*config.RouteTable) []error {
+	type route struct {
+		table int
+		route int
+	}
+	errs := make([]error, len(names))
+	ctxs := make([]context.Context, len(names))
+	ends := make([]func(error), len(names))
+	results := make([][][]error, len(names))
+	routes := make([]route, 0)
+	for i, name := range names {
+		tableCtx, span := tracing.Start(ctx, "RunOneRouteTable", tracing.RouteTable.String(name))
+		ctxs[i] = tableCtx
+		ends[i] = func(err error) { tracing.End(span, err) }
+		if errs[i] = configRouteTables[i].UpdateEc2RouteTables(ctxs[i], rt); errs[i] != nil {
+			continue
+		}
+		results[i] = make([][]error, len(configRouteTables[i].ManageRoutes))
+		for j := range configRouteTables[i].ManageRoutes {
+			routes = append(routes, route{table: i, route: j})
+		}
 	}
-	return configRouteTable.RunEc2Updates(ctx, d.RouteTableManager, d.noop)
+	d.workers.Run(len(routes), func(k int) {
+		i, j := routes[k].table, routes[k].route
+		results[i][j] = configRouteTables[i].ManageRoute(ctxs[i], d.RouteTableManager, j, d.noop)
+	})
+	for i := range names {
+		if errs[i] == nil {
+			errs[i] = configRouteTables[i].Ec2UpdatesError(results[i])
+		}
+		ends[i](errs[i])
+	}
+	return errs
 }
 
-func (d *Daemon) RunRouteTables(ctx context.Context) error {
+func (d *Daemon) RunRouteTables(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "RunRouteTables")
+	defer func() { tracing.End(span, err) }()
+	d.runLock.Lock()
+	defer d.runLock.Unlock()
+	// Healthcheck triggered reevaluations are kept out of the route tables from before
+	// they are described until we're done with them, and describe them again themselves.
+	defer d.RouteTableManager.LockRouteTables(d.routeTableIDs...)()
+	ctx = d.Config.Safety.StartRun(ctx)
 	rt, err := d.RouteTableManager.GetRouteTables(ctx)
 	if err != nil {
+		for name := range d.Config.RouteTables {
+			d.setRouteTableStatus(name, err)
+		}
 		return err
 	}
-	for name, configRouteTables := range d.Config.RouteTables {
-		if err := d.RunOneRouteTable(ctx, rt, name, configRouteTables); err != nil {
-			return err
+	known := make(map[string]bool)
+	for _, id := range d.routeTableIDs {
+		known[id] = true
+	}
+	ids := make([]string, 0, len(rt))
+	added := make([]string, 0)
+	for _, rtb := range rt {
+		id := awsv2.ToString(rtb.RouteTableId)
+		ids = append(ids, id)
+		if !known[id] {
+			added = append(added, id)
 		}
 	}
-	return nil
+	defer d.RouteTableManager.LockRouteTables(added...)()
+	d.routeTableIDs = ids
+	// Instance statuses and network interfaces are looked up once for all the route tables
+	specs := make([]*aws.ManageRoutesSpec, 0)
+	for _, configRouteTable := range d.Config.RouteTables {
+		specs = append(specs, configRouteTable.ManageRoutes...)
+	}
+	ctx = aws.WithLookups(ctx, rt, specs)
+	// One route table failing doesn't stop the others being run
+	names := d.Config.RouteTableNames()
+	configRouteTables := make([]*config.RouteTable, len(names))
+	for i, name := range names {
+		configRouteTables[i] = d.Config.RouteTables[name]
+	}
+	errs := d.runRouteTables(ctx, rt, names, configRouteTables)
+	var result *multierror.Error
+	for i, err := range errs {
+		d.setRouteTableStatus(names[i], err)
+		if err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Route table %s: %s", names[i], err.Error())))
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// setRouteTableStatus records how a run over a route table went, for status.
+func (d *Daemon) setRouteTableStatus(name string, err error) {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	if d.routeTableStatus == nil {
+		d.routeTableStatus = make(map[string]RouteTableStatus)
+	}
+	clk := d.Clock
+	if clk == nil {
+		clk = clock.Real
+	}
+	now := clk.Now().UTC()
+	s := d.routeTableStatus[name]
+	s.LastRun = now
+	s.Error = ""
+	if err != nil {
+		s.Error = err.Error()
+	} else {
+		s.LastSuccess = &now
+	}
+	d.routeTableStatus[name] = s
+}
+
+// failingRouteTables are the names of the route tables whose last run failed.
+func (d *Daemon) failingRouteTables() []string {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	failing := make([]string, 0)
+	for name, s := range d.routeTableStatus {
+		if s.Error != "" {
+			failing = append(failing, name)
+		}
+	}
+	sort.Strings(failing)
+	return failing
+}
+
+// flushTracing sends any spans not sent yet, as we stop.
+func (d *Daemon) flushTracing() {
+	if d.stopTracing == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.stopTracing(ctx); err != nil {
+		log.WithFields(logrus.Fields{"err": err.Error()}).Warn("Error sending traces")
+	}
 }
 
 func (d *Daemon) Run(ctx context.Context, oneShot bool, noop bool) int {
 	d.oneShot = oneShot
 	d.noop = noop
-	if err := d.Setup(); err != nil {
-		log.WithFields(log.Fields{"err": err.Error()}).Error("Error in initial setup")
+	if err := d.setup(ctx); err != nil {
+		log.WithFields(logrus.Fields{"err": err.Error()}).Error("Error in initial setup")
 		return 1
 	}
+	defer d.flushTracing()
+	defer d.audit.Close()
+	defer d.notifier.Stop()
 
-	if !d.RouteTableManager.InstanceIsRouter(ctx, d.Instance) {
-		log.WithFields(log.Fields{"instance_id": d.Instance}).Error("I am not a router (do not have src/destination checking disabled)")
-		return 1
+	// Without an instance, we're managing routes to other instances from outside them
+	if d.Instance != "" {
+		var router bool
+		err := d.retryStartup(ctx, "router check", func() (err error) {
+			router, err = d.RouteTableManager.InstanceIsRouter(ctx, d.Instance)
+			return err
+		})
+		if err != nil {
+			log.WithFields(logrus.Fields{"instance_id": d.Instance, "err": err.Error()}).Error("Could not check whether I am a router")
+			return 1
+		}
+		if !router {
+			log.WithFields(logrus.Fields{"instance_id": d.Instance}).Error("I am not a router (do not have src/destination checking disabled)")
+			return 1
+		}
+	}
+
+	if !oneShot {
+		if err := d.startStatusServer(); err != nil {
+			log.WithFields(logrus.Fields{"err": err.Error()}).Error("Error starting status server")
+			return 1
+		}
+		defer d.stopStatusServer()
+	}
+
+	if !oneShot && !noop {
+		defer d.releaseLocalAddresses()
 	}
 
 	d.quitChan = make(chan bool, 1)
 	d.runHealthChecks()
 	defer d.stopHealthChecks()
+	if !oneShot {
+		d.startGossip(ctx)
+		defer d.stopGossip()
+		d.startSpotWatcher()
+		defer d.stopSpotWatcher()
+		d.startLifecycleWatcher()
+		defer d.stopLifecycleWatcher()
+	}
 	err := d.RunRouteTables(ctx)
 	if err != nil {
-		log.WithFields(log.Fields{"err": err.Error()}).Error("Error in initial route table run")
-		return 1
+		if oneShot || d.Config.StartupFailure != config.StartupKeepRunning {
+			log.WithFields(logrus.Fields{"err": err.Error()}).Error("Error in initial route table run")
+			return 1
+		}
+		log.WithFields(logrus.Fields{"err": err.Error()}).Error("Error in initial route table run, will retry every poll_time")
+	} else {
+		d.notifyReady()
 	}
+	defer d.sdNotify.Stopping()
 	d.loopQuitChan = make(chan bool, 1)
 	if oneShot {
 		d.quitChan <- true
 	} else {
 		d.RunSleepLoop()
 	}
-	<-d.quitChan
+	select {
+	case <-d.quitChan:
+	case <-ctx.Done():
+	}
 	d.loopQuitChan <- true
 	return 0
 }
 
 func (d *Daemon) RunSleepLoop() {
+	ticker := d.Clock.NewTicker(d.FetchWait)
+	fetch := ticker.Chan()
+	// systemd's watchdog is pinged twice as often as it needs to be
+	var watchdog <-chan time.Time
+	var watchdogTicker clock.Ticker
+	if interval := d.sdNotify.WatchdogInterval(); interval > 0 {
+		watchdogTicker = d.Clock.NewTicker(interval / 2)
+		watchdog = watchdogTicker.Chan()
+	}
 	go func() {
-
-		ticker := time.NewTicker(d.FetchWait)
-		fetch := ticker.C
+		peerChange := d.gossipChanges()
 
 		for {
 			select {
 			case <-d.loopQuitChan:
 				ticker.Stop()
+				if watchdogTicker != nil {
+					watchdogTicker.Stop()
+				}
 				return
+			case <-watchdog:
+				d.pingWatchdog()
 			case <-fetch:
 				err := d.RunRouteTables(context.Background())
 				if err != nil {
-					log.WithFields(log.Fields{"err": err.Error()}).Warn("Error in route table poll run")
+					log.WithFields(logrus.Fields{"err": err.Error()}).Warn("Error in route table poll run")
+				} else {
+					d.notifyReady()
+				}
+				d.discoverGossipSeeds(context.Background())
+				d.sdNotify.Status(d.systemdStatus())
+			case <-peerChange:
+				log.Info("Gossip peer health changed, reevaluating routes")
+				err := d.RunRouteTables(context.Background())
+				if err != nil {
+					log.WithFields(logrus.Fields{"err": err.Error()}).Warn("Error in gossip triggered route table run")
+				} else {
+					d.notifyReady()
 				}
 			}
 		}
 	}()
 }
+
+// notifyReady tells systemd we are ready after the first route table run to succeed, which
+// under startup_failure: keep_running may not be the first run.
+func (d *Daemon) notifyReady() {
+	if d.ready {
+		return
+	}
+	d.ready = true
+	if err := d.sdNotify.Ready(d.systemdStatus()); err != nil {
+		log.WithFields(logrus.Fields{"err": err.Error()}).Warn("Could not tell systemd we are ready")
+	}
+}
+
+// pingWatchdog is called from the poll loop, so systemd's watchdog is only pinged while
+// the loop is going round, and then only if none of the healthchecks' runners are stuck.
+func (d *Daemon) pingWatchdog() {
+	now := d.Clock.Now()
+	for name, hc := range d.Config.Healthchecks {
+		if hc.Stalled(now, d.sdNotify.WatchdogInterval()) {
+			log.WithFields(logrus.Fields{"healthcheck": name}).Error("Healthcheck has stopped running, not pinging the systemd watchdog")
+			return
+		}
+	}
+	if err := d.sdNotify.Watchdog(d.systemdStatus()); err != nil {
+		log.WithFields(logrus.Fields{"err": err.Error()}).Warn("Could not ping the systemd watchdog")
+	}
+}
+
+// systemdStatus sums up the routes we own and the state of our healthchecks, for
+// systemctl status.
+func (d *Daemon) systemdStatus() string {
+	s := d.localState()
+	unhealthy := make([]string, 0)
+	for name, healthy := range s.Healthchecks {
+		if !healthy {
+			unhealthy = append(unhealthy, name)
+		}
+	}
+	sort.Strings(unhealthy)
+	status := fmt.Sprintf("Owns %d routes, %d/%d healthchecks healthy", len(s.Owned), len(s.Healthchecks)-len(unhealthy), len(s.Healthchecks))
+	if len(unhealthy) > 0 {
+		status += fmt.Sprintf(" (unhealthy: %s)", strings.Join(unhealthy, ", "))
+	}
+	if failing := d.failingRouteTables(); len(failing) > 0 {
+		status += fmt.Sprintf(", route tables failing: %s", strings.Join(failing, ", "))
+	}
+	if reason := d.drain.Reason(); reason != "" {
+		status += ", draining: " + reason
+	}
+	return status
+}
@@ -0,0 +1,79 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/justenwalker/awsnycast/aws"
+	"github.com/justenwalker/awsnycast/gossip"
+)
+
+func (d *Daemon) setupGossip() error {
+	if d.Config.Gossip == nil {
+		return nil
+	}
+	if d.Instance == "" {
+		return errors.New("gossip needs an instance_id in the instance metadata")
+	}
+	node, err := gossip.New(*d.Config.Gossip, d.Instance, d.localState, d.Clock)
+	if err != nil {
+		return err
+	}
+	d.gossip = node
+	if m, ok := d.RouteTableManager.(*aws.RouteTableManagerEC2); ok {
+		m.Peers = node
+	}
+	return nil
+}
+
+// discoverGossipSeeds adds every instance with the configured seed_tag to the gossip seeds.
+func (d *Daemon) discoverGossipSeeds(ctx context.Context) {
+	if d.gossip == nil || d.Config.Gossip.SeedTag == nil {
+		return
+	}
+	m, ok := d.RouteTableManager.(*aws.RouteTableManagerEC2)
+	if !ok {
+		return
+	}
+	key := d.Config.Gossip.SeedTag["key"]
+	value := d.Config.Gossip.SeedTag["value"]
+	contextLogger := log.WithFields(logrus.Fields{"key": key, "value": value})
+	ips, err := m.InstanceIPsByTag(ctx, key, value)
+	if err != nil {
+		contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Warn("Could not discover gossip seeds by tag")
+		return
+	}
+	seeds := make([]string, len(ips))
+	for i, ip := range ips {
+		seeds[i] = net.JoinHostPort(ip, d.Config.Gossip.Port())
+	}
+	contextLogger.WithFields(logrus.Fields{"seeds": seeds}).Debug("Discovered gossip seeds by tag")
+	d.gossip.AddSeeds(seeds)
+}
+
+// gossipChanges fires when a peer's health changes; it is nil (so never fires) without gossip.
+func (d *Daemon) gossipChanges() <-chan bool {
+	if d.gossip == nil {
+		return nil
+	}
+	return d.gossip.Changes()
+}
+
+func (d *Daemon) startGossip(ctx context.Context) {
+	if d.gossip == nil {
+		return
+	}
+	d.discoverGossipSeeds(ctx)
+	d.gossip.Start()
+	log.WithFields(logrus.Fields{"addr": d.gossip.Addr()}).Info("Started gossip")
+}
+
+func (d *Daemon) stopGossip() {
+	if d.gossip == nil {
+		return
+	}
+	d.gossip.Stop()
+}
@@ -0,0 +1,125 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/sirupsen/logrus"
+)
+
+// leavingLifecycleState is true for the Auto Scaling target lifecycle states in which this
+// instance stops serving traffic.
+func leavingLifecycleState(state string) bool {
+	return state == "Terminated" || strings.HasPrefix(state, "Warmed:")
+}
+
+func (d *Daemon) startLifecycleWatcher() {
+	if d.Config.AutoScaling == nil {
+		return
+	}
+	d.lifecycleQuitChan = make(chan bool)
+	go func() {
+		ticker := d.Clock.NewTicker(time.Duration(d.Config.AutoScaling.Interval * float64(time.Second)))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.lifecycleQuitChan:
+				return
+			case <-ticker.Chan():
+				// Only in the metadata service if the instance is in an Auto Scaling group
+				state, err := d.MetadataFetcher.GetMetadata("autoscaling/target-lifecycle-state")
+				if err != nil || !leavingLifecycleState(state) {
+					continue
+				}
+				d.handleLifecycle(context.Background(), state)
+				return
+			}
+		}
+	}()
+}
+
+func (d *Daemon) stopLifecycleWatcher() {
+	if d.lifecycleQuitChan == nil {
+		return
+	}
+	close(d.lifecycleQuitChan)
+}
+
+// handleLifecycle drains our routes, waits (up to drain_timeout) for other instances to take
+// over the ones we held, then lets Auto Scaling carry on.
+func (d *Daemon) handleLifecycle(ctx context.Context, state string) {
+	contextLogger := log.WithFields(logrus.Fields{"target_lifecycle_state": state})
+	owned := d.localState().Owned
+	d.Drain(fmt.Sprintf("auto scaling target lifecycle state %s", state))
+
+	timeout := time.Duration(d.Config.AutoScaling.DrainTimeout * float64(time.Second))
+	interval := time.Duration(d.Config.AutoScaling.Interval * float64(time.Second))
+	deadline := d.Clock.Now().Add(timeout)
+	for !d.handedOver(ctx, owned) {
+		if d.Clock.Now().After(deadline) {
+			contextLogger.WithFields(logrus.Fields{"drain_timeout": timeout}).Warn("Routes were not all handed over before drain_timeout, completing lifecycle action anyway")
+			break
+		}
+		select {
+		case <-d.lifecycleQuitChan:
+			return
+		case <-d.Clock.After(interval):
+		}
+	}
+
+	group := d.Config.AutoScaling.GroupName
+	if group == "" {
+		var err error
+		if group, err = d.Lifecycle.GroupName(ctx, d.Instance); err != nil {
+			contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Error("Could not find Auto Scaling group to complete lifecycle action")
+			return
+		}
+	}
+	contextLogger = contextLogger.WithFields(logrus.Fields{
+		"group":          group,
+		"lifecycle_hook": d.Config.AutoScaling.LifecycleHook,
+	})
+	if err := d.Lifecycle.Complete(ctx, group, d.Config.AutoScaling.LifecycleHook, d.Instance); err != nil {
+		contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Error("Error completing lifecycle action")
+		return
+	}
+	contextLogger.Info("Completed lifecycle action")
+}
+
+// handedOver is true once every route in owned (as "rtb cidr") points at another instance.
+func (d *Daemon) handedOver(ctx context.Context, owned []string) bool {
+	if len(owned) == 0 {
+		return true
+	}
+	tables, err := d.RouteTableManager.GetRouteTables(ctx)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err.Error()}).Warn("Error getting route tables to check routes have been handed over")
+		return false
+	}
+	for _, o := range owned {
+		parts := strings.SplitN(o, " ", 2)
+		if instance := routeInstance(tables, parts[0], parts[1]); instance == "" || instance == d.Instance {
+			log.WithFields(logrus.Fields{"rtb": parts[0], "cidr": parts[1]}).Debug("Route not handed over yet")
+			return false
+		}
+	}
+	return true
+}
+
+// routeInstance is the instance a route points at, or empty if there is no such route.
+func routeInstance(tables []ec2type.RouteTable, rtb string, cidr string) string {
+	for _, table := range tables {
+		if table.RouteTableId == nil || *table.RouteTableId != rtb {
+			continue
+		}
+		for _, route := range table.Routes {
+			if route.DestinationCidrBlock != nil && *route.DestinationCidrBlock == cidr && route.InstanceId != nil {
+				return *route.InstanceId
+			}
+		}
+	}
+	return ""
+}
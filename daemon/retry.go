@@ -0,0 +1,66 @@
+package daemon
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults for retrying startup steps (instance metadata, AWS credentials and the router
+// check), which often aren't ready yet when an instance has just booted.
+const (
+	defaultStartupAttempts = 8
+	defaultStartupBackoff  = time.Second
+	maxStartupBackoff      = 30 * time.Second
+)
+
+// jitter is a random wait of between half and all of d, so that instances booting together
+// don't all retry at once.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryStartup runs f until it succeeds, up to StartupAttempts times, backing off
+// exponentially (with jitter) from StartupBackoff between attempts.
+func (d *Daemon) retryStartup(ctx context.Context, what string, f func() error) error {
+	attempts := d.StartupAttempts
+	if attempts <= 0 {
+		attempts = defaultStartupAttempts
+	}
+	backoff := d.StartupBackoff
+	if backoff <= 0 {
+		backoff = defaultStartupBackoff
+	}
+	contextLogger := log.WithFields(logrus.Fields{"step": what})
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			if attempt > 1 {
+				contextLogger.WithFields(logrus.Fields{"attempt": attempt}).Info("Startup step succeeded after retrying")
+			}
+			return nil
+		}
+		contextLogger = contextLogger.WithFields(logrus.Fields{
+			"attempt":  attempt,
+			"attempts": attempts,
+			"err":      err.Error(),
+		})
+		if attempt >= attempts {
+			contextLogger.Error("Startup step failed, giving up")
+			return err
+		}
+		wait := jitter(backoff)
+		contextLogger.WithFields(logrus.Fields{"retry_in": wait.String()}).Warn("Startup step failed, retrying")
+		select {
+		case <-d.Clock.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+		if backoff > maxStartupBackoff {
+			backoff = maxStartupBackoff
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// spotInstanceAction is the body of spot/instance-action in the metadata service
+type spotInstanceAction struct {
+	Action string `json:"action"`
+	Time   string `json:"time"`
+}
+
+// spotRebalance is the body of events/recommendations/rebalance in the metadata service
+type spotRebalance struct {
+	NoticeTime string `json:"noticeTime"`
+}
+
+// spotNotice returns why we should drain, if the metadata service says this spot instance
+// is about to be interrupted (or, with drain_on_rebalance, is at risk of it). The keys
+// only exist in the metadata service when there is a notice.
+func (d *Daemon) spotNotice() (string, bool) {
+	if body, err := d.MetadataFetcher.GetMetadata("spot/instance-action"); err == nil {
+		var action spotInstanceAction
+		if err := json.Unmarshal([]byte(body), &action); err != nil {
+			log.WithFields(logrus.Fields{"err": err.Error(), "body": body}).Warn("Could not parse spot instance-action, draining anyway")
+		}
+		return fmt.Sprintf("spot interruption notice: %s at %s", action.Action, action.Time), true
+	}
+	if d.Config.Spot.DrainOnRebalance {
+		if body, err := d.MetadataFetcher.GetMetadata("events/recommendations/rebalance"); err == nil {
+			var rebalance spotRebalance
+			if err := json.Unmarshal([]byte(body), &rebalance); err != nil {
+				log.WithFields(logrus.Fields{"err": err.Error(), "body": body}).Warn("Could not parse spot rebalance recommendation, draining anyway")
+			}
+			return fmt.Sprintf("spot rebalance recommendation at %s", rebalance.NoticeTime), true
+		}
+	}
+	return "", false
+}
+
+func (d *Daemon) startSpotWatcher() {
+	if d.Config.Spot == nil {
+		return
+	}
+	d.spotQuitChan = make(chan bool)
+	go func() {
+		ticker := d.Clock.NewTicker(time.Duration(d.Config.Spot.Interval * float64(time.Second)))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.spotQuitChan:
+				return
+			case <-ticker.Chan():
+				if reason, ok := d.spotNotice(); ok {
+					d.Drain(reason)
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (d *Daemon) stopSpotWatcher() {
+	if d.spotQuitChan == nil {
+		return
+	}
+	close(d.spotQuitChan)
+}
@@ -0,0 +1,122 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/justenwalker/awsnycast/aws"
+	"github.com/justenwalker/awsnycast/gossip"
+)
+
+// Status is served as JSON on the status listen address.
+type Status struct {
+	gossip.State
+	Version     string                       `json:"version"`
+	Draining    string                       `json:"draining,omitempty"`
+	Damping     map[string]aws.DampingStatus `json:"damping,omitempty"`
+	RouteTables map[string]RouteTableStatus  `json:"route_tables"`
+}
+
+// RouteTableStatus is how the last run over one of the configured route tables went.
+type RouteTableStatus struct {
+	LastRun     time.Time  `json:"last_run"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// localState is our current healthcheck and route state, as told to other instances.
+func (d *Daemon) localState() gossip.State {
+	s := gossip.State{
+		Instance:     d.Instance,
+		Healthchecks: make(map[string]bool),
+		Routes:       make(map[string]bool),
+		Owned:        make([]string, 0),
+	}
+	for name, hc := range d.Config.Healthchecks {
+		s.Healthchecks[name] = hc.IsHealthy()
+	}
+	for _, rt := range d.Config.RouteTables {
+		for _, mr := range rt.ManageRoutes {
+			if !mr.InstanceIsSelf {
+				continue
+			}
+			healthy := mr.LocalHealthy()
+			if prev, ok := s.Routes[mr.Cidr]; ok {
+				healthy = healthy && prev
+			}
+			s.Routes[mr.Cidr] = healthy
+			for _, rtb := range mr.OwnedRouteTables() {
+				s.Owned = append(s.Owned, rtb+" "+mr.Cidr)
+			}
+		}
+	}
+	return s
+}
+
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Status{
+		State:       d.localState(),
+		Version:     d.Version,
+		Draining:    d.drain.Reason(),
+		Damping:     d.dampingStatus(),
+		RouteTables: d.routeTableStatuses(),
+	})
+}
+
+// routeTableStatuses is a copy of the status of each route table which has been run.
+func (d *Daemon) routeTableStatuses() map[string]RouteTableStatus {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	status := make(map[string]RouteTableStatus)
+	for name, s := range d.routeTableStatus {
+		status[name] = s
+	}
+	return status
+}
+
+// dampingStatus is the flap damping and min_hold_time state of each managed route, keyed
+// by route table and CIDR.
+func (d *Daemon) dampingStatus() map[string]aws.DampingStatus {
+	status := make(map[string]aws.DampingStatus)
+	for _, rt := range d.Config.RouteTables {
+		for _, mr := range rt.ManageRoutes {
+			for rtb, s := range mr.DampingStatus() {
+				status[rtb+" "+mr.Cidr] = s
+			}
+		}
+	}
+	return status
+}
+
+func (d *Daemon) startStatusServer() error {
+	if d.Config.Status == nil {
+		return nil
+	}
+	l, err := net.Listen("tcp", d.Config.Status.Listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/status", d)
+	d.statusServer = &http.Server{Handler: mux}
+	go d.statusServer.Serve(l)
+	log.WithFields(logrus.Fields{"addr": l.Addr().String()}).Info("Serving status")
+	return nil
+}
+
+func (d *Daemon) stopStatusServer() {
+	if d.statusServer == nil {
+		return
+	}
+	d.statusServer.Close()
+	d.statusServer = nil
+}
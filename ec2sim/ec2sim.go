@@ -0,0 +1,756 @@
+// Package ec2sim is an in-memory stand-in for the parts of the EC2 API that AWSnycast uses.
+// It keeps route tables, instances and network interfaces, and changes them the way EC2
+// would (routes to a stopped or terminated instance become blackholes, DryRun requests are
+// checked but change nothing), so that tests can play out several steps of a failover
+// against the real route table manager. It also records every call, and can be told to
+// throttle or fail calls.
+//
+// Everything is safe to use from several goroutines, e.g. from two daemons racing to take
+// over the same route.
+package ec2sim
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+// Instance is an instance to add to the simulator. State defaults to running, and the
+// instance and system status checks default to ok. SourceDestCheck defaults to disabled,
+// as it is on the instances AWSnycast routes to.
+type Instance struct {
+	ID              string
+	PrivateIP       string
+	SubnetID        string
+	VpcID           string
+	State           ec2type.InstanceStateName
+	InstanceStatus  ec2type.SummaryStatus
+	SystemStatus    ec2type.SummaryStatus
+	Tags            map[string]string
+	SourceDestCheck bool
+}
+
+// NetworkInterface is an ENI to add to the simulator. InstanceID is empty for an ENI that
+// isn't attached to anything.
+type NetworkInterface struct {
+	ID              string
+	InstanceID      string
+	DeviceIndex     int32
+	PrivateIP       string
+	SubnetID        string
+	SourceDestCheck bool
+}
+
+// Call is one request made to the simulator.
+type Call struct {
+	Operation string
+	Input     interface{}
+}
+
+// EC2 is the simulator. The zero value is not usable, use New.
+type EC2 struct {
+	mu          sync.Mutex
+	routeTables map[string]*ec2type.RouteTable
+	instances   map[string]*Instance
+	interfaces  map[string]*NetworkInterface
+	calls       []Call
+	failures    map[string][]error
+}
+
+func New() *EC2 {
+	return &EC2{
+		routeTables: make(map[string]*ec2type.RouteTable),
+		instances:   make(map[string]*Instance),
+		interfaces:  make(map[string]*NetworkInterface),
+		calls:       make([]Call, 0),
+		failures:    make(map[string][]error),
+	}
+}
+
+func apiError(code string, format string, args ...interface{}) error {
+	return &smithy.GenericAPIError{Code: code, Message: fmt.Sprintf(format, args...), Fault: smithy.FaultClient}
+}
+
+// ErrorCode is the EC2 error code of err (e.g. "DryRunOperation"), or empty if it is not an
+// API error.
+func ErrorCode(err error) string {
+	if apiErr, ok := err.(smithy.APIError); ok {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+func dryRunError() error {
+	return apiError("DryRunOperation", "Request would have succeeded, but DryRun flag is set.")
+}
+
+// AddRouteTable adds an empty route table (apart from the local route for the VPC's CIDR,
+// if one is given).
+func (e *EC2) AddRouteTable(id string, vpcID string, vpcCIDR string, tags map[string]string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rtb := &ec2type.RouteTable{
+		RouteTableId: aws.String(id),
+		VpcId:        aws.String(vpcID),
+		Routes:       make([]ec2type.Route, 0),
+		Tags:         toTags(tags),
+	}
+	if vpcCIDR != "" {
+		rtb.Routes = append(rtb.Routes, ec2type.Route{
+			DestinationCidrBlock: aws.String(vpcCIDR),
+			GatewayId:            aws.String("local"),
+			Origin:               ec2type.RouteOriginCreateRouteTable,
+			State:                ec2type.RouteStateActive,
+		})
+	}
+	e.routeTables[id] = rtb
+}
+
+// AddInstance adds an instance, with a primary network interface (eni-<instance id without
+// the i->) if it has a PrivateIP.
+func (e *EC2) AddInstance(i Instance) {
+	if i.State == "" {
+		i.State = ec2type.InstanceStateNameRunning
+	}
+	if i.InstanceStatus == "" {
+		i.InstanceStatus = ec2type.SummaryStatusOk
+	}
+	if i.SystemStatus == "" {
+		i.SystemStatus = ec2type.SummaryStatusOk
+	}
+	e.mu.Lock()
+	e.instances[i.ID] = &i
+	e.mu.Unlock()
+	if i.PrivateIP != "" {
+		e.AddNetworkInterface(NetworkInterface{
+			ID:              "eni-" + strings.TrimPrefix(i.ID, "i-"),
+			InstanceID:      i.ID,
+			PrivateIP:       i.PrivateIP,
+			SubnetID:        i.SubnetID,
+			SourceDestCheck: i.SourceDestCheck,
+		})
+	}
+}
+
+func (e *EC2) AddNetworkInterface(n NetworkInterface) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.interfaces[n.ID] = &n
+}
+
+// AddRoute adds a route straight to a route table, without it being recorded as a call,
+// to set up the state a test starts from. target is an instance, ENI, or internet, VPN or
+// transit gateway ID.
+func (e *EC2) AddRoute(rtb string, cidr string, target string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if strings.HasPrefix(target, "igw-") || strings.HasPrefix(target, "vgw-") || strings.HasPrefix(target, "tgw-") {
+		return e.addGatewayRoute(rtb, cidr, target)
+	}
+	input := &ec2.CreateRouteInput{RouteTableId: aws.String(rtb), DestinationCidrBlock: aws.String(cidr)}
+	if strings.HasPrefix(target, "eni-") {
+		input.NetworkInterfaceId = aws.String(target)
+	} else {
+		input.InstanceId = aws.String(target)
+	}
+	return e.createRoute(input)
+}
+
+func (e *EC2) addGatewayRoute(rtb string, cidr string, target string) error {
+	r, err := e.routeTable(aws.String(rtb))
+	if err != nil {
+		return err
+	}
+	if findRoute(r, cidr) >= 0 {
+		return apiError("RouteAlreadyExists", "The route identified by %s already exists.", cidr)
+	}
+	route := ec2type.Route{
+		DestinationCidrBlock: aws.String(cidr),
+		Origin:               ec2type.RouteOriginCreateRoute,
+		State:                ec2type.RouteStateActive,
+	}
+	if strings.HasPrefix(target, "tgw-") {
+		route.TransitGatewayId = aws.String(target)
+	} else {
+		route.GatewayId = aws.String(target)
+	}
+	r.Routes = append(r.Routes, route)
+	return nil
+}
+
+// SetInstanceState changes an instance's state, e.g. to stopped or terminated. Routes to an
+// instance which is no longer running become blackholes, and come back if it starts again.
+// A terminated instance's network interfaces are deleted.
+func (e *EC2) SetInstanceState(id string, state ec2type.InstanceStateName) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	i, ok := e.instances[id]
+	if !ok {
+		return
+	}
+	i.State = state
+	if state == ec2type.InstanceStateNameTerminated {
+		for nicID, n := range e.interfaces {
+			if n.InstanceID == id {
+				delete(e.interfaces, nicID)
+			}
+		}
+	}
+	for _, rtb := range e.routeTables {
+		for idx := range rtb.Routes {
+			route := &rtb.Routes[idx]
+			if route.InstanceId != nil && *route.InstanceId == id {
+				route.State = e.routeState(route)
+			}
+		}
+	}
+}
+
+// SetInstanceStatus sets the result of an instance's instance and system status checks.
+func (e *EC2) SetInstanceStatus(id string, instanceStatus ec2type.SummaryStatus, systemStatus ec2type.SummaryStatus) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if i, ok := e.instances[id]; ok {
+		i.InstanceStatus = instanceStatus
+		i.SystemStatus = systemStatus
+	}
+}
+
+// Throttle makes the next n calls to operation (e.g. "ReplaceRoute") fail with
+// RequestLimitExceeded.
+func (e *EC2) Throttle(operation string, n int) {
+	for i := 0; i < n; i++ {
+		e.FailNext(operation, apiError("RequestLimitExceeded", "Request limit exceeded."))
+	}
+}
+
+// FailNext makes the next call to operation fail with err, without changing anything.
+func (e *EC2) FailNext(operation string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures[operation] = append(e.failures[operation], err)
+}
+
+// Calls returns every call made so far, in order.
+func (e *EC2) Calls() []Call {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Call{}, e.calls...)
+}
+
+// CallsTo returns the inputs of every call made to operation so far, in order.
+func (e *EC2) CallsTo(operation string) []interface{} {
+	inputs := make([]interface{}, 0)
+	for _, c := range e.Calls() {
+		if c.Operation == operation {
+			inputs = append(inputs, c.Input)
+		}
+	}
+	return inputs
+}
+
+// ResetCalls forgets the calls made so far.
+func (e *EC2) ResetCalls() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.calls = make([]Call, 0)
+}
+
+// Route returns a copy of the route for cidr in a route table, if there is one.
+func (e *EC2) Route(rtb string, cidr string) (ec2type.Route, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if t, ok := e.routeTables[rtb]; ok {
+		if idx := findRoute(t, cidr); idx >= 0 {
+			return t.Routes[idx], true
+		}
+	}
+	return ec2type.Route{}, false
+}
+
+// RouteTarget is the instance a route points at, or the ENI if it isn't attached to one,
+// or the gateway, or empty if there is no such route.
+func (e *EC2) RouteTarget(rtb string, cidr string) string {
+	route, ok := e.Route(rtb, cidr)
+	if !ok {
+		return ""
+	}
+	if route.InstanceId != nil {
+		return *route.InstanceId
+	}
+	if route.NetworkInterfaceId != nil {
+		return *route.NetworkInterfaceId
+	}
+	if route.GatewayId != nil {
+		return *route.GatewayId
+	}
+	if route.TransitGatewayId != nil {
+		return *route.TransitGatewayId
+	}
+	return ""
+}
+
+// call records a call, and returns the error it should fail with, if any. Must be called
+// with the lock held.
+func (e *EC2) call(operation string, input interface{}) error {
+	e.calls = append(e.calls, Call{Operation: operation, Input: input})
+	if failures := e.failures[operation]; len(failures) > 0 {
+		e.failures[operation] = failures[1:]
+		return failures[0]
+	}
+	return nil
+}
+
+func toTags(tags map[string]string) []ec2type.Tag {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]ec2type.Tag, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, ec2type.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return out
+}
+
+func findRoute(rtb *ec2type.RouteTable, cidr string) int {
+	for idx, route := range rtb.Routes {
+		if route.DestinationCidrBlock != nil && *route.DestinationCidrBlock == cidr {
+			return idx
+		}
+	}
+	return -1
+}
+
+// routeState is active if the route's instance is running, and blackhole otherwise.
+func (e *EC2) routeState(route *ec2type.Route) ec2type.RouteState {
+	if route.NetworkInterfaceId != nil {
+		if _, ok := e.interfaces[*route.NetworkInterfaceId]; !ok {
+			return ec2type.RouteStateBlackhole
+		}
+	}
+	if route.InstanceId != nil {
+		if i, ok := e.instances[*route.InstanceId]; !ok || i.State != ec2type.InstanceStateNameRunning {
+			return ec2type.RouteStateBlackhole
+		}
+	}
+	return ec2type.RouteStateActive
+}
+
+// target fills in a route's instance and ENI from the instance or ENI given in a request,
+// as EC2 does: an instance must have exactly one ENI to be used as a target.
+func (e *EC2) target(route *ec2type.Route, instanceID *string, nicID *string) error {
+	switch {
+	case nicID != nil:
+		n, ok := e.interfaces[*nicID]
+		if !ok {
+			return apiError("InvalidNetworkInterfaceID.NotFound", "The networkInterface ID '%s' does not exist", *nicID)
+		}
+		route.NetworkInterfaceId = aws.String(n.ID)
+		route.InstanceId = nil
+		if n.InstanceID != "" {
+			route.InstanceId = aws.String(n.InstanceID)
+		}
+	case instanceID != nil:
+		i, ok := e.instances[*instanceID]
+		if !ok || i.State == ec2type.InstanceStateNameTerminated {
+			return apiError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", *instanceID)
+		}
+		nics := e.instanceInterfaces(i.ID)
+		if len(nics) != 1 {
+			return apiError("InvalidInstanceID", "There are multiple interfaces attached to instance '%s'. Please specify an interface ID for the operation instead.", i.ID)
+		}
+		route.InstanceId = aws.String(i.ID)
+		route.NetworkInterfaceId = aws.String(nics[0].ID)
+	default:
+		return apiError("MissingParameter", "The request must contain exactly one of gatewayId, natGatewayId, networkInterfaceId, vpcPeeringConnectionId or instanceId")
+	}
+	route.InstanceOwnerId = aws.String("123456789012")
+	route.Origin = ec2type.RouteOriginCreateRoute
+	route.State = e.routeState(route)
+	return nil
+}
+
+func (e *EC2) instanceInterfaces(instanceID string) []*NetworkInterface {
+	nics := make([]*NetworkInterface, 0)
+	for _, n := range e.interfaces {
+		if n.InstanceID == instanceID {
+			nics = append(nics, n)
+		}
+	}
+	sort.Slice(nics, func(a, b int) bool { return nics[a].DeviceIndex < nics[b].DeviceIndex })
+	return nics
+}
+
+func (e *EC2) routeTable(id *string) (*ec2type.RouteTable, error) {
+	if id == nil {
+		return nil, apiError("MissingParameter", "The request must contain the parameter routeTableId")
+	}
+	rtb, ok := e.routeTables[*id]
+	if !ok {
+		return nil, apiError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", *id)
+	}
+	return rtb, nil
+}
+
+func (e *EC2) createRoute(input *ec2.CreateRouteInput) error {
+	rtb, err := e.routeTable(input.RouteTableId)
+	if err != nil {
+		return err
+	}
+	if findRoute(rtb, aws.ToString(input.DestinationCidrBlock)) >= 0 {
+		return apiError("RouteAlreadyExists", "The route identified by %s already exists.", aws.ToString(input.DestinationCidrBlock))
+	}
+	route := ec2type.Route{DestinationCidrBlock: input.DestinationCidrBlock}
+	if err := e.target(&route, input.InstanceId, input.NetworkInterfaceId); err != nil {
+		return err
+	}
+	if aws.ToBool(input.DryRun) {
+		return dryRunError()
+	}
+	rtb.Routes = append(rtb.Routes, route)
+	return nil
+}
+
+func (e *EC2) CreateRoute(ctx context.Context, input *ec2.CreateRouteInput, opts ...func(*ec2.Options)) (*ec2.CreateRouteOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call("CreateRoute", input); err != nil {
+		return nil, err
+	}
+	if err := e.createRoute(input); err != nil {
+		return nil, err
+	}
+	return &ec2.CreateRouteOutput{Return: aws.Bool(true)}, nil
+}
+
+func (e *EC2) ReplaceRoute(ctx context.Context, input *ec2.ReplaceRouteInput, opts ...func(*ec2.Options)) (*ec2.ReplaceRouteOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call("ReplaceRoute", input); err != nil {
+		return nil, err
+	}
+	rtb, err := e.routeTable(input.RouteTableId)
+	if err != nil {
+		return nil, err
+	}
+	idx := findRoute(rtb, aws.ToString(input.DestinationCidrBlock))
+	if idx < 0 {
+		return nil, apiError("InvalidParameterValue", "There is no route defined for '%s' in the route table. Use CreateRoute instead.", aws.ToString(input.DestinationCidrBlock))
+	}
+	route := ec2type.Route{DestinationCidrBlock: input.DestinationCidrBlock}
+	if err := e.target(&route, input.InstanceId, input.NetworkInterfaceId); err != nil {
+		return nil, err
+	}
+	if aws.ToBool(input.DryRun) {
+		return nil, dryRunError()
+	}
+	route.Origin = ec2type.RouteOriginCreateRoute
+	rtb.Routes[idx] = route
+	return &ec2.ReplaceRouteOutput{}, nil
+}
+
+func (e *EC2) DeleteRoute(ctx context.Context, input *ec2.DeleteRouteInput, opts ...func(*ec2.Options)) (*ec2.DeleteRouteOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call("DeleteRoute", input); err != nil {
+		return nil, err
+	}
+	rtb, err := e.routeTable(input.RouteTableId)
+	if err != nil {
+		return nil, err
+	}
+	idx := findRoute(rtb, aws.ToString(input.DestinationCidrBlock))
+	if idx < 0 {
+		return nil, apiError("InvalidRoute.NotFound", "no route with destination-cidr-block %s in route table %s", aws.ToString(input.DestinationCidrBlock), *input.RouteTableId)
+	}
+	if aws.ToBool(input.DryRun) {
+		return nil, dryRunError()
+	}
+	rtb.Routes = append(rtb.Routes[:idx], rtb.Routes[idx+1:]...)
+	return &ec2.DeleteRouteOutput{}, nil
+}
+
+// copyRouteTable copies a route table, so that callers can't see it change under them.
+func copyRouteTable(rtb *ec2type.RouteTable) ec2type.RouteTable {
+	c := *rtb
+	c.Routes = append([]ec2type.Route{}, rtb.Routes...)
+	c.Tags = append([]ec2type.Tag{}, rtb.Tags...)
+	c.Associations = append([]ec2type.RouteTableAssociation{}, rtb.Associations...)
+	return c
+}
+
+func tagsMatch(tags []ec2type.Tag, key string, values []string) bool {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key && contains(values, aws.ToString(tag.Value)) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFilters checks fields (filter name to value) and tags against EC2 style filters.
+// Filters which aren't in fields and aren't tag filters are an error, so that a test
+// relying on one the simulator doesn't understand fails rather than passing by accident.
+func matchFilters(filters []ec2type.Filter, fields map[string]string, tags []ec2type.Tag) (bool, error) {
+	for _, f := range filters {
+		name := aws.ToString(f.Name)
+		if strings.HasPrefix(name, "tag:") {
+			if !tagsMatch(tags, strings.TrimPrefix(name, "tag:"), f.Values) {
+				return false, nil
+			}
+			continue
+		}
+		v, ok := fields[name]
+		if !ok {
+			return false, apiError("InvalidParameterValue", "The filter '%s' is invalid", name)
+		}
+		if !contains(f.Values, v) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (e *EC2) DescribeRouteTables(ctx context.Context, input *ec2.DescribeRouteTablesInput, opts ...func(*ec2.Options)) (*ec2.DescribeRouteTablesOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call("DescribeRouteTables", input); err != nil {
+		return nil, err
+	}
+	for _, id := range input.RouteTableIds {
+		if _, ok := e.routeTables[id]; !ok {
+			return nil, apiError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", id)
+		}
+	}
+	ids := make([]string, 0, len(e.routeTables))
+	for id := range e.routeTables {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	out := &ec2.DescribeRouteTablesOutput{RouteTables: make([]ec2type.RouteTable, 0)}
+	for _, id := range ids {
+		rtb := e.routeTables[id]
+		if len(input.RouteTableIds) > 0 && !contains(input.RouteTableIds, id) {
+			continue
+		}
+		ok, err := matchFilters(input.Filters, map[string]string{
+			"route-table-id": id,
+			"vpc-id":         aws.ToString(rtb.VpcId),
+		}, rtb.Tags)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out.RouteTables = append(out.RouteTables, copyRouteTable(rtb))
+		}
+	}
+	return out, nil
+}
+
+func (e *EC2) DescribeNetworkInterfaces(ctx context.Context, input *ec2.DescribeNetworkInterfacesInput, opts ...func(*ec2.Options)) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call("DescribeNetworkInterfaces", input); err != nil {
+		return nil, err
+	}
+	for _, id := range input.NetworkInterfaceIds {
+		if _, ok := e.interfaces[id]; !ok {
+			return nil, apiError("InvalidNetworkInterfaceID.NotFound", "The networkInterface ID '%s' does not exist", id)
+		}
+	}
+	ids := make([]string, 0, len(e.interfaces))
+	for id := range e.interfaces {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	out := &ec2.DescribeNetworkInterfacesOutput{NetworkInterfaces: make([]ec2type.NetworkInterface, 0)}
+	for _, id := range ids {
+		n := e.interfaces[id]
+		if len(input.NetworkInterfaceIds) > 0 && !contains(input.NetworkInterfaceIds, id) {
+			continue
+		}
+		fields := map[string]string{
+			"network-interface-id":    n.ID,
+			"subnet-id":               n.SubnetID,
+			"private-ip-address":      n.PrivateIP,
+			"attachment.instance-id":  n.InstanceID,
+			"attachment.device-index": "",
+		}
+		if n.InstanceID != "" {
+			fields["attachment.device-index"] = fmt.Sprintf("%d", n.DeviceIndex)
+		}
+		ok, err := matchFilters(input.Filters, fields, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		nic := ec2type.NetworkInterface{
+			NetworkInterfaceId: aws.String(n.ID),
+			PrivateIpAddress:   aws.String(n.PrivateIP),
+			SubnetId:           aws.String(n.SubnetID),
+			SourceDestCheck:    aws.Bool(n.SourceDestCheck),
+			Status:             ec2type.NetworkInterfaceStatusAvailable,
+		}
+		if n.InstanceID != "" {
+			nic.Status = ec2type.NetworkInterfaceStatusInUse
+			nic.Attachment = &ec2type.NetworkInterfaceAttachment{
+				InstanceId:  aws.String(n.InstanceID),
+				DeviceIndex: aws.Int32(n.DeviceIndex),
+				Status:      ec2type.AttachmentStatusAttached,
+			}
+		}
+		out.NetworkInterfaces = append(out.NetworkInterfaces, nic)
+	}
+	return out, nil
+}
+
+func (e *EC2) instance(id string) (*Instance, error) {
+	i, ok := e.instances[id]
+	if !ok {
+		return nil, apiError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", id)
+	}
+	return i, nil
+}
+
+func (e *EC2) DescribeInstanceAttribute(ctx context.Context, input *ec2.DescribeInstanceAttributeInput, opts ...func(*ec2.Options)) (*ec2.DescribeInstanceAttributeOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call("DescribeInstanceAttribute", input); err != nil {
+		return nil, err
+	}
+	i, err := e.instance(aws.ToString(input.InstanceId))
+	if err != nil {
+		return nil, err
+	}
+	if input.Attribute != ec2type.InstanceAttributeNameSourceDestCheck {
+		return nil, apiError("InvalidParameterValue", "Attribute %s is not simulated", input.Attribute)
+	}
+	// EC2 reports the primary interface's setting
+	sourceDestCheck := i.SourceDestCheck
+	if nics := e.instanceInterfaces(i.ID); len(nics) > 0 {
+		sourceDestCheck = nics[0].SourceDestCheck
+	}
+	return &ec2.DescribeInstanceAttributeOutput{
+		InstanceId:      aws.String(i.ID),
+		SourceDestCheck: &ec2type.AttributeBooleanValue{Value: aws.Bool(sourceDestCheck)},
+	}, nil
+}
+
+func (e *EC2) sortedInstances(ids []string) ([]*Instance, error) {
+	instances := make([]*Instance, 0)
+	for _, id := range ids {
+		i, err := e.instance(id)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, i)
+	}
+	if len(ids) == 0 {
+		for _, i := range e.instances {
+			instances = append(instances, i)
+		}
+	}
+	sort.Slice(instances, func(a, b int) bool { return instances[a].ID < instances[b].ID })
+	return instances, nil
+}
+
+func (e *EC2) DescribeInstanceStatus(ctx context.Context, input *ec2.DescribeInstanceStatusInput, opts ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call("DescribeInstanceStatus", input); err != nil {
+		return nil, err
+	}
+	instances, err := e.sortedInstances(input.InstanceIds)
+	if err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeInstanceStatusOutput{InstanceStatuses: make([]ec2type.InstanceStatus, 0)}
+	for _, i := range instances {
+		running := i.State == ec2type.InstanceStateNameRunning
+		if !running && !aws.ToBool(input.IncludeAllInstances) {
+			continue
+		}
+		status := ec2type.InstanceStatus{
+			InstanceId:     aws.String(i.ID),
+			InstanceState:  &ec2type.InstanceState{Name: i.State},
+			InstanceStatus: &ec2type.InstanceStatusSummary{Status: ec2type.SummaryStatusNotApplicable},
+			SystemStatus:   &ec2type.InstanceStatusSummary{Status: ec2type.SummaryStatusNotApplicable},
+		}
+		if running {
+			status.InstanceStatus.Status = i.InstanceStatus
+			status.SystemStatus.Status = i.SystemStatus
+		}
+		out.InstanceStatuses = append(out.InstanceStatuses, status)
+	}
+	return out, nil
+}
+
+func (e *EC2) DescribeInstances(ctx context.Context, input *ec2.DescribeInstancesInput, opts ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call("DescribeInstances", input); err != nil {
+		return nil, err
+	}
+	instances, err := e.sortedInstances(input.InstanceIds)
+	if err != nil {
+		return nil, err
+	}
+	reservation := ec2type.Reservation{Instances: make([]ec2type.Instance, 0)}
+	for _, i := range instances {
+		tags := toTags(i.Tags)
+		ok, err := matchFilters(input.Filters, map[string]string{
+			"instance-id":         i.ID,
+			"instance-state-name": string(i.State),
+			"private-ip-address":  i.PrivateIP,
+			"subnet-id":           i.SubnetID,
+			"vpc-id":              i.VpcID,
+		}, tags)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		instance := ec2type.Instance{
+			InstanceId:      aws.String(i.ID),
+			State:           &ec2type.InstanceState{Name: i.State},
+			Tags:            tags,
+			SourceDestCheck: aws.Bool(i.SourceDestCheck),
+		}
+		if i.PrivateIP != "" {
+			instance.PrivateIpAddress = aws.String(i.PrivateIP)
+		}
+		if i.SubnetID != "" {
+			instance.SubnetId = aws.String(i.SubnetID)
+		}
+		if i.VpcID != "" {
+			instance.VpcId = aws.String(i.VpcID)
+		}
+		reservation.Instances = append(reservation.Instances, instance)
+	}
+	out := &ec2.DescribeInstancesOutput{Reservations: make([]ec2type.Reservation, 0)}
+	if len(reservation.Instances) > 0 {
+		out.Reservations = append(out.Reservations, reservation)
+	}
+	return out, nil
+}
@@ -0,0 +1,218 @@
+package ec2sim
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2type "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func getSim() *EC2 {
+	e := New()
+	e.AddRouteTable("rtb-1", "vpc-1", "10.0.0.0/16", map[string]string{"Name": "private"})
+	e.AddInstance(Instance{ID: "i-1", PrivateIP: "10.0.0.1", VpcID: "vpc-1", Tags: map[string]string{"role": "nat"}})
+	e.AddInstance(Instance{ID: "i-2", PrivateIP: "10.0.0.2", VpcID: "vpc-1", Tags: map[string]string{"role": "nat"}})
+	return e
+}
+
+func TestCreateRoute(t *testing.T) {
+	e := getSim()
+	ctx := context.Background()
+	_, err := e.CreateRoute(ctx, &ec2.CreateRouteInput{
+		RouteTableId:         aws.String("rtb-1"),
+		DestinationCidrBlock: aws.String("0.0.0.0/0"),
+		InstanceId:           aws.String("i-1"),
+	})
+	assert.Nil(t, err)
+	route, ok := e.Route("rtb-1", "0.0.0.0/0")
+	if assert.True(t, ok) {
+		assert.Equal(t, *route.InstanceId, "i-1")
+		assert.Equal(t, *route.NetworkInterfaceId, "eni-1")
+		assert.Equal(t, route.State, ec2type.RouteStateActive)
+	}
+	_, err = e.CreateRoute(ctx, &ec2.CreateRouteInput{
+		RouteTableId:         aws.String("rtb-1"),
+		DestinationCidrBlock: aws.String("0.0.0.0/0"),
+		InstanceId:           aws.String("i-2"),
+	})
+	assert.Equal(t, ErrorCode(err), "RouteAlreadyExists")
+	assert.Equal(t, e.RouteTarget("rtb-1", "0.0.0.0/0"), "i-1")
+	assert.Equal(t, len(e.CallsTo("CreateRoute")), 2)
+}
+
+func TestCreateRouteErrors(t *testing.T) {
+	e := getSim()
+	e.AddNetworkInterface(NetworkInterface{ID: "eni-1b", InstanceID: "i-1", DeviceIndex: 1})
+	ctx := context.Background()
+	_, err := e.CreateRoute(ctx, &ec2.CreateRouteInput{RouteTableId: aws.String("rtb-2"), DestinationCidrBlock: aws.String("0.0.0.0/0"), InstanceId: aws.String("i-2")})
+	assert.Equal(t, ErrorCode(err), "InvalidRouteTableID.NotFound")
+	_, err = e.CreateRoute(ctx, &ec2.CreateRouteInput{RouteTableId: aws.String("rtb-1"), DestinationCidrBlock: aws.String("0.0.0.0/0"), InstanceId: aws.String("i-3")})
+	assert.Equal(t, ErrorCode(err), "InvalidInstanceID.NotFound")
+	_, err = e.CreateRoute(ctx, &ec2.CreateRouteInput{RouteTableId: aws.String("rtb-1"), DestinationCidrBlock: aws.String("0.0.0.0/0"), InstanceId: aws.String("i-1")})
+	assert.Equal(t, ErrorCode(err), "InvalidInstanceID")
+	_, err = e.CreateRoute(ctx, &ec2.CreateRouteInput{RouteTableId: aws.String("rtb-1"), DestinationCidrBlock: aws.String("0.0.0.0/0"), NetworkInterfaceId: aws.String("eni-1b")})
+	assert.Nil(t, err)
+	assert.Equal(t, e.RouteTarget("rtb-1", "0.0.0.0/0"), "i-1")
+}
+
+func TestDryRun(t *testing.T) {
+	e := getSim()
+	assert.Nil(t, e.AddRoute("rtb-1", "0.0.0.0/0", "i-1"))
+	ctx := context.Background()
+	_, err := e.ReplaceRoute(ctx, &ec2.ReplaceRouteInput{RouteTableId: aws.String("rtb-1"), DestinationCidrBlock: aws.String("0.0.0.0/0"), NetworkInterfaceId: aws.String("eni-2"), DryRun: aws.Bool(true)})
+	assert.Equal(t, ErrorCode(err), "DryRunOperation")
+	_, err = e.DeleteRoute(ctx, &ec2.DeleteRouteInput{RouteTableId: aws.String("rtb-1"), DestinationCidrBlock: aws.String("0.0.0.0/0"), DryRun: aws.Bool(true)})
+	assert.Equal(t, ErrorCode(err), "DryRunOperation")
+	_, err = e.CreateRoute(ctx, &ec2.CreateRouteInput{RouteTableId: aws.String("rtb-1"), DestinationCidrBlock: aws.String("10.1.0.0/16"), InstanceId: aws.String("i-2"), DryRun: aws.Bool(true)})
+	assert.Equal(t, ErrorCode(err), "DryRunOperation")
+	// Still checks the request
+	_, err = e.DeleteRoute(ctx, &ec2.DeleteRouteInput{RouteTableId: aws.String("rtb-1"), DestinationCidrBlock: aws.String("10.1.0.0/16"), DryRun: aws.Bool(true)})
+	assert.Equal(t, ErrorCode(err), "InvalidRoute.NotFound")
+
+	assert.Equal(t, e.RouteTarget("rtb-1", "0.0.0.0/0"), "i-1")
+	_, ok := e.Route("rtb-1", "10.1.0.0/16")
+	assert.False(t, ok)
+}
+
+func TestReplaceAndDeleteRoute(t *testing.T) {
+	e := getSim()
+	assert.Nil(t, e.AddRoute("rtb-1", "0.0.0.0/0", "i-1"))
+	ctx := context.Background()
+	_, err := e.ReplaceRoute(ctx, &ec2.ReplaceRouteInput{RouteTableId: aws.String("rtb-1"), DestinationCidrBlock: aws.String("0.0.0.0/0"), NetworkInterfaceId: aws.String("eni-2")})
+	assert.Nil(t, err)
+	assert.Equal(t, e.RouteTarget("rtb-1", "0.0.0.0/0"), "i-2")
+	_, err = e.ReplaceRoute(ctx, &ec2.ReplaceRouteInput{RouteTableId: aws.String("rtb-1"), DestinationCidrBlock: aws.String("10.1.0.0/16"), NetworkInterfaceId: aws.String("eni-2")})
+	assert.Equal(t, ErrorCode(err), "InvalidParameterValue")
+	_, err = e.DeleteRoute(ctx, &ec2.DeleteRouteInput{RouteTableId: aws.String("rtb-1"), DestinationCidrBlock: aws.String("0.0.0.0/0")})
+	assert.Nil(t, err)
+	assert.Equal(t, e.RouteTarget("rtb-1", "0.0.0.0/0"), "")
+	_, err = e.DeleteRoute(ctx, &ec2.DeleteRouteInput{RouteTableId: aws.String("rtb-1"), DestinationCidrBlock: aws.String("0.0.0.0/0")})
+	assert.Equal(t, ErrorCode(err), "InvalidRoute.NotFound")
+}
+
+func TestInstanceStateBlackholesRoutes(t *testing.T) {
+	e := getSim()
+	assert.Nil(t, e.AddRoute("rtb-1", "0.0.0.0/0", "i-1"))
+	e.SetInstanceState("i-1", ec2type.InstanceStateNameStopped)
+	route, _ := e.Route("rtb-1", "0.0.0.0/0")
+	assert.Equal(t, route.State, ec2type.RouteStateBlackhole)
+	e.SetInstanceState("i-1", ec2type.InstanceStateNameRunning)
+	route, _ = e.Route("rtb-1", "0.0.0.0/0")
+	assert.Equal(t, route.State, ec2type.RouteStateActive)
+	e.SetInstanceState("i-1", ec2type.InstanceStateNameTerminated)
+	route, _ = e.Route("rtb-1", "0.0.0.0/0")
+	assert.Equal(t, route.State, ec2type.RouteStateBlackhole)
+
+	out, err := e.DescribeNetworkInterfaces(context.Background(), &ec2.DescribeNetworkInterfacesInput{
+		Filters: []ec2type.Filter{{Name: aws.String("attachment.instance-id"), Values: []string{"i-1"}}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(out.NetworkInterfaces), 0)
+}
+
+func TestDescribeRouteTablesReturnsCopies(t *testing.T) {
+	e := getSim()
+	ctx := context.Background()
+	out, err := e.DescribeRouteTables(ctx, &ec2.DescribeRouteTablesInput{})
+	assert.Nil(t, err)
+	if assert.Equal(t, len(out.RouteTables), 1) {
+		assert.Equal(t, len(out.RouteTables[0].Routes), 1)
+		assert.Nil(t, e.AddRoute("rtb-1", "0.0.0.0/0", "i-1"))
+		assert.Equal(t, len(out.RouteTables[0].Routes), 1)
+	}
+	out, err = e.DescribeRouteTables(ctx, &ec2.DescribeRouteTablesInput{
+		Filters: []ec2type.Filter{{Name: aws.String("tag:Name"), Values: []string{"public"}}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(out.RouteTables), 0)
+	_, err = e.DescribeRouteTables(ctx, &ec2.DescribeRouteTablesInput{
+		Filters: []ec2type.Filter{{Name: aws.String("association.main"), Values: []string{"true"}}},
+	})
+	assert.Equal(t, ErrorCode(err), "InvalidParameterValue")
+}
+
+func TestDescribeNetworkInterfaces(t *testing.T) {
+	e := getSim()
+	e.AddNetworkInterface(NetworkInterface{ID: "eni-1b", InstanceID: "i-1", DeviceIndex: 1, SourceDestCheck: true})
+	e.AddNetworkInterface(NetworkInterface{ID: "eni-spare", SourceDestCheck: true})
+	out, err := e.DescribeNetworkInterfaces(context.Background(), &ec2.DescribeNetworkInterfacesInput{
+		Filters: []ec2type.Filter{
+			{Name: aws.String("attachment.instance-id"), Values: []string{"i-1"}},
+			{Name: aws.String("attachment.device-index"), Values: []string{"1"}},
+		},
+	})
+	assert.Nil(t, err)
+	if assert.Equal(t, len(out.NetworkInterfaces), 1) {
+		assert.Equal(t, *out.NetworkInterfaces[0].NetworkInterfaceId, "eni-1b")
+		assert.Equal(t, *out.NetworkInterfaces[0].SourceDestCheck, true)
+	}
+	out, err = e.DescribeNetworkInterfaces(context.Background(), &ec2.DescribeNetworkInterfacesInput{NetworkInterfaceIds: []string{"eni-2", "eni-spare"}})
+	assert.Nil(t, err)
+	if assert.Equal(t, len(out.NetworkInterfaces), 2) {
+		assert.Equal(t, *out.NetworkInterfaces[0].PrivateIpAddress, "10.0.0.2")
+		assert.Nil(t, out.NetworkInterfaces[1].Attachment)
+	}
+}
+
+func TestDescribeInstanceStatus(t *testing.T) {
+	e := getSim()
+	e.SetInstanceStatus("i-1", ec2type.SummaryStatusImpaired, ec2type.SummaryStatusOk)
+	e.SetInstanceState("i-2", ec2type.InstanceStateNameStopped)
+	out, err := e.DescribeInstanceStatus(context.Background(), &ec2.DescribeInstanceStatusInput{InstanceIds: []string{"i-1", "i-2"}})
+	assert.Nil(t, err)
+	if assert.Equal(t, len(out.InstanceStatuses), 1) {
+		assert.Equal(t, out.InstanceStatuses[0].InstanceStatus.Status, ec2type.SummaryStatusImpaired)
+	}
+	out, err = e.DescribeInstanceStatus(context.Background(), &ec2.DescribeInstanceStatusInput{IncludeAllInstances: aws.Bool(true)})
+	assert.Nil(t, err)
+	assert.Equal(t, len(out.InstanceStatuses), 2)
+	_, err = e.DescribeInstanceStatus(context.Background(), &ec2.DescribeInstanceStatusInput{InstanceIds: []string{"i-3"}})
+	assert.Equal(t, ErrorCode(err), "InvalidInstanceID.NotFound")
+}
+
+func TestDescribeInstances(t *testing.T) {
+	e := getSim()
+	e.SetInstanceState("i-2", ec2type.InstanceStateNameStopped)
+	out, err := e.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{
+		Filters: []ec2type.Filter{
+			{Name: aws.String("tag:role"), Values: []string{"nat"}},
+			{Name: aws.String("instance-state-name"), Values: []string{"running"}},
+		},
+	})
+	assert.Nil(t, err)
+	if assert.Equal(t, len(out.Reservations), 1) && assert.Equal(t, len(out.Reservations[0].Instances), 1) {
+		assert.Equal(t, *out.Reservations[0].Instances[0].PrivateIpAddress, "10.0.0.1")
+	}
+}
+
+func TestDescribeInstanceAttribute(t *testing.T) {
+	e := getSim()
+	out, err := e.DescribeInstanceAttribute(context.Background(), &ec2.DescribeInstanceAttributeInput{
+		InstanceId: aws.String("i-1"),
+		Attribute:  ec2type.InstanceAttributeNameSourceDestCheck,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, *out.SourceDestCheck.Value, false)
+}
+
+func TestThrottleAndFailNext(t *testing.T) {
+	e := getSim()
+	ctx := context.Background()
+	e.Throttle("DescribeRouteTables", 2)
+	e.FailNext("DescribeInstances", errors.New("AWS blew up"))
+	for i := 0; i < 2; i++ {
+		_, err := e.DescribeRouteTables(ctx, &ec2.DescribeRouteTablesInput{})
+		assert.Equal(t, ErrorCode(err), "RequestLimitExceeded")
+	}
+	_, err := e.DescribeRouteTables(ctx, &ec2.DescribeRouteTablesInput{})
+	assert.Nil(t, err)
+	_, err = e.DescribeInstances(ctx, &ec2.DescribeInstancesInput{})
+	assert.Equal(t, err.Error(), "AWS blew up")
+	assert.Equal(t, len(e.Calls()), 4)
+	e.ResetCalls()
+	assert.Equal(t, len(e.Calls()), 0)
+}
@@ -0,0 +1,412 @@
+package gossip
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+
+	"github.com/justenwalker/awsnycast/clock"
+	"github.com/justenwalker/awsnycast/logging"
+)
+
+var log = logging.For("gossip")
+
+const maxMessageSize = 65507
+
+// Config for the gossip layer between AWSnycast instances, under the top level 'gossip' key.
+type Config struct {
+	Bind      string            `yaml:"bind"`
+	Seeds     []string          `yaml:"seeds"`
+	SeedTag   map[string]string `yaml:"seed_tag"`
+	Interval  float64           `yaml:"interval"`
+	DeadAfter float64           `yaml:"dead_after"`
+	Secret    string            `yaml:"secret"`
+}
+
+func (c *Config) Validate() error {
+	var result *multierror.Error
+	if c.Bind == "" {
+		c.Bind = "0.0.0.0:7946"
+	}
+	if host, _, err := net.SplitHostPort(c.Bind); err != nil {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("Could not parse gossip bind address '%s': %s", c.Bind, err.Error())))
+	} else if c.Secret == "" && !isLoopback(host) {
+		// Anyone who can reach the port could otherwise make us take routes over
+		result = multierror.Append(result, errors.New(fmt.Sprintf("gossip needs a secret to bind to '%s', which is not a loopback address", c.Bind)))
+	}
+	if c.Interval == 0 {
+		c.Interval = 1
+	}
+	if c.DeadAfter == 0 {
+		c.DeadAfter = c.Interval * 5
+	}
+	if c.DeadAfter <= c.Interval {
+		result = multierror.Append(result, errors.New("gossip dead_after must be longer than interval"))
+	}
+	if c.SeedTag != nil {
+		if c.SeedTag["key"] == "" || c.SeedTag["value"] == "" {
+			result = multierror.Append(result, errors.New("gossip seed_tag needs a key and a value"))
+		}
+	}
+	if len(c.Seeds) == 0 && c.SeedTag == nil {
+		result = multierror.Append(result, errors.New("gossip needs either seeds or a seed_tag to find other instances"))
+	}
+	return result.ErrorOrNil()
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Port returns the port we listen on, which other instances found by seed_tag are assumed to share.
+func (c Config) Port() string {
+	_, port, _ := net.SplitHostPort(c.Bind)
+	return port
+}
+
+// State is what each instance shares about itself.
+type State struct {
+	Instance     string          `json:"instance"`
+	Healthchecks map[string]bool `json:"healthchecks"`
+	Routes       map[string]bool `json:"routes"` // cidr -> healthy, for each route we would advertise as ourself
+	Owned        []string        `json:"owned"`  // "rtb-id cidr" for each route currently pointing at us
+}
+
+// Member is another AWSnycast instance we have heard from.
+type Member struct {
+	Addr     string
+	State    State
+	LastSeen time.Time
+	Alive    bool
+}
+
+// Sent is when the message was sent, in nanoseconds, and goes up with every message an
+// instance sends. As it is signed along with the rest of the message, it stops old messages
+// being replayed.
+type message struct {
+	State   State    `json:"state"`
+	Members []string `json:"members"`
+	Leave   bool     `json:"leave,omitempty"`
+	Sent    int64    `json:"sent"`
+}
+
+type envelope struct {
+	Payload json.RawMessage `json:"payload"`
+	MAC     []byte          `json:"mac,omitempty"`
+}
+
+// Node is our membership of the gossip cluster. Every interval it sends our State, plus
+// the addresses of every live member it knows about, to every address it knows about.
+// Members we stop hearing from for dead_after are marked as not alive.
+type Node struct {
+	config    Config
+	name      string
+	stateFunc func() State
+	clock     clock.Clock
+	conn      *net.UDPConn
+	lock      sync.Mutex
+	members   map[string]*Member
+	seeds     map[string]bool
+	self      map[string]bool
+	lastSent  int64
+	sent      map[string]int64 // instance -> Sent of the latest message we accepted from it
+	changes   chan bool
+	quitChan  chan bool
+	wg        sync.WaitGroup
+}
+
+// New starts listening, but doesn't send anything until Start is called. stateFunc is
+// called to get our current state each time we gossip.
+func New(config Config, name string, stateFunc func() State, clk clock.Clock) (*Node, error) {
+	addr, err := net.ResolveUDPAddr("udp", config.Bind)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		config:    config,
+		name:      name,
+		stateFunc: stateFunc,
+		clock:     clk,
+		conn:      conn,
+		members:   make(map[string]*Member),
+		seeds:     make(map[string]bool),
+		self:      make(map[string]bool),
+		sent:      make(map[string]int64),
+		changes:   make(chan bool, 1),
+		quitChan:  make(chan bool),
+	}
+	n.AddSeeds(config.Seeds)
+	return n, nil
+}
+
+// Addr is the address we are listening on.
+func (n *Node) Addr() string {
+	return n.conn.LocalAddr().String()
+}
+
+// AddSeeds adds more addresses to gossip with, e.g. when instances are discovered by tag.
+func (n *Node) AddSeeds(seeds []string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, s := range seeds {
+		n.seeds[s] = true
+	}
+}
+
+// Changes fires when another instance changes the health of its routes, leaves or dies.
+func (n *Node) Changes() <-chan bool {
+	return n.changes
+}
+
+// Members returns a copy of every member we have heard from.
+func (n *Node) Members() []Member {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	members := make([]Member, 0, len(n.members))
+	for _, m := range n.members {
+		members = append(members, *m)
+	}
+	return members
+}
+
+// PeerRouteHealthy returns whether the instance says it is healthy for a cidr, and whether
+// we know anything at all. An instance which has left or died is known to be unhealthy.
+// If we have heard from the instance at more than one address, the latest message counts.
+func (n *Node) PeerRouteHealthy(instance string, cidr string) (bool, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var latest *Member
+	for _, m := range n.members {
+		if m.State.Instance == instance && (latest == nil || m.LastSeen.After(latest.LastSeen)) {
+			latest = m
+		}
+	}
+	if latest == nil {
+		return false, false
+	}
+	if !latest.Alive {
+		return false, true
+	}
+	healthy, ok := latest.State.Routes[cidr]
+	return healthy, ok
+}
+
+func (n *Node) Start() {
+	n.wg.Add(2)
+	go n.receiveLoop()
+	go func() {
+		defer n.wg.Done()
+		ticker := n.clock.NewTicker(time.Duration(n.config.Interval * float64(time.Second)))
+		defer ticker.Stop()
+		n.broadcast(false)
+		for {
+			select {
+			case <-n.quitChan:
+				return
+			case <-ticker.Chan():
+				n.reap()
+				n.broadcast(false)
+			}
+		}
+	}()
+}
+
+// Stop tells everyone we are leaving, so they can take over our routes straight away.
+func (n *Node) Stop() {
+	close(n.quitChan)
+	n.broadcast(true)
+	n.conn.Close()
+	n.wg.Wait()
+}
+
+func (n *Node) notify() {
+	select {
+	case n.changes <- true:
+	default:
+	}
+}
+
+func (n *Node) broadcast(leave bool) {
+	msg := message{Leave: leave}
+	if n.stateFunc != nil {
+		msg.State = n.stateFunc()
+	}
+	msg.State.Instance = n.name
+	n.lock.Lock()
+	msg.Sent = n.clock.Now().UnixNano()
+	if msg.Sent <= n.lastSent {
+		msg.Sent = n.lastSent + 1
+	}
+	n.lastSent = msg.Sent
+	targets := make(map[string]bool)
+	for addr := range n.seeds {
+		targets[addr] = true
+	}
+	for addr, m := range n.members {
+		targets[addr] = true
+		if m.Alive {
+			msg.Members = append(msg.Members, addr)
+		}
+	}
+	for addr := range n.self {
+		delete(targets, addr)
+	}
+	n.lock.Unlock()
+	data, err := n.encode(msg)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err.Error()}).Error("Could not encode gossip message")
+		return
+	}
+	for addr := range targets {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			log.WithFields(logrus.Fields{"addr": addr, "err": err.Error()}).Debug("Could not resolve gossip peer")
+			continue
+		}
+		if _, err := n.conn.WriteToUDP(data, udpAddr); err != nil {
+			log.WithFields(logrus.Fields{"addr": addr, "err": err.Error()}).Debug("Could not send gossip")
+		}
+	}
+}
+
+func (n *Node) receiveLoop() {
+	defer n.wg.Done()
+	buf := make([]byte, maxMessageSize)
+	for {
+		size, from, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-n.quitChan:
+				return
+			default:
+			}
+			log.WithFields(logrus.Fields{"err": err.Error()}).Debug("Error reading gossip")
+			continue
+		}
+		msg, err := n.decode(buf[:size])
+		if err != nil {
+			log.WithFields(logrus.Fields{"from": from.String(), "err": err.Error()}).Warn("Ignoring bad gossip message")
+			continue
+		}
+		n.receive(from.String(), msg)
+	}
+}
+
+func (n *Node) receive(from string, msg message) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if msg.State.Instance == n.name {
+		n.self[from] = true // We're in our own seed list
+		return
+	}
+	contextLogger := log.WithFields(logrus.Fields{
+		"peer":          from,
+		"peer_instance": msg.State.Instance,
+	})
+	now := n.clock.Now()
+	window := time.Duration(n.config.DeadAfter * float64(time.Second))
+	sent := time.Unix(0, msg.Sent)
+	if sent.Before(now.Add(-window)) || sent.After(now.Add(window)) {
+		contextLogger.WithFields(logrus.Fields{"sent": sent}).Warn("Ignoring stale gossip message")
+		return
+	}
+	if msg.Sent <= n.sent[msg.State.Instance] {
+		// Also happens when we are in the peer's seeds at more than one address
+		contextLogger.WithFields(logrus.Fields{"sent": sent}).Debug("Ignoring duplicate gossip message")
+		return
+	}
+	n.sent[msg.State.Instance] = msg.Sent
+	m, ok := n.members[from]
+	if !ok {
+		m = &Member{Addr: from}
+		n.members[from] = m
+		contextLogger.Info("New gossip member")
+	}
+	changed := !reflect.DeepEqual(m.State.Routes, msg.State.Routes)
+	if msg.Leave {
+		if m.Alive {
+			contextLogger.Info("Gossip member is leaving")
+		}
+		changed = true
+		m.Alive = false
+		m.LastSeen = now
+	} else {
+		if ok && !m.Alive {
+			contextLogger.Info("Gossip member is alive again")
+			changed = true
+		}
+		m.Alive = true
+		m.LastSeen = now
+	}
+	m.State = msg.State
+	for _, addr := range msg.Members {
+		if _, known := n.members[addr]; !known && !n.self[addr] {
+			n.seeds[addr] = true
+		}
+	}
+	if changed {
+		contextLogger.WithFields(logrus.Fields{"routes": msg.State.Routes}).Debug("Gossip member state changed")
+		n.notify()
+	}
+}
+
+func (n *Node) reap() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	deadAfter := time.Duration(n.config.DeadAfter * float64(time.Second))
+	for addr, m := range n.members {
+		if m.Alive && n.clock.Now().Sub(m.LastSeen) > deadAfter {
+			log.WithFields(logrus.Fields{"peer": addr, "peer_instance": m.State.Instance}).Warn("Gossip member is dead")
+			m.Alive = false
+			n.notify()
+		}
+	}
+}
+
+func (n *Node) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, []byte(n.config.Secret))
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+func (n *Node) encode(msg message) ([]byte, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	env := envelope{Payload: payload}
+	if n.config.Secret != "" {
+		env.MAC = n.mac(payload)
+	}
+	return json.Marshal(env)
+}
+
+func (n *Node) decode(data []byte) (message, error) {
+	var env envelope
+	var msg message
+	if err := json.Unmarshal(data, &env); err != nil {
+		return msg, err
+	}
+	if n.config.Secret != "" && !hmac.Equal(env.MAC, n.mac(env.Payload)) {
+		return msg, errors.New("message is not signed with our secret")
+	}
+	err := json.Unmarshal(env.Payload, &msg)
+	return msg, err
+}
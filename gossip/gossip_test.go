@@ -0,0 +1,254 @@
+package gossip
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/justenwalker/awsnycast/clock"
+	"github.com/justenwalker/awsnycast/testhelpers"
+)
+
+type fakeState struct {
+	sync.Mutex
+	healthy bool
+}
+
+func (s *fakeState) set(healthy bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.healthy = healthy
+}
+
+func (s *fakeState) get() State {
+	s.Lock()
+	defer s.Unlock()
+	return State{Routes: map[string]bool{"192.168.1.1/32": s.healthy}}
+}
+
+func getNode(t *testing.T, name string, secret string, seeds ...string) (*Node, *fakeState) {
+	state := &fakeState{healthy: true}
+	c := Config{
+		Bind:      "127.0.0.1:0",
+		Seeds:     seeds,
+		Interval:  0.01,
+		DeadAfter: 0.1,
+		Secret:    secret,
+	}
+	n, err := New(c, name, state.get, clock.Real)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, state
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if f() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func TestConfigValidateDefaults(t *testing.T) {
+	c := Config{Seeds: []string{"10.0.0.1:7946"}, Secret: "sekrit"}
+	assert.Nil(t, c.Validate())
+	assert.Equal(t, c.Bind, "0.0.0.0:7946")
+	assert.Equal(t, c.Port(), "7946")
+	assert.Equal(t, c.Interval, float64(1))
+	assert.Equal(t, c.DeadAfter, float64(5))
+}
+
+func TestConfigValidateNoSecret(t *testing.T) {
+	c := Config{Seeds: []string{"10.0.0.1:7946"}}
+	testhelpers.CheckOneMultiError(t, c.Validate(), "gossip needs a secret to bind to '0.0.0.0:7946', which is not a loopback address")
+	c = Config{Bind: "127.0.0.1:7946", Seeds: []string{"127.0.0.2:7946"}}
+	assert.Nil(t, c.Validate())
+}
+
+func TestPeerRouteHealthyLatest(t *testing.T) {
+	now := time.Now()
+	n := &Node{members: map[string]*Member{
+		"10.0.0.1:7946": {State: State{Instance: "i-b", Routes: map[string]bool{"192.168.1.1/32": true}}, LastSeen: now.Add(-time.Minute), Alive: true},
+		"10.0.1.1:7946": {State: State{Instance: "i-b", Routes: map[string]bool{"192.168.1.1/32": false}}, LastSeen: now, Alive: true},
+		"10.0.2.1:7946": {State: State{Instance: "i-b"}, LastSeen: now.Add(-time.Hour), Alive: false},
+	}}
+	for i := 0; i < 10; i++ {
+		healthy, known := n.PeerRouteHealthy("i-b", "192.168.1.1/32")
+		assert.Equal(t, known, true)
+		assert.Equal(t, healthy, false)
+	}
+	n.members["10.0.0.1:7946"].LastSeen = now.Add(time.Second)
+	healthy, _ := n.PeerRouteHealthy("i-b", "192.168.1.1/32")
+	assert.Equal(t, healthy, true)
+}
+
+func TestConfigValidateNoSeeds(t *testing.T) {
+	c := Config{Secret: "sekrit"}
+	testhelpers.CheckOneMultiError(t, c.Validate(), "gossip needs either seeds or a seed_tag to find other instances")
+}
+
+func TestConfigValidateBadSeedTag(t *testing.T) {
+	c := Config{SeedTag: map[string]string{"key": "cluster"}, Secret: "sekrit"}
+	testhelpers.CheckOneMultiError(t, c.Validate(), "gossip seed_tag needs a key and a value")
+}
+
+func TestConfigValidateDeadAfter(t *testing.T) {
+	c := Config{Seeds: []string{"10.0.0.1:7946"}, Interval: 2, DeadAfter: 1, Secret: "sekrit"}
+	testhelpers.CheckOneMultiError(t, c.Validate(), "gossip dead_after must be longer than interval")
+}
+
+func TestGossipCluster(t *testing.T) {
+	a, _ := getNode(t, "i-a", "")
+	b, bState := getNode(t, "i-b", "", a.Addr())
+	c, _ := getNode(t, "i-c", "", a.Addr(), b.Addr())
+	a.AddSeeds([]string{a.Addr()}) // Our own address in the seeds is ignored
+	for _, n := range []*Node{a, b, c} {
+		n.Start()
+	}
+	defer a.Stop()
+	defer c.Stop()
+
+	// a only learns of c via b's member list or c contacting it
+	waitFor(t, "membership", func() bool {
+		return len(a.Members()) == 2 && len(b.Members()) == 2 && len(c.Members()) == 2
+	})
+	healthy, known := c.PeerRouteHealthy("i-b", "192.168.1.1/32")
+	assert.Equal(t, known, true)
+	assert.Equal(t, healthy, true)
+	_, known = c.PeerRouteHealthy("i-b", "10.0.0.0/8")
+	assert.Equal(t, known, false)
+	_, known = c.PeerRouteHealthy("i-other", "192.168.1.1/32")
+	assert.Equal(t, known, false)
+
+	// Unhealthy route is seen by the others
+	bState.set(false)
+	<-a.Changes()
+	waitFor(t, "unhealthy state", func() bool {
+		healthy, known := a.PeerRouteHealthy("i-b", "192.168.1.1/32")
+		return known && !healthy
+	})
+
+	// Leaving is seen straight away
+	b.Stop()
+	waitFor(t, "leave", func() bool {
+		for _, m := range c.Members() {
+			if m.State.Instance == "i-b" {
+				return !m.Alive
+			}
+		}
+		return false
+	})
+	healthy, known = c.PeerRouteHealthy("i-b", "192.168.1.1/32")
+	assert.Equal(t, known, true)
+	assert.Equal(t, healthy, false)
+}
+
+func TestGossipMemberDies(t *testing.T) {
+	a, _ := getNode(t, "i-a", "")
+	b, _ := getNode(t, "i-b", "", a.Addr())
+	a.Start()
+	b.Start()
+	defer a.Stop()
+	waitFor(t, "membership", func() bool {
+		healthy, _ := a.PeerRouteHealthy("i-b", "192.168.1.1/32")
+		return healthy
+	})
+	// Stop b without it telling anyone it is leaving
+	close(b.quitChan)
+	b.conn.Close()
+	b.wg.Wait()
+	waitFor(t, "dead member", func() bool {
+		healthy, known := a.PeerRouteHealthy("i-b", "192.168.1.1/32")
+		return known && !healthy
+	})
+}
+
+func TestGossipSecret(t *testing.T) {
+	a, _ := getNode(t, "i-a", "sekrit")
+	b, _ := getNode(t, "i-b", "sekrit", a.Addr())
+	c, _ := getNode(t, "i-c", "wrong", a.Addr())
+	for _, n := range []*Node{a, b, c} {
+		n.Start()
+		defer n.Stop()
+	}
+	waitFor(t, "membership", func() bool {
+		return len(a.Members()) == 1 && len(b.Members()) == 1
+	})
+	time.Sleep(50 * time.Millisecond)
+	_, known := a.PeerRouteHealthy("i-c", "192.168.1.1/32")
+	assert.Equal(t, known, false)
+	assert.Equal(t, len(c.Members()), 0)
+}
+
+func getFakeNode(t *testing.T, name string, c *clock.Fake) *Node {
+	n, err := New(Config{Bind: "127.0.0.1:0", Interval: 1, DeadAfter: 5}, name, nil, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestGossipReplay(t *testing.T) {
+	c := clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+	a := getFakeNode(t, "i-a", c)
+	defer a.conn.Close()
+	b := getFakeNode(t, "i-b", c)
+	defer b.conn.Close()
+
+	b.broadcast(false)
+	healthyMsg := message{State: State{Instance: "i-b", Routes: map[string]bool{"192.168.1.1/32": true}}, Sent: b.lastSent}
+	a.receive("10.0.0.2:7946", healthyMsg)
+	healthy, _ := a.PeerRouteHealthy("i-b", "192.168.1.1/32")
+	assert.Equal(t, healthy, true)
+
+	// Sent goes up even if the clock doesn't move
+	b.broadcast(false)
+	assert.Equal(t, b.lastSent, healthyMsg.Sent+1)
+	a.receive("10.0.0.2:7946", message{State: State{Instance: "i-b", Routes: map[string]bool{"192.168.1.1/32": false}}, Sent: b.lastSent})
+	healthy, _ = a.PeerRouteHealthy("i-b", "192.168.1.1/32")
+	assert.Equal(t, healthy, false)
+
+	// Replaying the older message, even from another address, changes nothing
+	a.receive("10.0.0.2:7946", healthyMsg)
+	a.receive("10.0.0.3:7946", healthyMsg)
+	healthy, _ = a.PeerRouteHealthy("i-b", "192.168.1.1/32")
+	assert.Equal(t, healthy, false)
+	assert.Equal(t, len(a.Members()), 1)
+}
+
+func TestGossipStale(t *testing.T) {
+	c := clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+	a := getFakeNode(t, "i-a", c)
+	defer a.conn.Close()
+	msg := message{State: State{Instance: "i-b", Routes: map[string]bool{"192.168.1.1/32": true}}, Sent: c.Now().UnixNano()}
+	c.Advance(6 * time.Second)
+	a.receive("10.0.0.2:7946", msg)
+	_, known := a.PeerRouteHealthy("i-b", "192.168.1.1/32")
+	assert.Equal(t, known, false)
+	msg.Sent = c.Now().Add(6 * time.Second).UnixNano()
+	a.receive("10.0.0.2:7946", msg)
+	_, known = a.PeerRouteHealthy("i-b", "192.168.1.1/32")
+	assert.Equal(t, known, false)
+}
+
+func TestGossipReapUsesClock(t *testing.T) {
+	c := clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+	a := getFakeNode(t, "i-a", c)
+	defer a.conn.Close()
+	a.receive("10.0.0.2:7946", message{State: State{Instance: "i-b", Routes: map[string]bool{"192.168.1.1/32": true}}, Sent: c.Now().UnixNano()})
+	c.Advance(5 * time.Second)
+	a.reap()
+	healthy, _ := a.PeerRouteHealthy("i-b", "192.168.1.1/32")
+	assert.Equal(t, healthy, true)
+	c.Advance(time.Second)
+	a.reap()
+	healthy, known := a.PeerRouteHealthy("i-b", "192.168.1.1/32")
+	assert.Equal(t, known, true)
+	assert.Equal(t, healthy, false)
+}
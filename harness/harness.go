@@ -0,0 +1,241 @@
+// Package harness runs several daemons in one process against a shared EC2 simulator,
+// with a fake clock, to play out failovers between them without AWS.
+//
+// Each daemon gets a local TCP "service" to healthcheck, which the test can take down
+// and bring back. The service's port is given to the daemon's config as the
+// service_port tag, so a healthcheck for it looks like:
+//
+//	healthchecks:
+//	    service:
+//	        type: tcp
+//	        destination: 127.0.0.1
+//	        config:
+//	            port: '{{ index .Tags "service_port" }}'
+package harness
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/justenwalker/awsnycast/aws"
+	"github.com/justenwalker/awsnycast/clock"
+	"github.com/justenwalker/awsnycast/daemon"
+	"github.com/justenwalker/awsnycast/ec2sim"
+	"github.com/justenwalker/awsnycast/instancemetadata"
+)
+
+const (
+	Region = "us-east-1"
+	VPC    = "vpc-harness"
+	// Settled is how long nothing has to happen for before the daemons are taken to be
+	// waiting on the clock.
+	Settled = 20 * time.Millisecond
+)
+
+type Harness struct {
+	EC2     *ec2sim.EC2
+	Clock   *clock.Fake
+	t       testing.TB
+	dir     string
+	members []*Member
+	nextIP  int
+}
+
+// Member is one daemon, and the service it healthchecks.
+type Member struct {
+	Instance         string
+	AvailabilityZone string
+	IP               string
+	Daemon           *daemon.Daemon
+	h                *Harness
+	port             string
+	mu               sync.Mutex
+	service          net.Listener
+	cancel           context.CancelFunc
+	exited           chan int
+}
+
+// New makes a harness, which is cleaned up (stopping every daemon) when the test ends.
+func New(t testing.TB) *Harness {
+	dir, err := ioutil.TempDir("", "awsnycast-harness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Harness{
+		EC2:    ec2sim.New(),
+		Clock:  clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)),
+		t:      t,
+		dir:    dir,
+		nextIP: 10,
+	}
+	t.Cleanup(func() {
+		h.StopAll()
+		os.RemoveAll(dir)
+	})
+	return h
+}
+
+// Add adds an instance in an availability zone, running a daemon with config (which is
+// a template, rendered with the instance's metadata). The daemon isn't started yet.
+func (h *Harness) Add(instance string, az string, config string) *Member {
+	filename := filepath.Join(h.dir, instance+".yaml.tmpl")
+	if err := ioutil.WriteFile(filename, []byte(config), 0600); err != nil {
+		h.t.Fatal(err)
+	}
+	h.nextIP++
+	m := &Member{
+		Instance:         instance,
+		AvailabilityZone: az,
+		IP:               fmt.Sprintf("10.0.0.%d", h.nextIP),
+		h:                h,
+	}
+	m.ServiceUp()
+	h.EC2.AddInstance(ec2sim.Instance{ID: instance, PrivateIP: m.IP, VpcID: VPC})
+	m.Daemon = &daemon.Daemon{
+		ConfigFile: filename,
+		Clock:      h.Clock,
+		MetadataFetcher: instancemetadata.Static{
+			Instance:         instance,
+			Region:           Region,
+			AvailabilityZone: az,
+			IPAddress:        m.IP,
+			VPC:              VPC,
+			Tags:             map[string]string{"service_port": m.port},
+		},
+		RouteTableManager: aws.NewRouteTableManagerEC2WithAPI(h.EC2),
+	}
+	h.members = append(h.members, m)
+	return m
+}
+
+// Member finds a daemon by its instance ID.
+func (h *Harness) Member(instance string) *Member {
+	for _, m := range h.members {
+		if m.Instance == instance {
+			return m
+		}
+	}
+	return nil
+}
+
+// Start runs the daemon, and waits for it to settle.
+func (m *Member) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.exited = make(chan int, 1)
+	go func() {
+		m.exited <- m.Daemon.Run(ctx, false, false)
+	}()
+	m.h.Settle()
+}
+
+// Stop stops the daemon (as if it had been sent SIGINT), returning its exit code.
+func (m *Member) Stop() int {
+	if m.cancel == nil {
+		return 0
+	}
+	m.cancel()
+	m.cancel = nil
+	return <-m.exited
+}
+
+// ServiceDown stops the service the daemon healthchecks, so that its next checks fail.
+func (m *Member) ServiceDown() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.service != nil {
+		m.service.Close()
+		m.service = nil
+	}
+}
+
+// ServiceUp starts the service (again) on the same port.
+func (m *Member) ServiceUp() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.service != nil {
+		return
+	}
+	addr := "127.0.0.1:0"
+	if m.port != "" {
+		addr = "127.0.0.1:" + m.port
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		m.h.t.Fatal(err)
+	}
+	_, m.port, _ = net.SplitHostPort(l.Addr().String())
+	m.service = l
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+}
+
+// StopAll stops every daemon and service.
+func (h *Harness) StopAll() {
+	for _, m := range h.members {
+		m.Stop()
+		m.ServiceDown()
+	}
+}
+
+// Settle waits until the daemons have finished what they're doing and are waiting on the
+// clock: that is, until neither the simulator nor the clock has seen anything new for a
+// while.
+func (h *Harness) Settle() {
+	calls, waiting := -1, -1
+	quiet := time.Now()
+	for time.Since(quiet) < Settled {
+		time.Sleep(time.Millisecond)
+		c, w := len(h.EC2.Calls()), h.Clock.Waiting()
+		if c != calls || w != waiting {
+			calls, waiting = c, w
+			quiet = time.Now()
+		}
+	}
+}
+
+// Advance moves the clock on by d a second at a time, letting the daemons settle after
+// each second.
+func (h *Harness) Advance(d time.Duration) {
+	for ; d > 0; d -= time.Second {
+		step := time.Second
+		if d < step {
+			step = d
+		}
+		h.Clock.Advance(step)
+		h.Settle()
+	}
+}
+
+// AdvanceUntil moves the clock on a second at a time until cond is true, or max has
+// passed. It returns how long that took, and whether cond became true.
+func (h *Harness) AdvanceUntil(cond func() bool, max time.Duration) (time.Duration, bool) {
+	var elapsed time.Duration
+	for !cond() {
+		if elapsed >= max {
+			return elapsed, false
+		}
+		h.Advance(time.Second)
+		elapsed += time.Second
+	}
+	return elapsed, true
+}
+
+// Owner is the instance a route points at, or empty if there is no such route.
+func (h *Harness) Owner(rtb string, cidr string) string {
+	return h.EC2.RouteTarget(rtb, cidr)
+}
@@ -0,0 +1,132 @@
+package harness
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+
+	"github.com/justenwalker/awsnycast/testhelpers"
+	"github.com/justenwalker/awsnycast/tracing"
+)
+
+const config = `---
+poll_time: 10
+healthchecks:
+    service:
+        type: tcp
+        destination: 127.0.0.1
+        rise: 2
+        fall: 3
+        every: 1
+        config:
+            port: '{{ index .Tags "service_port" }}'
+routetables:
+    private:
+        find:
+            type: by_tag
+            config:
+                key: Name
+                value: private
+        manage_routes:
+           - cidr: 0.0.0.0/0
+             instance: SELF
+             healthcheck: service
+             if_unhealthy: {{ ne .AvailabilityZone "us-east-1a" }}
+`
+
+func getFailover(t *testing.T) *Harness {
+	h := New(t)
+	h.EC2.AddRouteTable("rtb-1", VPC, "10.0.0.0/16", map[string]string{"Name": "private"})
+	// Start a second apart, so their polls don't coincide
+	for _, m := range []*Member{
+		h.Add("i-a", "us-east-1a", config),
+		h.Add("i-b", "us-east-1b", config),
+		h.Add("i-c", "us-east-1c", config),
+	} {
+		m.Start()
+		h.Advance(time.Second)
+	}
+	_, ok := h.AdvanceUntil(func() bool { return h.Owner("rtb-1", "0.0.0.0/0") == "i-a" }, 30*time.Second)
+	if !assert.True(t, ok, "primary never took the route") {
+		t.FailNow()
+	}
+	return h
+}
+
+func TestPrimaryServiceDies(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping harness test in short mode")
+	}
+	h := getFailover(t)
+	h.Member("i-a").ServiceDown()
+	backup := func() bool {
+		owner := h.Owner("rtb-1", "0.0.0.0/0")
+		return owner == "i-b" || owner == "i-c"
+	}
+	took, ok := h.AdvanceUntil(backup, time.Minute)
+	assert.True(t, ok)
+	// The primary notices after fall (3) checks and deletes the route, then whichever
+	// backup polls (every 10s) next creates it - i-b, whose polls come first after that.
+	owner := h.Owner("rtb-1", "0.0.0.0/0")
+	t.Logf("%s took over after %s", owner, took)
+	assert.Equal(t, owner, "i-b")
+	assert.True(t, took <= 3*time.Second+10*time.Second, took.String())
+
+	// The winner keeps it, and the primary doesn't take it back while unhealthy
+	h.Advance(30 * time.Second)
+	assert.Equal(t, h.Owner("rtb-1", "0.0.0.0/0"), owner)
+}
+
+func TestBackupTakesOverFromStoppedPrimary(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping harness test in short mode")
+	}
+	h := getFailover(t)
+	assert.Equal(t, h.Member("i-a").Stop(), 0)
+	h.EC2.SetInstanceState("i-a", "stopped")
+	took, ok := h.AdvanceUntil(func() bool { return h.Owner("rtb-1", "0.0.0.0/0") != "i-a" }, time.Minute)
+	assert.True(t, ok)
+	// Within a poll of the route going blackhole
+	assert.True(t, took <= 10*time.Second, took.String())
+	assert.Contains(t, []string{"i-b", "i-c"}, h.Owner("rtb-1", "0.0.0.0/0"))
+}
+
+func TestServiceDeathIsTraced(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping harness test in short mode")
+	}
+	collector := testhelpers.NewFakeCollector()
+	defer collector.Close()
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+
+	h := New(t)
+	h.EC2.AddRouteTable("rtb-1", VPC, "10.0.0.0/16", map[string]string{"Name": "private"})
+	m := h.Add("i-a", "us-east-1a", config+"tracing:\n    endpoint: "+collector.URL+"\n")
+	m.Start()
+	_, ok := h.AdvanceUntil(func() bool { return h.Owner("rtb-1", "0.0.0.0/0") == "i-a" }, 30*time.Second)
+	assert.True(t, ok)
+	m.ServiceDown()
+	_, ok = h.AdvanceUntil(func() bool { return h.Owner("rtb-1", "0.0.0.0/0") == "" }, 30*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, m.Stop(), 0) // Sends the spans
+
+	assert.Equal(t, collector.Resource()["host.id"], "i-a")
+	decisions := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, span := range collector.Spans() {
+		names[span.Name] = true
+		for _, kv := range span.Attributes {
+			if kv.Key == string(tracing.Decision) {
+				decisions[kv.Value.GetStringValue()] = true
+			}
+		}
+	}
+	for _, name := range []string{"RunRouteTables", "RunOneRouteTable", "handleHealthcheckResult", "healthcheck transition", "ManageInstanceRoute", "EC2.CreateRoute", "EC2.DeleteRoute"} {
+		assert.True(t, names[name], name)
+	}
+	assert.True(t, decisions["create"])
+	assert.True(t, decisions["delete"])
+}
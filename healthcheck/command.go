@@ -6,7 +6,7 @@ import (
 	"strings"
 
 	"github.com/hashicorp/go-multierror"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 
 	"github.com/justenwalker/awsnycast/utils"
 )
@@ -22,14 +22,14 @@ type CommandHealthCheck struct {
 }
 
 func (h CommandHealthCheck) Healthcheck() bool {
-	contextLogger := log.WithFields(log.Fields{
+	contextLogger := log.WithFields(logrus.Fields{
 		"destination": h.Destination,
 		"command":     h.Command,
 		"arguments":   strings.Join(h.Arguments, ", "),
 	})
 	contextLogger.Debug("Run command")
 	if err := exec.Command(h.Command, h.Arguments...).Run(); err != nil {
-		contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("command healthcheck failed")
+		contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Debug("command healthcheck failed")
 		return false
 	}
 	contextLogger.Debug("command OK")
@@ -0,0 +1,99 @@
+package healthcheck
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+
+	"github.com/justenwalker/awsnycast/utils"
+)
+
+func init() {
+	RegisterHealthcheck("composite", CompositeConstructor)
+	noDestination["composite"] = true
+}
+
+// CompositeHealthCheck is healthy based on the current state of a set of
+// other named healthchecks, rather than by probing anything itself.
+type CompositeHealthCheck struct {
+	Mode   string
+	Names  []string
+	Checks []CanBeHealthy
+}
+
+func (h CompositeHealthCheck) Healthcheck() bool {
+	contextLogger := log.WithFields(logrus.Fields{
+		"mode":   h.Mode,
+		"checks": h.Names,
+	})
+	for i, c := range h.Checks {
+		healthy := c.IsHealthy()
+		if h.Mode == "any" && healthy {
+			contextLogger.WithFields(logrus.Fields{"healthy_check": h.Names[i]}).Debug("composite OK")
+			return true
+		}
+		if h.Mode == "all" && !healthy {
+			contextLogger.WithFields(logrus.Fields{"unhealthy_check": h.Names[i]}).Debug("composite healthcheck failed")
+			return false
+		}
+	}
+	if h.Mode == "all" {
+		contextLogger.Debug("composite OK")
+		return true
+	}
+	contextLogger.Debug("composite healthcheck failed")
+	return false
+}
+
+// DependencyNames returns the names of the other healthchecks this healthcheck
+// is built from. Only composite healthchecks have dependencies.
+func (h *Healthcheck) DependencyNames() ([]string, error) {
+	if h.Type != "composite" {
+		return nil, nil
+	}
+	val, ok := h.Config["checks"]
+	if !ok {
+		return nil, errors.New("'checks' not defined in composite healthcheck config")
+	}
+	names, err := utils.GetAsSlice(val)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, errors.New("'checks' in composite healthcheck config is empty")
+	}
+	return names, nil
+}
+
+// SetDependencies supplies the healthchecks named by DependencyNames, in the same order.
+// It must be called before Setup.
+func (h *Healthcheck) SetDependencies(deps []*Healthcheck) {
+	h.dependencies = deps
+}
+
+func CompositeConstructor(h Healthcheck) (HealthChecker, error) {
+	var result *multierror.Error
+	hc := CompositeHealthCheck{
+		Mode: "all",
+	}
+	if val, ok := h.Config["mode"]; ok {
+		hc.Mode = utils.GetAsString(val)
+	}
+	if hc.Mode != "all" && hc.Mode != "any" {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("Unknown mode '%s' in composite healthcheck config, must be 'all' or 'any'", hc.Mode)))
+	}
+	names, err := h.DependencyNames()
+	if err != nil {
+		result = multierror.Append(result, err)
+	} else if len(names) != len(h.dependencies) {
+		result = multierror.Append(result, errors.New("composite healthcheck dependencies have not been resolved"))
+	} else {
+		hc.Names = names
+		for _, dep := range h.dependencies {
+			hc.Checks = append(hc.Checks, dep)
+		}
+	}
+	return hc, result.ErrorOrNil()
+}
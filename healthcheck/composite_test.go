@@ -0,0 +1,123 @@
+package healthcheck
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/justenwalker/awsnycast/testhelpers"
+)
+
+func getCompositeDependencies(healthy ...bool) []*Healthcheck {
+	deps := make([]*Healthcheck, len(healthy))
+	for i, v := range healthy {
+		deps[i] = &Healthcheck{isHealthy: v}
+	}
+	return deps
+}
+
+func getCompositeHealthcheck(mode string, deps []*Healthcheck) Healthcheck {
+	c := make(map[string]interface{})
+	checks := make([]interface{}, len(deps))
+	for i := range deps {
+		checks[i] = "check"
+	}
+	c["checks"] = checks
+	if mode != "" {
+		c["mode"] = mode
+	}
+	h := Healthcheck{
+		Type:   "composite",
+		Config: c,
+	}
+	h.SetDependencies(deps)
+	return h
+}
+
+func TestHealthcheckCompositeValidateNoDestination(t *testing.T) {
+	h := getCompositeHealthcheck("", getCompositeDependencies(true))
+	assert.Nil(t, h.Validate("foo", false))
+}
+
+func TestHealthcheckCompositeAll(t *testing.T) {
+	h := getCompositeHealthcheck("", getCompositeDependencies(true, true))
+	if assert.Nil(t, h.Validate("foo", false)) {
+		assert.Nil(t, h.Setup())
+		assert.Equal(t, h.healthchecker.Healthcheck(), true)
+	}
+}
+
+func TestHealthcheckCompositeAllFail(t *testing.T) {
+	h := getCompositeHealthcheck("all", getCompositeDependencies(true, false))
+	if assert.Nil(t, h.Validate("foo", false)) {
+		assert.Nil(t, h.Setup())
+		assert.Equal(t, h.healthchecker.Healthcheck(), false)
+	}
+}
+
+func TestHealthcheckCompositeAny(t *testing.T) {
+	h := getCompositeHealthcheck("any", getCompositeDependencies(false, true))
+	if assert.Nil(t, h.Validate("foo", false)) {
+		assert.Nil(t, h.Setup())
+		assert.Equal(t, h.healthchecker.Healthcheck(), true)
+	}
+}
+
+func TestHealthcheckCompositeAnyFail(t *testing.T) {
+	h := getCompositeHealthcheck("any", getCompositeDependencies(false, false))
+	if assert.Nil(t, h.Validate("foo", false)) {
+		assert.Nil(t, h.Setup())
+		assert.Equal(t, h.healthchecker.Healthcheck(), false)
+	}
+}
+
+func TestHealthcheckCompositeBadMode(t *testing.T) {
+	h := getCompositeHealthcheck("most", getCompositeDependencies(true))
+	assert.Nil(t, h.Validate("foo", false))
+	testhelpers.CheckOneMultiError(t, h.Setup(), "Unknown mode 'most' in composite healthcheck config, must be 'all' or 'any'")
+}
+
+func TestHealthcheckCompositeNoChecks(t *testing.T) {
+	h := Healthcheck{Type: "composite"}
+	assert.Nil(t, h.Validate("foo", false))
+	testhelpers.CheckOneMultiError(t, h.Setup(), "'checks' not defined in composite healthcheck config")
+}
+
+func TestHealthcheckCompositeUnresolved(t *testing.T) {
+	h := getCompositeHealthcheck("", getCompositeDependencies(true))
+	h.SetDependencies(nil)
+	assert.Nil(t, h.Validate("foo", false))
+	testhelpers.CheckOneMultiError(t, h.Setup(), "composite healthcheck dependencies have not been resolved")
+}
+
+func TestHealthcheckDependencyNamesNotComposite(t *testing.T) {
+	h := Healthcheck{Type: "ping", Destination: "127.0.0.1"}
+	names, err := h.DependencyNames()
+	assert.Nil(t, err)
+	assert.Nil(t, names)
+}
+
+func TestHealthcheckCompositeDependencyRunning(t *testing.T) {
+	dep := &Healthcheck{Type: "ping", Destination: "127.0.0.1", Rise: 1}
+	assert.Nil(t, dep.Validate("dep", false))
+	dep.healthchecker = MyFakeHealthCheck{Healthy: true}
+	h := getCompositeHealthcheck("", []*Healthcheck{dep})
+	assert.Nil(t, h.Validate("foo", false))
+	assert.Nil(t, h.Setup())
+	done := make(chan bool)
+	go func() { // The dependency's runner changes its state as the composite reads it
+		for i := 0; i < 100; i++ {
+			dep.PerformHealthcheck()
+		}
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			h.healthchecker.Healthcheck()
+		}
+	}
+	assert.Equal(t, h.healthchecker.Healthcheck(), true)
+}
@@ -1,18 +1,41 @@
 package healthcheck
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os/exec"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/justenwalker/awsnycast/clock"
+	"github.com/justenwalker/awsnycast/logging"
+	"github.com/justenwalker/awsnycast/tracing"
 )
 
+var log = logging.For("healthcheck")
+
 var healthCheckTypes map[string]func(Healthcheck) (HealthChecker, error)
 
+// stateLock guards the state a healthcheck's runner changes as it runs, which other
+// goroutines (composite healthchecks, route management, status) read. It is shared by
+// all healthchecks, as they are passed around and copied by value.
+var stateLock sync.RWMutex
+
+// noDestination holds the healthcheck types which do not probe a destination
+// themselves. They are configured without one, and cannot be remote healthchecks.
+var noDestination = make(map[string]bool)
+
+// configValidators check the config of the healthcheck types which need it checked when
+// the config is loaded, rather than when the healthcheck is set up.
+var configValidators = make(map[string]func(name string, config map[string]interface{}) error)
+
 func RegisterHealthcheck(name string, f func(Healthcheck) (HealthChecker, error)) {
 	if healthCheckTypes == nil {
 		healthCheckTypes = make(map[string]func(Healthcheck) (HealthChecker, error))
@@ -30,6 +53,11 @@ type CanBeHealthy interface {
 	CanPassYet() bool
 }
 
+// Notifier is told each time a healthcheck changes state, e.g. to send a webhook.
+type Notifier interface {
+	HealthcheckChanged(name string, destination string, healthy bool)
+}
+
 type Healthcheck struct {
 	canPassYet     bool                   `yaml:"-"`
 	runCount       uint64                 `yaml:"-"`
@@ -43,14 +71,28 @@ type Healthcheck struct {
 	Config         map[string]interface{} `yaml:"config"`
 	RunOnHealthy   []string               `yaml:"run_on_healthy"`
 	RunOnUnhealthy []string               `yaml:"run_on_unhealthy"`
+	PeerStatus     *PeerStatusConfig      `yaml:"peer_status"`
+	route          string                 `yaml:"-"`
 	healthchecker  HealthChecker          `yaml:"-"`
 	isRunning      bool                   `yaml:"-"`
 	quitChan       chan<- bool            `yaml:"-"`
 	hasQuitChan    <-chan bool            `yaml:"-"`
 	listeners      []chan<- bool          `yaml:"-"`
+	dependencies   []*Healthcheck         `yaml:"-"`
+	clock          clock.Clock            `yaml:"-"`
+	changingSince  time.Time              `yaml:"-"`
+	name           string                 `yaml:"-"`
+	notifier       Notifier               `yaml:"-"`
+	lastRun        int64                  `yaml:"-"` // UnixNano of the last completed run, for Stalled
 }
 
 func (h *Healthcheck) NewWithDestination(destination string) (*Healthcheck, error) {
+	return h.NewWithDestinationForRoute(destination, "")
+}
+
+// NewWithDestinationForRoute makes a remote healthcheck against the instance holding a route,
+// which is needed to ask that instance about the route if the template has peer_status set.
+func (h *Healthcheck) NewWithDestinationForRoute(destination string, route string) (*Healthcheck, error) {
 	n := &Healthcheck{
 		Destination:    destination,
 		Type:           h.Type,
@@ -60,12 +102,17 @@ func (h *Healthcheck) NewWithDestination(destination string) (*Healthcheck, erro
 		Config:         h.Config,
 		RunOnHealthy:   h.RunOnHealthy,
 		RunOnUnhealthy: h.RunOnUnhealthy,
+		PeerStatus:     h.PeerStatus,
+		route:          route,
+		clock:          h.clock,
+		name:           h.name,
+		notifier:       h.notifier,
 	}
 	err := n.Validate(destination, false)
 	if err == nil {
 		err = n.Setup()
 	}
-	log.WithFields(log.Fields{
+	log.WithFields(logrus.Fields{
 		"destination": n.Destination,
 		"type":        n.Type,
 		"err":         err,
@@ -75,37 +122,47 @@ func (h *Healthcheck) NewWithDestination(destination string) (*Healthcheck, erro
 
 func (h *Healthcheck) GetListener() <-chan bool {
 	c := make(chan bool, 5)
+	stateLock.Lock()
 	h.listeners = append(h.listeners, c)
+	stateLock.Unlock()
 	return c
 }
 
 func (h *Healthcheck) stateChange() {
-	contextLogger := log.WithFields(log.Fields{
+	contextLogger := log.WithFields(logrus.Fields{
 		"destination": h.Destination,
 		"type":        h.Type,
 	})
+	stateLock.Lock()
 	h.canPassYet = true
+	listeners := append([]chan<- bool(nil), h.listeners...)
+	stateLock.Unlock()
 	if h.isHealthy {
 		if len(h.RunOnHealthy) > 0 {
 			cmd := h.RunOnHealthy[0]
 			if err := exec.Command(cmd, h.RunOnHealthy[1:]...).Run(); err != nil {
-				contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("healthcheck RunOnHealthy failed")
+				contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Debug("healthcheck RunOnHealthy failed")
 			}
 		}
 	} else {
 		if len(h.RunOnUnhealthy) > 0 {
 			cmd := h.RunOnUnhealthy[0]
 			if err := exec.Command(cmd, h.RunOnUnhealthy[1:]...).Run(); err != nil {
-				contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("healthcheck RunOnUnhealthy failed")
+				contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Debug("healthcheck RunOnUnhealthy failed")
 			}
 		}
 	}
-	for _, l := range h.listeners {
+	if h.notifier != nil {
+		h.notifier.HealthcheckChanged(h.name, h.Destination, h.isHealthy)
+	}
+	for _, l := range listeners {
 		l <- h.isHealthy
 	}
 }
 
 func (h *Healthcheck) CanPassYet() bool {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
 	return h.canPassYet
 }
 
@@ -116,20 +173,37 @@ func (h Healthcheck) GetHealthChecker() (HealthChecker, error) {
 	return nil, errors.New(fmt.Sprintf("Healthcheck type '%s' not found in the healthcheck registry", h.Type))
 }
 
-func (h Healthcheck) IsHealthy() bool {
+func (h *Healthcheck) IsHealthy() bool {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
 	return h.isHealthy
 }
 
+// setHealthy is only called from the runner, which is the only writer of isHealthy and
+// History, so it can go on reading them without the lock.
+func (h *Healthcheck) setHealthy(healthy bool) {
+	stateLock.Lock()
+	h.isHealthy = healthy
+	stateLock.Unlock()
+}
+
 func (h *Healthcheck) PerformHealthcheck() {
 	if h.healthchecker == nil {
 		panic("Setup() never called for healthcheck before Run")
 	}
 	h.runCount = h.runCount + 1
 	result := h.healthchecker.Healthcheck()
+	stateLock.Lock()
 	maxIdx := uint(len(h.History) - 1)
 	h.History = append(h.History[:0], h.History[1:]...)
 	h.History = append(h.History, result)
-	contextLogger := log.WithFields(log.Fields{
+	stateLock.Unlock()
+	if result == h.isHealthy {
+		h.changingSince = time.Time{}
+	} else if h.changingSince.IsZero() {
+		h.changingSince = h.now()
+	}
+	contextLogger := log.WithFields(logrus.Fields{
 		"destination": h.Destination,
 		"type":        h.Type,
 	})
@@ -141,7 +215,8 @@ func (h *Healthcheck) PerformHealthcheck() {
 			}
 		}
 		contextLogger.Info("Healthcheck is unhealthy")
-		h.isHealthy = false
+		h.setHealthy(false)
+		h.traceTransition()
 		h.stateChange()
 	} else { // Currently unhealthy
 		downTo := maxIdx - h.Rise + 1
@@ -153,12 +228,37 @@ func (h *Healthcheck) PerformHealthcheck() {
 				return
 			}
 		}
-		h.isHealthy = true
+		h.setHealthy(true)
 		contextLogger.Info("Healthcheck is healthy")
+		h.traceTransition()
 		h.stateChange()
 	}
 }
 
+func (h *Healthcheck) now() time.Time {
+	if h.clock == nil {
+		return clock.Real.Now()
+	}
+	return h.clock.Now()
+}
+
+// traceTransition records the time from the first check that disagreed with the old state
+// to the change of state, i.e. how long was spent waiting for rise or fall checks in a row.
+func (h *Healthcheck) traceTransition() {
+	start := h.changingSince
+	if start.IsZero() {
+		start = h.now()
+	}
+	h.changingSince = time.Time{}
+	tracing.Record(context.Background(), "healthcheck transition", start, h.now(),
+		tracing.Type.String(h.Type),
+		tracing.Destination.String(h.Destination),
+		tracing.Healthy.Bool(h.isHealthy),
+		tracing.Rise.Int(int(h.Rise)),
+		tracing.Fall.Int(int(h.Fall)),
+	)
+}
+
 func (h *Healthcheck) Validate(name string, remote bool) error {
 	if h == nil {
 		panic("Cannot validate nill healthcheck")
@@ -185,7 +285,9 @@ func (h *Healthcheck) Validate(name string, remote bool) error {
 	var result *multierror.Error
 	if !remote {
 		if h.Destination == "" {
-			result = multierror.Append(result, errors.New(fmt.Sprintf("Healthcheck %s has no destination set", name)))
+			if !noDestination[h.Type] {
+				result = multierror.Append(result, errors.New(fmt.Sprintf("Healthcheck %s has no destination set", name)))
+			}
 		} else {
 			if net.ParseIP(h.Destination) == nil {
 				result = multierror.Append(result, errors.New(fmt.Sprintf("Healthcheck %s destination '%s' does not parse as an IP address", name, h.Destination)))
@@ -195,6 +297,14 @@ func (h *Healthcheck) Validate(name string, remote bool) error {
 		if h.Destination != "" {
 			result = multierror.Append(result, errors.New(fmt.Sprintf("Remote healthcheck %s cannot have destination set", name)))
 		}
+		if noDestination[h.Type] {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Remote healthcheck %s cannot be of type %s", name, h.Type)))
+		}
+		if h.PeerStatus != nil {
+			if err := h.PeerStatus.Validate(name); err != nil {
+				result = multierror.Append(result, err)
+			}
+		}
 	}
 	if h.Type == "" {
 		result = multierror.Append(result, errors.New("No healthcheck type set"))
@@ -202,30 +312,63 @@ func (h *Healthcheck) Validate(name string, remote bool) error {
 		if _, found := healthCheckTypes[h.Type]; !found {
 			result = multierror.Append(result, errors.New(fmt.Sprintf("Unknown healthcheck type '%s' in %s", h.Type, name)))
 		}
+		if validate, ok := configValidators[h.Type]; ok {
+			if err := validate(name, h.Config); err != nil {
+				result = multierror.Append(result, err)
+			}
+		}
 	}
 	return result.ErrorOrNil()
 }
 
 func (h *Healthcheck) Setup() error {
+	// Set up again, the old healthchecker is replaced, so let go of anything it holds
+	// (e.g. a push healthcheck's path on its listener) first.
+	if closer, ok := h.healthchecker.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+		h.healthchecker = nil
+	}
 	hc, err := h.GetHealthChecker()
 	if err != nil {
 		return err
 	}
+	if h.PeerStatus != nil && h.route != "" {
+		hc = NewPeerStatusHealthCheck(h.Destination, h.route, *h.PeerStatus, hc)
+	}
 	h.healthchecker = hc
 	return nil
 }
 
-func sleepAndSend(t uint, send chan<- bool) {
+// SetClock sets the clock that the time between runs is measured with.
+func (h *Healthcheck) SetClock(c clock.Clock) {
+	h.clock = c
+}
+
+// SetNotifier tells n (as name) each time the healthcheck changes state. Remote
+// healthchecks made from this one tell n too.
+func (h *Healthcheck) SetNotifier(name string, n Notifier) {
+	h.name = name
+	h.notifier = n
+}
+
+func sleepAndSend(c clock.Clock, t uint, send chan<- bool) {
+	wait := c.After(time.Duration(t) * time.Second)
 	go func() {
-		time.Sleep(time.Duration(t) * time.Second)
+		<-wait
 		send <- true
 	}()
 }
 
 func (h *Healthcheck) Run(debug bool) {
-	if h.isRunning {
+	if h.IsRunning() {
 		return
 	}
+	c := h.clock
+	if c == nil {
+		c = clock.Real
+	}
 	hasquit := make(chan bool)
 	quit := make(chan bool)
 	run := make(chan bool)
@@ -239,8 +382,9 @@ func (h *Healthcheck) Run(debug bool) {
 			case <-run:
 				log.Debug("Healthcheck is running")
 				h.PerformHealthcheck()
+				atomic.StoreInt64(&h.lastRun, c.Now().UnixNano())
 				log.Debug("Healthcheck has run")
-				sleepAndSend(h.Every, run) // Queue the next run up
+				sleepAndSend(c, h.Every, run) // Queue the next run up
 			}
 		}
 		hasquit <- true
@@ -248,11 +392,26 @@ func (h *Healthcheck) Run(debug bool) {
 	}()
 	h.hasQuitChan = hasquit
 	h.quitChan = quit
+	atomic.StoreInt64(&h.lastRun, c.Now().UnixNano())
+	stateLock.Lock()
 	h.isRunning = true
+	stateLock.Unlock()
 	run <- true // Fire straight away once set running
 }
 
-func (h Healthcheck) IsRunning() bool {
+// Stalled is true if the healthcheck is running, but hasn't finished a check for grace
+// longer than it should take to come round again - i.e. its runner is stuck.
+func (h *Healthcheck) Stalled(now time.Time, grace time.Duration) bool {
+	if !h.IsRunning() {
+		return false
+	}
+	last := time.Unix(0, atomic.LoadInt64(&h.lastRun))
+	return now.Sub(last) > time.Duration(h.Every)*time.Second+grace
+}
+
+func (h *Healthcheck) IsRunning() bool {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
 	return h.isRunning
 }
 
@@ -265,5 +424,7 @@ func (h *Healthcheck) Stop() {
 	<-h.hasQuitChan // Block till finished
 	h.quitChan = nil
 	h.hasQuitChan = nil
+	stateLock.Lock()
 	h.isRunning = false
+	stateLock.Unlock()
 }
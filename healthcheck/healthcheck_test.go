@@ -4,13 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/justenwalker/awsnycast/clock"
 	"github.com/justenwalker/awsnycast/testhelpers"
+	"github.com/justenwalker/awsnycast/tracing"
 )
 
 type MyFakeHealthCheck struct {
@@ -211,6 +213,84 @@ func TestHealthcheckRise(t *testing.T) {
 	}
 }
 
+func TestHealthcheckRiseIsTraced(t *testing.T) {
+	sr := testhelpers.RecordSpans(t)
+	RegisterHealthcheck("test_ok", MyFakeHealthConstructorOk)
+	c := clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := Healthcheck{Type: "test_ok", Destination: "127.0.0.1", Rise: 3}
+	h.Validate("foo", false)
+	h.Setup()
+	h.SetClock(c)
+	for i := 0; i < 3; i++ {
+		h.PerformHealthcheck()
+		c.Advance(5 * time.Second)
+	}
+	assert.Equal(t, h.IsHealthy(), true)
+	spans := sr.Ended()
+	if assert.Equal(t, len(spans), 1) {
+		assert.Equal(t, spans[0].Name(), "healthcheck transition")
+		// From the first passing check to the third
+		assert.Equal(t, spans[0].EndTime().Sub(spans[0].StartTime()), 10*time.Second)
+		assert.Contains(t, spans[0].Attributes(), tracing.Healthy.Bool(true))
+		assert.Contains(t, spans[0].Attributes(), tracing.Rise.Int(3))
+	}
+}
+
+type fakeNotifier struct {
+	changes []string
+}
+
+func (n *fakeNotifier) HealthcheckChanged(name string, destination string, healthy bool) {
+	n.changes = append(n.changes, fmt.Sprintf("%s %s %v", name, destination, healthy))
+}
+
+func TestHealthcheckNotifies(t *testing.T) {
+	RegisterHealthcheck("test_ok", MyFakeHealthConstructorOk)
+	n := &fakeNotifier{}
+	h := Healthcheck{Type: "test_ok", Destination: "127.0.0.1", Rise: 2}
+	h.Validate("foo", false)
+	h.SetNotifier("foo", n)
+	h.Setup()
+	remote, err := h.NewWithDestination("10.0.0.1")
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		h.PerformHealthcheck()
+		remote.PerformHealthcheck()
+	}
+	assert.Equal(t, n.changes, []string{"foo 127.0.0.1 true", "foo 10.0.0.1 true"})
+}
+
+// hangingHealthCheck blocks until release is closed.
+type hangingHealthCheck struct {
+	release chan bool
+}
+
+func (h hangingHealthCheck) Healthcheck() bool {
+	<-h.release
+	return true
+}
+
+func TestHealthcheckStalled(t *testing.T) {
+	release := make(chan bool)
+	RegisterHealthcheck("test_hang", func(Healthcheck) (HealthChecker, error) {
+		return hangingHealthCheck{release: release}, nil
+	})
+	c := clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := Healthcheck{Type: "test_hang", Destination: "127.0.0.1", Every: 10}
+	h.Validate("foo", false)
+	h.Setup()
+	h.SetClock(c)
+	assert.Equal(t, h.Stalled(c.Now().Add(time.Hour), time.Second), false, "Stalled when not running")
+	h.Run(false)
+	c.Advance(15 * time.Second)
+	assert.Equal(t, h.Stalled(c.Now(), 5*time.Second), false)
+	c.Advance(time.Second)
+	assert.Equal(t, h.Stalled(c.Now(), 5*time.Second), true)
+	close(release)
+	h.Stop()
+	assert.Equal(t, h.Stalled(c.Now(), 5*time.Second), false)
+}
+
 func TestHealthcheckFall(t *testing.T) {
 	RegisterHealthcheck("test_fail", MyFakeHealthConstructorFail)
 	h_ok := Healthcheck{Type: "test_fail", Destination: "127.0.0.1", Fall: 2}
@@ -371,7 +451,7 @@ func TestChangeDestinationFail(t *testing.T) {
 func TestHealthcheckRunOnHealthy(t *testing.T) {
 	dir, err := ioutil.TempDir("", "awsnycast")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 	defer os.RemoveAll(dir) // clean up
 	flagFile := dir + "/run_on_healthy"
@@ -400,7 +480,7 @@ func TestHealthcheckRunOnUnhealthy(t *testing.T) {
 	pingCmd = "false"
 	dir, err := ioutil.TempDir("", "awsnycast")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 	defer os.RemoveAll(dir) // clean up
 	flagFile := dir + "/run_on_unhealthy"
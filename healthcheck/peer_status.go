@@ -0,0 +1,95 @@
+package healthcheck
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PeerStatusConfig makes a remote healthcheck ask the AWSnycast daemon on the instance
+// currently holding a route for its own view of the route's health, rather than probing
+// the service directly. The direct probe is only used if the daemon can't be reached.
+type PeerStatusConfig struct {
+	Port    uint   `yaml:"port"`
+	Path    string `yaml:"path"`
+	Timeout uint   `yaml:"timeout"`
+}
+
+func (c *PeerStatusConfig) Validate(name string) error {
+	if c.Port == 0 {
+		return errors.New(fmt.Sprintf("Remote healthcheck %s peer_status needs a port", name))
+	}
+	if c.Path == "" {
+		c.Path = "/status"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 2
+	}
+	return nil
+}
+
+// PeerStatusHealthCheck asks the peer's status endpoint about a route, falling back
+// to another healthcheck if it can't get an answer.
+type PeerStatusHealthCheck struct {
+	Destination string
+	Route       string
+	URL         string
+	Fallback    HealthChecker
+	client      *http.Client
+}
+
+// peerStatus is the part of the daemon's status output we care about
+type peerStatus struct {
+	Routes map[string]bool `json:"routes"`
+}
+
+func NewPeerStatusHealthCheck(destination string, route string, config PeerStatusConfig, fallback HealthChecker) PeerStatusHealthCheck {
+	return PeerStatusHealthCheck{
+		Destination: destination,
+		Route:       route,
+		URL:         fmt.Sprintf("http://%s%s", net.JoinHostPort(destination, strconv.Itoa(int(config.Port))), config.Path),
+		Fallback:    fallback,
+		client:      &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+	}
+}
+
+func (h PeerStatusHealthCheck) Healthcheck() bool {
+	contextLogger := log.WithFields(logrus.Fields{
+		"destination": h.Destination,
+		"route":       h.Route,
+		"url":         h.URL,
+	})
+	healthy, err := h.askPeer()
+	if err != nil {
+		contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Info("Could not get route health from peer AWSnycast, falling back to direct probe")
+		return h.Fallback.Healthcheck()
+	}
+	contextLogger.WithFields(logrus.Fields{"healthy": healthy}).Debug("Got route health from peer AWSnycast")
+	return healthy
+}
+
+func (h PeerStatusHealthCheck) askPeer() (bool, error) {
+	resp, err := h.client.Get(h.URL)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New(fmt.Sprintf("unexpected status %s", resp.Status))
+	}
+	var status peerStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return false, err
+	}
+	healthy, ok := status.Routes[h.Route]
+	if !ok {
+		return false, errors.New("peer does not advertise this route")
+	}
+	return healthy, nil
+}
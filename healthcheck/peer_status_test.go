@@ -0,0 +1,84 @@
+package healthcheck
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/justenwalker/awsnycast/testhelpers"
+)
+
+func getPeerStatusHealthCheck(t *testing.T, body string, fallback bool) (PeerStatusHealthCheck, func()) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.URL.Path, "/status")
+		fmt.Fprint(w, body)
+	}))
+	host, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	c := PeerStatusConfig{Port: uint(p)}
+	assert.Nil(t, c.Validate("foo"))
+	return NewPeerStatusHealthCheck(host, "192.168.1.1/32", c, MyFakeHealthCheck{Healthy: fallback}), ts.Close
+}
+
+func TestPeerStatusHealthy(t *testing.T) {
+	h, cleanup := getPeerStatusHealthCheck(t, `{"routes": {"192.168.1.1/32": true}}`, false)
+	defer cleanup()
+	assert.Equal(t, h.Healthcheck(), true)
+}
+
+func TestPeerStatusUnhealthy(t *testing.T) {
+	h, cleanup := getPeerStatusHealthCheck(t, `{"routes": {"192.168.1.1/32": false}}`, true)
+	defer cleanup()
+	assert.Equal(t, h.Healthcheck(), false)
+}
+
+func TestPeerStatusRouteNotAdvertisedFallback(t *testing.T) {
+	h, cleanup := getPeerStatusHealthCheck(t, `{"routes": {"10.0.0.0/8": false}}`, true)
+	defer cleanup()
+	assert.Equal(t, h.Healthcheck(), true)
+}
+
+func TestPeerStatusUnreachableFallback(t *testing.T) {
+	h, cleanup := getPeerStatusHealthCheck(t, `{}`, true)
+	cleanup()
+	assert.Equal(t, h.Healthcheck(), true)
+	h.Fallback = MyFakeHealthCheck{Healthy: false}
+	assert.Equal(t, h.Healthcheck(), false)
+}
+
+func TestPeerStatusValidate(t *testing.T) {
+	h := Healthcheck{
+		Type:       "ping",
+		PeerStatus: &PeerStatusConfig{},
+	}
+	testhelpers.CheckOneMultiError(t, h.Validate("foo", true), "Remote healthcheck foo peer_status needs a port")
+	h.PeerStatus.Port = 9300
+	assert.Nil(t, h.Validate("foo", true))
+	assert.Equal(t, h.PeerStatus.Path, "/status")
+	assert.Equal(t, h.PeerStatus.Timeout, uint(2))
+}
+
+func TestPeerStatusNewWithDestinationForRoute(t *testing.T) {
+	h := Healthcheck{
+		Type:       "ping",
+		PeerStatus: &PeerStatusConfig{Port: 9300},
+	}
+	assert.Nil(t, h.Validate("foo", true))
+	n, err := h.NewWithDestinationForRoute("127.0.0.2", "192.168.1.1/32")
+	if assert.Nil(t, err) {
+		if assert.IsType(t, PeerStatusHealthCheck{}, n.healthchecker) {
+			p := n.healthchecker.(PeerStatusHealthCheck)
+			assert.Equal(t, p.URL, "http://127.0.0.2:9300/status")
+			assert.IsType(t, PingHealthCheck{}, p.Fallback)
+		}
+	}
+	n, err = h.NewWithDestination("127.0.0.2")
+	if assert.Nil(t, err) {
+		assert.IsType(t, PingHealthCheck{}, n.healthchecker)
+	}
+}
@@ -3,7 +3,7 @@ package healthcheck
 import (
 	"os/exec"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
 var pingCmd string
@@ -19,12 +19,12 @@ type PingHealthCheck struct {
 
 func (h PingHealthCheck) Healthcheck() bool {
 	args := []string{"-c", "1", h.Destination}
-	contextLogger := log.WithFields(log.Fields{
+	contextLogger := log.WithFields(logrus.Fields{
 		"destination": h.Destination,
 	})
 	contextLogger.Debug("Pinging")
 	if err := exec.Command(pingCmd, args...).Run(); err != nil {
-		contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("ping healthcheck failed")
+		contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Debug("ping healthcheck failed")
 		return false
 	}
 	contextLogger.Debug("Ping OK")
@@ -0,0 +1,301 @@
+package healthcheck
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+
+	"github.com/justenwalker/awsnycast/clock"
+	"github.com/justenwalker/awsnycast/utils"
+)
+
+func init() {
+	RegisterHealthcheck("push", PushConstructor)
+	noDestination["push"] = true
+	configValidators["push"] = validatePushConfig
+}
+
+// PushHealthCheck is healthy while the last status POSTed to it by an external
+// system was a pass, and that status has not outlived its TTL.
+type PushHealthCheck struct {
+	Listen string
+	Path   string
+	TTL    time.Duration
+	Token  string
+	state  *pushState
+}
+
+type pushState struct {
+	sync.Mutex
+	healthy    bool
+	expires    time.Time
+	defaultTTL time.Duration
+	token      string
+	clock      clock.Clock
+}
+
+// validatePushConfig stops a push healthcheck listening beyond this host without a token,
+// as anyone who could reach it could then fail it and withdraw our routes.
+func validatePushConfig(name string, config map[string]interface{}) error {
+	listen := utils.GetAsString(config["listen"])
+	if listen == "" || strings.HasPrefix(listen, "unix:") || utils.GetAsString(config["token"]) != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil || !isLoopback(host) {
+		return errors.New(fmt.Sprintf("push healthcheck %s needs a token to listen on '%s', which is not a loopback address", name, listen))
+	}
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorized is true if the request has the token (if any) as a bearer token.
+func (s *pushState) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+	given := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(given, []byte("Bearer "+s.token)) == 1
+}
+
+type pushStatus struct {
+	Status string `json:"status"`
+	TTL    int    `json:"ttl"`
+}
+
+func (s *pushState) now() time.Time {
+	if s.clock == nil {
+		return clock.Real.Now()
+	}
+	return s.clock.Now()
+}
+
+func (s *pushState) set(healthy bool, ttl time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.healthy = healthy
+	s.expires = s.now().Add(ttl)
+}
+
+func (s *pushState) get() (bool, time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	return s.healthy, s.expires
+}
+
+func (h PushHealthCheck) Healthcheck() bool {
+	healthy, expires := h.state.get()
+	contextLogger := log.WithFields(logrus.Fields{
+		"listen":  h.Listen,
+		"path":    h.Path,
+		"expires": expires,
+	})
+	if h.state.now().After(expires) {
+		contextLogger.Debug("push healthcheck has not been updated within its ttl")
+		return false
+	}
+	if !healthy {
+		contextLogger.Debug("push healthcheck failed")
+		return false
+	}
+	contextLogger.Debug("push healthcheck OK")
+	return true
+}
+
+// Close stops this healthcheck receiving updates, shutting down the listener
+// once no other push healthchecks are using it.
+func (h PushHealthCheck) Close() error {
+	pushServersLock.Lock()
+	defer pushServersLock.Unlock()
+	s, ok := pushServers[h.Listen]
+	if !ok {
+		return nil
+	}
+	s.Lock()
+	delete(s.checks, h.Path)
+	remaining := len(s.checks)
+	s.Unlock()
+	if remaining > 0 {
+		return nil
+	}
+	delete(pushServers, h.Listen)
+	// Close the listener here rather than leaving it to Serve, which may not have started
+	// yet, and would then remove the socket of the next push healthcheck on this address.
+	s.listener.Close()
+	return s.server.Close()
+}
+
+// pushServer is shared by all push healthchecks which listen on the same address,
+// each of which is updated on its own path.
+type pushServer struct {
+	sync.Mutex
+	server   *http.Server
+	listener net.Listener
+	checks   map[string]*pushState
+}
+
+var (
+	pushServers     = make(map[string]*pushServer)
+	pushServersLock sync.Mutex
+)
+
+func (s *pushServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	state, ok := s.checks[r.URL.Path]
+	s.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	contextLogger := log.WithFields(logrus.Fields{
+		"path":   r.URL.Path,
+		"remote": r.RemoteAddr,
+	})
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		if !state.authorized(r) {
+			contextLogger.Warn("Push healthcheck update without the token")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		status, err := parsePushStatus(r)
+		if err != nil {
+			contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Info("Bad push healthcheck update")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ttl := state.defaultTTL
+		if status.TTL > 0 {
+			ttl = time.Duration(status.TTL) * time.Second
+		}
+		state.set(status.Status == "pass", ttl)
+		contextLogger.WithFields(logrus.Fields{"status": status.Status, "ttl": ttl}).Debug("Got push healthcheck update")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	healthy, expires := state.get()
+	resp := pushStatus{Status: "fail"}
+	if now := state.now(); healthy && now.Before(expires) {
+		resp.Status = "pass"
+		resp.TTL = int(expires.Sub(now).Seconds())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parsePushStatus reads an update either as a JSON body, or as form/query parameters,
+// e.g. curl -d status=pass -d ttl=30
+func parsePushStatus(r *http.Request) (pushStatus, error) {
+	var status pushStatus
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			return status, err
+		}
+	} else {
+		status.Status = r.FormValue("status")
+		if ttl := r.FormValue("ttl"); ttl != "" {
+			v, err := strconv.Atoi(ttl)
+			if err != nil {
+				return status, errors.New(fmt.Sprintf("ttl '%s' is not a number of seconds", ttl))
+			}
+			status.TTL = v
+		}
+	}
+	if status.Status != "pass" && status.Status != "fail" {
+		return status, errors.New(fmt.Sprintf("status must be 'pass' or 'fail', not '%s'", status.Status))
+	}
+	if status.TTL < 0 {
+		return status, errors.New("ttl cannot be negative")
+	}
+	return status, nil
+}
+
+func listenPush(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(strings.TrimPrefix(addr, "unix:"), "//")
+		os.Remove(path) // Stale socket from a previous run
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func registerPushHealthcheck(listen string, path string, state *pushState) error {
+	pushServersLock.Lock()
+	defer pushServersLock.Unlock()
+	s, ok := pushServers[listen]
+	if !ok {
+		l, err := listenPush(listen)
+		if err != nil {
+			return err
+		}
+		s = &pushServer{listener: l, checks: make(map[string]*pushState)}
+		s.server = &http.Server{Handler: s}
+		go s.server.Serve(l)
+		pushServers[listen] = s
+		log.WithFields(logrus.Fields{"listen": listen}).Info("Listening for push healthcheck updates")
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.checks[path]; ok {
+		return errors.New(fmt.Sprintf("push healthcheck path '%s' on '%s' is already in use", path, listen))
+	}
+	s.checks[path] = state
+	return nil
+}
+
+func PushConstructor(h Healthcheck) (HealthChecker, error) {
+	var result *multierror.Error
+	hc := PushHealthCheck{
+		Path: "/",
+		TTL:  30 * time.Second,
+	}
+	if val, ok := h.Config["listen"]; ok {
+		hc.Listen = utils.GetAsString(val)
+	} else {
+		result = multierror.Append(result, errors.New("'listen' not defined in push healthcheck config"))
+	}
+	if val, ok := h.Config["path"]; ok {
+		hc.Path = utils.GetAsString(val)
+		if !strings.HasPrefix(hc.Path, "/") {
+			hc.Path = "/" + hc.Path
+		}
+	}
+	if val, ok := h.Config["token"]; ok {
+		hc.Token = utils.GetAsString(val)
+	}
+	if val, ok := h.Config["ttl"]; ok {
+		ttl, err := utils.GetAsInt(val, 0)
+		if err != nil || ttl <= 0 {
+			result = multierror.Append(result, errors.New("'ttl' in push healthcheck config must be a positive number of seconds"))
+		}
+		hc.TTL = time.Duration(ttl) * time.Second
+	}
+	if err := result.ErrorOrNil(); err != nil {
+		return hc, err
+	}
+	hc.state = &pushState{defaultTTL: hc.TTL, token: hc.Token, clock: h.clock}
+	if err := registerPushHealthcheck(hc.Listen, hc.Path, hc.state); err != nil {
+		return hc, err
+	}
+	return hc, nil
+}
@@ -0,0 +1,190 @@
+package healthcheck
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/justenwalker/awsnycast/clock"
+	"github.com/justenwalker/awsnycast/testhelpers"
+)
+
+func getPushHealthcheck(t *testing.T) (*Healthcheck, *http.Client, func()) {
+	dir, err := ioutil.TempDir("", "awsnycast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "push.sock")
+	c := make(map[string]interface{})
+	c["listen"] = "unix:" + socket
+	c["path"] = "service"
+	c["ttl"] = 60
+	h := &Healthcheck{
+		Type:   "push",
+		Config: c,
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+	return h, client, func() {
+		if h, ok := h.healthchecker.(PushHealthCheck); ok {
+			h.Close()
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestHealthcheckPush(t *testing.T) {
+	h, client, cleanup := getPushHealthcheck(t)
+	defer cleanup()
+	if assert.Nil(t, h.Validate("foo", false)) {
+		if assert.Nil(t, h.Setup()) {
+			assert.Equal(t, h.healthchecker.Healthcheck(), false, "healthy before any update")
+
+			resp, err := client.PostForm("http://push/service", url.Values{"status": {"pass"}})
+			if assert.Nil(t, err) {
+				assert.Equal(t, resp.StatusCode, http.StatusOK)
+				body, _ := ioutil.ReadAll(resp.Body)
+				assert.Contains(t, string(body), `"status":"pass"`)
+				resp.Body.Close()
+			}
+			assert.Equal(t, h.healthchecker.Healthcheck(), true)
+			_, expires := h.healthchecker.(PushHealthCheck).state.get()
+			assert.WithinDuration(t, time.Now().Add(60*time.Second), expires, 5*time.Second)
+
+			resp, err = client.Post("http://push/service", "application/json", strings.NewReader(`{"status": "fail", "ttl": 10}`))
+			if assert.Nil(t, err) {
+				assert.Equal(t, resp.StatusCode, http.StatusOK)
+				resp.Body.Close()
+			}
+			assert.Equal(t, h.healthchecker.Healthcheck(), false)
+		}
+	}
+}
+
+func TestHealthcheckPushExpires(t *testing.T) {
+	h, _, cleanup := getPushHealthcheck(t)
+	defer cleanup()
+	c := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	h.SetClock(c)
+	assert.Nil(t, h.Validate("foo", false))
+	if assert.Nil(t, h.Setup()) {
+		state := h.healthchecker.(PushHealthCheck).state
+		state.set(true, time.Minute)
+		assert.Equal(t, h.healthchecker.Healthcheck(), true)
+		c.Advance(59 * time.Second)
+		assert.Equal(t, h.healthchecker.Healthcheck(), true)
+		c.Advance(2 * time.Second)
+		assert.Equal(t, h.healthchecker.Healthcheck(), false)
+	}
+}
+
+func TestHealthcheckPushSetupTwice(t *testing.T) {
+	h, client, cleanup := getPushHealthcheck(t)
+	defer cleanup()
+	assert.Nil(t, h.Validate("foo", false))
+	assert.Nil(t, h.Setup())
+	if assert.Nil(t, h.Setup()) {
+		resp, err := client.PostForm("http://push/service", url.Values{"status": {"pass"}})
+		if assert.Nil(t, err) {
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+			resp.Body.Close()
+		}
+		assert.Equal(t, h.healthchecker.Healthcheck(), true)
+	}
+}
+
+func TestHealthcheckPushBadUpdate(t *testing.T) {
+	h, client, cleanup := getPushHealthcheck(t)
+	defer cleanup()
+	assert.Nil(t, h.Validate("foo", false))
+	if assert.Nil(t, h.Setup()) {
+		resp, err := client.PostForm("http://push/service", url.Values{"status": {"maybe"}})
+		if assert.Nil(t, err) {
+			assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+			resp.Body.Close()
+		}
+		resp, err = client.PostForm("http://push/other", url.Values{"status": {"pass"}})
+		if assert.Nil(t, err) {
+			assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+			resp.Body.Close()
+		}
+		assert.Equal(t, h.healthchecker.Healthcheck(), false)
+	}
+}
+
+func TestHealthcheckPushPathInUse(t *testing.T) {
+	h, _, cleanup := getPushHealthcheck(t)
+	defer cleanup()
+	assert.Nil(t, h.Validate("foo", false))
+	if assert.Nil(t, h.Setup()) {
+		_, err := h.GetHealthChecker()
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "push healthcheck path '/service' on ")
+		}
+	}
+}
+
+func TestHealthcheckPushNoListen(t *testing.T) {
+	h := Healthcheck{Type: "push"}
+	assert.Nil(t, h.Validate("foo", false))
+	testhelpers.CheckOneMultiError(t, h.Setup(), "'listen' not defined in push healthcheck config")
+}
+
+func TestHealthcheckPushRemote(t *testing.T) {
+	h := Healthcheck{Type: "push"}
+	testhelpers.CheckOneMultiError(t, h.Validate("foo", true), "Remote healthcheck foo cannot be of type push")
+}
+
+func TestHealthcheckPushToken(t *testing.T) {
+	h, client, cleanup := getPushHealthcheck(t)
+	defer cleanup()
+	h.Config["token"] = "sekrit"
+	assert.Nil(t, h.Validate("foo", false))
+	if assert.Nil(t, h.Setup()) {
+		post := func(auth string) int {
+			req, _ := http.NewRequest("POST", "http://push/service", strings.NewReader("status=pass"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			resp, err := client.Do(req)
+			if !assert.Nil(t, err) {
+				return 0
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		assert.Equal(t, post(""), http.StatusUnauthorized)
+		assert.Equal(t, post("Bearer wrong"), http.StatusUnauthorized)
+		assert.Equal(t, h.healthchecker.Healthcheck(), false)
+		assert.Equal(t, post("Bearer sekrit"), http.StatusOK)
+		assert.Equal(t, h.healthchecker.Healthcheck(), true)
+	}
+}
+
+func TestHealthcheckPushNeedsToken(t *testing.T) {
+	for _, listen := range []string{"127.0.0.1:8080", "localhost:8080", "[::1]:8080", "unix:/run/awsnycast.sock"} {
+		h := Healthcheck{Type: "push", Config: map[string]interface{}{"listen": listen}}
+		assert.Nil(t, h.Validate("foo", false), listen)
+	}
+	for _, listen := range []string{"0.0.0.0:8080", ":8080", "10.0.0.5:8080"} {
+		h := Healthcheck{Type: "push", Config: map[string]interface{}{"listen": listen}}
+		testhelpers.CheckOneMultiError(t, h.Validate("foo", false), "push healthcheck foo needs a token to listen on '"+listen+"', which is not a loopback address")
+		h.Config["token"] = "sekrit"
+		assert.Nil(t, h.Validate("foo", false), listen)
+	}
+}
@@ -11,7 +11,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-multierror"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 
 	"github.com/justenwalker/awsnycast/utils"
 )
@@ -31,9 +31,9 @@ type TcpHealthCheck struct {
 	ServerName  string
 }
 
-func (h TcpHealthCheck) VerifyResponse(answer string, contextLogger *log.Entry) bool {
+func (h TcpHealthCheck) VerifyResponse(answer string, contextLogger *logrus.Entry) bool {
 
-	ansLogger := contextLogger.WithFields(log.Fields{
+	ansLogger := contextLogger.WithFields(logrus.Fields{
 		"answer": answer,
 		"expect": h.Expect,
 	})
@@ -47,7 +47,7 @@ func (h TcpHealthCheck) VerifyResponse(answer string, contextLogger *log.Entry)
 }
 
 func TLSHealthCheck(h TcpHealthCheck) bool {
-	contextLogger := log.WithFields(log.Fields{
+	contextLogger := log.WithFields(logrus.Fields{
 		"destination": h.Destination,
 		"port":        h.Port,
 		"tls":         h.TLS,
@@ -75,7 +75,7 @@ func TLSHealthCheck(h TcpHealthCheck) bool {
 	)
 
 	if err != nil {
-		contextLogger.WithFields(log.Fields{"err": err.Error()}).Info("Failed connecting")
+		contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Info("Failed connecting")
 		return false
 	}
 	defer c.Close()
@@ -93,7 +93,7 @@ func TLSHealthCheck(h TcpHealthCheck) bool {
 	n, err := c.Read(b)
 
 	if err != nil {
-		contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("Could not read response")
+		contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Debug("Could not read response")
 		return false
 	}
 
@@ -106,7 +106,7 @@ func (h TcpHealthCheck) Healthcheck() bool {
 		return TLSHealthCheck(h)
 	}
 
-	contextLogger := log.WithFields(log.Fields{
+	contextLogger := log.WithFields(logrus.Fields{
 		"destination": h.Destination,
 		"port":        h.Port,
 	})
@@ -118,7 +118,7 @@ func (h TcpHealthCheck) Healthcheck() bool {
 	)
 
 	if err != nil {
-		contextLogger.WithFields(log.Fields{"err": err.Error()}).Info("Failed connecting")
+		contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Info("Failed connecting")
 		return false
 	}
 	defer c.Close()
@@ -135,7 +135,7 @@ func (h TcpHealthCheck) Healthcheck() bool {
 	b := make([]byte, 1024)
 	n, err := c.Read(b)
 	if err != nil {
-		contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("Could not read response")
+		contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Debug("Could not read response")
 		return false
 	}
 
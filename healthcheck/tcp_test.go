@@ -10,7 +10,6 @@ import (
 	"testing"
 
 	"github.com/justenwalker/awsnycast/testhelpers"
-	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
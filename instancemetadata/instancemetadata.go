@@ -1,26 +1,98 @@
 package instancemetadata
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
-	log "github.com/sirupsen/logrus"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	smithylogging "github.com/aws/smithy-go/logging"
+	"github.com/sirupsen/logrus"
+
+	"github.com/justenwalker/awsnycast/logging"
 )
 
+var log = logging.For("instancemetadata")
+
 type MetadataFetcher interface {
 	Available() bool
 	GetMetadata(string) (string, error)
 }
 
+// Options control how we talk to the instance metadata service. There is no hop limit
+// option, as the hop limit for session token responses is the instance's
+// HttpPutResponseHopLimit, which has to be raised to 2 to use tokens from a container.
+type Options struct {
+	// Endpoint overrides the metadata service address, e.g. http://169.254.169.254
+	Endpoint string
+	// IPv6 uses the IPv6 metadata endpoint, when Endpoint isn't set
+	IPv6 bool
+	// Timeout for each metadata lookup, including fetching a session token
+	Timeout time.Duration
+	Debug   bool
+}
+
+// IMDSFetcher fetches metadata with IMDSv2 session tokens, so it works on instances
+// with HttpTokens=required. Tokens are cached, and fetched again when they expire or
+// the metadata service rejects them.
+type IMDSFetcher struct {
+	client  *imds.Client
+	timeout time.Duration
+}
+
+const defaultTimeout = 5 * time.Second
+
 func New(debug bool) MetadataFetcher {
-	sess := session.New()
-	if debug {
-		sess.Config.LogLevel = aws.LogLevel(aws.LogDebug)
+	return NewWithOptions(Options{Debug: debug})
+}
+
+func NewWithOptions(o Options) MetadataFetcher {
+	opts := imds.Options{Endpoint: o.Endpoint}
+	if o.IPv6 {
+		opts.EndpointMode = imds.EndpointModeStateIPv6
+	}
+	if o.Debug {
+		opts.ClientLogMode = aws.LogRequest | aws.LogResponse | aws.LogRetries
+		opts.Logger = smithylogging.LoggerFunc(func(c smithylogging.Classification, format string, v ...interface{}) {
+			log.Debugf(format, v...)
+		})
+	}
+	if o.Timeout == 0 {
+		o.Timeout = defaultTimeout
+	}
+	return &IMDSFetcher{
+		client:  imds.New(opts),
+		timeout: o.Timeout,
+	}
+}
+
+func (f *IMDSFetcher) Available() bool {
+	if _, err := f.GetMetadata("instance-id"); err != nil {
+		log.WithFields(logrus.Fields{"err": err.Error()}).Debug("Metadata service not available")
+		return false
+	}
+	return true
+}
+
+func (f *IMDSFetcher) GetMetadata(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	out, err := f.client.GetMetadata(ctx, &imds.GetMetadataInput{Path: path})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "", errors.New(fmt.Sprintf("%s (from a container, the instance's HttpPutResponseHopLimit needs to be at least 2)", err.Error()))
 	}
-	return ec2metadata.New(sess)
+	if err != nil {
+		return "", err
+	}
+	defer out.Content.Close()
+	b, err := ioutil.ReadAll(out.Content)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
 }
 
 type InstanceMetadata struct {
@@ -29,9 +101,24 @@ type InstanceMetadata struct {
 	AvailabilityZone string
 	Region           string
 	IPAddress        string
+	VPC              string
+	VPCCIDRs         []string
+	Interfaces       []NetworkInterface
+	Tags             map[string]string
 }
 
 func FetchMetadata(mdf MetadataFetcher) (InstanceMetadata, error) {
+	if s, ok := mdf.(Static); ok {
+		m := s.InstanceMetadata()
+		log.WithFields(logrus.Fields{
+			"subnet_id":   m.Subnet,
+			"instance_id": m.Instance,
+			"region":      m.Region,
+			"ip":          m.IPAddress,
+			"vpc_id":      m.VPC,
+		}).Info("Using static instance metadata")
+		return m, nil
+	}
 	m := InstanceMetadata{}
 	if !mdf.Available() {
 		return m, errors.New("No metadata service")
@@ -60,12 +147,30 @@ func FetchMetadata(mdf MetadataFetcher) (InstanceMetadata, error) {
 	}
 	m.Subnet = subnet
 
-	log.WithFields(log.Fields{
+	mac, err := mdf.GetMetadata("mac")
+	if err != nil {
+		return m, errors.New(fmt.Sprintf("Error getting metadata: %s", err.Error()))
+	}
+	m.VPC, m.VPCCIDRs, err = getVPC(mdf, mac)
+	if err != nil {
+		return m, errors.New(fmt.Sprintf("Error getting VPC: %s", err.Error()))
+	}
+	m.Interfaces, err = getInterfaces(mdf)
+	if err != nil {
+		return m, errors.New(fmt.Sprintf("Error getting network interfaces: %s", err.Error()))
+	}
+	m.Tags = getTags(mdf)
+
+	log.WithFields(logrus.Fields{
 		"subnet_id":         subnet,
 		"availability_zone": az,
 		"instance_id":       instanceId,
 		"region":            m.Region,
 		"ip":                m.IPAddress,
+		"vpc_id":            m.VPC,
+		"vpc_cidrs":         m.VPCCIDRs,
+		"interfaces":        len(m.Interfaces),
+		"tags":              len(m.Tags),
 	}).Info("Got instance metadata")
 
 	return m, nil
@@ -3,8 +3,12 @@ package instancemetadata
 import (
 	"errors"
 	"fmt"
-	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/justenwalker/awsnycast/testhelpers"
 )
 
 func TestNew(t *testing.T) {
@@ -40,6 +44,12 @@ func getFakeMetadataFetcher(a bool) MetadataFetcher {
 	fakeM.Meta["mac"] = "06:1d:ea:6f:8c:6e"
 	fakeM.Meta["local-ipv4"] = "127.0.0.1"
 	fakeM.Meta["network/interfaces/macs/06:1d:ea:6f:8c:6e/subnet-id"] = "subnet-28b0e940"
+	fakeM.Meta["network/interfaces/macs/06:1d:ea:6f:8c:6e/vpc-id"] = "vpc-9496cffc"
+	fakeM.Meta["network/interfaces/macs/06:1d:ea:6f:8c:6e/vpc-ipv4-cidr-blocks"] = "172.17.0.0/16"
+	fakeM.Meta["network/interfaces/macs/"] = "06:1d:ea:6f:8c:6e/"
+	fakeM.Meta["network/interfaces/macs/06:1d:ea:6f:8c:6e/interface-id"] = "eni-1234"
+	fakeM.Meta["network/interfaces/macs/06:1d:ea:6f:8c:6e/device-number"] = "0"
+	fakeM.Meta["network/interfaces/macs/06:1d:ea:6f:8c:6e/local-ipv4s"] = "127.0.0.1"
 	return fakeM
 }
 
@@ -101,3 +111,145 @@ func TestFetchMetadata(t *testing.T) {
 	assert.Equal(t, m.AvailabilityZone, "us-west-1a")
 	assert.Equal(t, m.Region, "us-west-1")
 }
+
+func getFakeIMDS() *testhelpers.FakeIMDS {
+	return testhelpers.NewFakeIMDS(getFakeMetadataFetcher(true).(FakeMetadataFetcher).Meta)
+}
+
+func TestIMDSFetcher(t *testing.T) {
+	imds := getFakeIMDS()
+	defer imds.Close()
+	mdf := NewWithOptions(Options{Endpoint: imds.URL, Timeout: time.Second})
+	assert.Equal(t, mdf.Available(), true)
+	m, err := FetchMetadata(mdf)
+	if assert.Nil(t, err) {
+		assert.Equal(t, m.Instance, "i-1234")
+		assert.Equal(t, m.Subnet, "subnet-28b0e940")
+		assert.Equal(t, m.IPAddress, "127.0.0.1")
+	}
+	// The session token is reused between requests
+	assert.Equal(t, imds.TokenCount, 1)
+}
+
+func TestIMDSFetcherTokenRefresh(t *testing.T) {
+	imds := getFakeIMDS()
+	defer imds.Close()
+	mdf := NewWithOptions(Options{Endpoint: imds.URL})
+	_, err := mdf.GetMetadata("instance-id")
+	assert.Nil(t, err)
+	imds.ExpireTokens()
+	v, err := mdf.GetMetadata("instance-id")
+	if assert.Nil(t, err) {
+		assert.Equal(t, v, "i-1234")
+	}
+	assert.Equal(t, imds.TokenCount, 2)
+}
+
+func TestIMDSFetcherMissingKey(t *testing.T) {
+	imds := getFakeIMDS()
+	defer imds.Close()
+	mdf := NewWithOptions(Options{Endpoint: imds.URL, Timeout: time.Second})
+	_, err := mdf.GetMetadata("nonexistent")
+	assert.NotNil(t, err)
+}
+
+func TestIMDSFetcherUnavailable(t *testing.T) {
+	imds := getFakeIMDS()
+	imds.Unavailable = true
+	defer imds.Close()
+	mdf := NewWithOptions(Options{Endpoint: imds.URL, Timeout: 100 * time.Millisecond})
+	assert.Equal(t, mdf.Available(), false)
+}
+
+func TestIMDSFetcherTokenTimeout(t *testing.T) {
+	imds := getFakeIMDS()
+	imds.DropTokens = true
+	defer imds.Close()
+	mdf := NewWithOptions(Options{Endpoint: imds.URL, Timeout: 100 * time.Millisecond})
+	_, err := mdf.GetMetadata("instance-id")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "HttpPutResponseHopLimit needs to be at least 2")
+	}
+}
+
+func TestStaticValidate(t *testing.T) {
+	s := Static{AvailabilityZone: "us-west-1a"}
+	assert.Nil(t, s.Validate())
+	assert.Equal(t, s.Region, "us-west-1")
+	s = Static{}
+	testhelpers.CheckOneMultiError(t, s.Validate(), "static metadata needs a region or availability_zone")
+	s = Static{Region: "us-west-1", IPAddress: "10.0.0.1"}
+	testhelpers.CheckOneMultiError(t, s.Validate(), "static metadata has a subnet_id or ip, but no instance_id")
+}
+
+func TestStaticGetMetadata(t *testing.T) {
+	s := Static{Instance: "i-1234", Region: "us-west-1"}
+	v, err := s.GetMetadata("instance-id")
+	assert.Nil(t, err)
+	assert.Equal(t, v, "i-1234")
+	_, err = s.GetMetadata("local-ipv4")
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Key local-ipv4 not set in static metadata")
+	}
+}
+
+func TestFetchMetadataStatic(t *testing.T) {
+	s := Static{Instance: "i-1234", Region: "us-west-1", Subnet: "subnet-28b0e940", IPAddress: "10.0.0.1", VPC: "vpc-1234"}
+	m, err := FetchMetadata(s)
+	assert.Nil(t, err)
+	assert.Equal(t, m, InstanceMetadata{
+		Instance:  "i-1234",
+		Region:    "us-west-1",
+		Subnet:    "subnet-28b0e940",
+		IPAddress: "10.0.0.1",
+		VPC:       "vpc-1234",
+	})
+}
+
+func TestFetchMetadataInterfacesAndTags(t *testing.T) {
+	mdf := getFakeMetadataFetcher(true).(FakeMetadataFetcher)
+	mdf.Meta["network/interfaces/macs/"] = "06:1d:ea:6f:8c:6f/\n06:1d:ea:6f:8c:6e/"
+	mdf.Meta["network/interfaces/macs/06:1d:ea:6f:8c:6e/vpc-ipv6-cidr-blocks"] = "2600:1f14::/56"
+	mdf.Meta["network/interfaces/macs/06:1d:ea:6f:8c:6f/interface-id"] = "eni-5678"
+	mdf.Meta["network/interfaces/macs/06:1d:ea:6f:8c:6f/device-number"] = "1"
+	mdf.Meta["network/interfaces/macs/06:1d:ea:6f:8c:6f/subnet-id"] = "subnet-5678"
+	mdf.Meta["network/interfaces/macs/06:1d:ea:6f:8c:6f/local-ipv4s"] = "172.17.1.5\n172.17.1.6"
+	mdf.Meta["network/interfaces/macs/06:1d:ea:6f:8c:6f/ipv6s"] = "2600:1f14::5"
+	mdf.Meta["tags/instance"] = "Name\ncluster"
+	mdf.Meta["tags/instance/Name"] = "router-a"
+	mdf.Meta["tags/instance/cluster"] = "edge"
+	m, err := FetchMetadata(mdf)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, m.VPC, "vpc-9496cffc")
+	assert.Equal(t, m.VPCCIDRs, []string{"172.17.0.0/16", "2600:1f14::/56"})
+	assert.Equal(t, m.Interfaces, []NetworkInterface{
+		{MAC: "06:1d:ea:6f:8c:6e", ID: "eni-1234", DeviceIndex: 0, Subnet: "subnet-28b0e940", PrivateIPs: []string{"127.0.0.1"}, IPv6Addresses: []string{}},
+		{MAC: "06:1d:ea:6f:8c:6f", ID: "eni-5678", DeviceIndex: 1, Subnet: "subnet-5678", PrivateIPs: []string{"172.17.1.5", "172.17.1.6"}, IPv6Addresses: []string{"2600:1f14::5"}},
+	})
+	assert.Equal(t, m.Tags, map[string]string{"Name": "router-a", "cluster": "edge"})
+	i, ok := m.Interface("1")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, i.ID, "eni-5678")
+	i, ok = m.Interface("eni-1234")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, i.DeviceIndex, 0)
+	_, ok = m.Interface("2")
+	assert.Equal(t, ok, false)
+}
+
+func TestFetchMetadataNoTags(t *testing.T) {
+	m, err := FetchMetadata(getFakeMetadataFetcher(true))
+	assert.Nil(t, err)
+	assert.Equal(t, m.Tags, map[string]string{})
+}
+
+func TestFetchMetadataInterfaceFail(t *testing.T) {
+	mdf := getFakeMetadataFetcher(true)
+	delete(mdf.(FakeMetadataFetcher).Meta, "network/interfaces/macs/06:1d:ea:6f:8c:6e/interface-id")
+	_, err := FetchMetadata(mdf)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Error getting network interfaces: interface 06:1d:ea:6f:8c:6e: Key network/interfaces/macs/06:1d:ea:6f:8c:6e/interface-id unknown")
+	}
+}
@@ -0,0 +1,124 @@
+package instancemetadata
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NetworkInterface is one of the ENIs attached to this instance.
+type NetworkInterface struct {
+	MAC           string
+	ID            string
+	DeviceIndex   int
+	Subnet        string
+	PrivateIPs    []string
+	IPv6Addresses []string
+}
+
+// Interface finds an attached ENI by its ID, or by its device index (e.g. "1" for eth1).
+func (m InstanceMetadata) Interface(idOrIndex string) (NetworkInterface, bool) {
+	for _, i := range m.Interfaces {
+		if i.ID == idOrIndex || strconv.Itoa(i.DeviceIndex) == idOrIndex {
+			return i, true
+		}
+	}
+	return NetworkInterface{}, false
+}
+
+// splitLines splits a metadata listing, dropping the trailing / on directory entries.
+func splitLines(s string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSuffix(strings.TrimSpace(line), "/")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func getInterfaces(mdf MetadataFetcher) ([]NetworkInterface, error) {
+	macs, err := mdf.GetMetadata("network/interfaces/macs/")
+	if err != nil {
+		return nil, err
+	}
+	interfaces := make([]NetworkInterface, 0)
+	for _, mac := range splitLines(macs) {
+		i, err := getInterface(mdf, mac)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("interface %s: %s", mac, err.Error()))
+		}
+		interfaces = append(interfaces, i)
+	}
+	sort.Slice(interfaces, func(a, b int) bool { return interfaces[a].DeviceIndex < interfaces[b].DeviceIndex })
+	return interfaces, nil
+}
+
+func getInterface(mdf MetadataFetcher, mac string) (NetworkInterface, error) {
+	i := NetworkInterface{MAC: mac}
+	prefix := fmt.Sprintf("network/interfaces/macs/%s/", mac)
+	id, err := mdf.GetMetadata(prefix + "interface-id")
+	if err != nil {
+		return i, err
+	}
+	i.ID = id
+	device, err := mdf.GetMetadata(prefix + "device-number")
+	if err != nil {
+		return i, err
+	}
+	if i.DeviceIndex, err = strconv.Atoi(device); err != nil {
+		return i, err
+	}
+	if i.Subnet, err = mdf.GetMetadata(prefix + "subnet-id"); err != nil {
+		return i, err
+	}
+	ips, err := mdf.GetMetadata(prefix + "local-ipv4s")
+	if err != nil {
+		return i, err
+	}
+	i.PrivateIPs = splitLines(ips)
+	// Only there if the interface has IPv6 addresses
+	ipv6s, _ := mdf.GetMetadata(prefix + "ipv6s")
+	i.IPv6Addresses = splitLines(ipv6s)
+	return i, nil
+}
+
+func getVPC(mdf MetadataFetcher, mac string) (string, []string, error) {
+	prefix := fmt.Sprintf("network/interfaces/macs/%s/", mac)
+	vpc, err := mdf.GetMetadata(prefix + "vpc-id")
+	if err != nil {
+		return "", nil, err
+	}
+	cidrs, err := mdf.GetMetadata(prefix + "vpc-ipv4-cidr-blocks")
+	if err != nil {
+		return "", nil, err
+	}
+	// Only there if the VPC has IPv6
+	ipv6Cidrs, _ := mdf.GetMetadata(prefix + "vpc-ipv6-cidr-blocks")
+	return vpc, append(splitLines(cidrs), splitLines(ipv6Cidrs)...), nil
+}
+
+// getTags reads the instance's tags, which are only in the metadata if the instance
+// has InstanceMetadataTags enabled.
+func getTags(mdf MetadataFetcher) map[string]string {
+	tags := make(map[string]string)
+	keys, err := mdf.GetMetadata("tags/instance")
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err.Error()}).Debug("No instance tags in metadata, InstanceMetadataTags may not be enabled")
+		return tags
+	}
+	for _, key := range splitLines(keys) {
+		value, err := mdf.GetMetadata("tags/instance/" + key)
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err.Error(), "key": key}).Warn("Error getting instance tag from metadata")
+			continue
+		}
+		tags[key] = value
+	}
+	return tags
+}
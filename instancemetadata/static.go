@@ -0,0 +1,73 @@
+package instancemetadata
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Static is metadata given in the config file or on the command line, for running
+// somewhere the metadata service can't be reached: a management host, a container
+// without IMDS access, or a test harness. Instance can be left out if AWSnycast isn't
+// running on an instance, in which case routes must name their instance explicitly.
+type Static struct {
+	Instance         string            `yaml:"instance_id"`
+	Region           string            `yaml:"region"`
+	AvailabilityZone string            `yaml:"availability_zone"`
+	Subnet           string            `yaml:"subnet_id"`
+	IPAddress        string            `yaml:"ip"`
+	VPC              string            `yaml:"vpc_id"`
+	VPCCIDRs         []string          `yaml:"vpc_cidrs"`
+	Tags             map[string]string `yaml:"tags"`
+}
+
+func (s *Static) Validate() error {
+	var result *multierror.Error
+	if s.Region == "" {
+		if s.AvailabilityZone == "" {
+			result = multierror.Append(result, errors.New("static metadata needs a region or availability_zone"))
+		} else {
+			s.Region = s.AvailabilityZone[:len(s.AvailabilityZone)-1]
+		}
+	}
+	if s.Instance == "" && (s.Subnet != "" || s.IPAddress != "") {
+		result = multierror.Append(result, errors.New("static metadata has a subnet_id or ip, but no instance_id"))
+	}
+	return result.ErrorOrNil()
+}
+
+func (s Static) Available() bool {
+	return true
+}
+
+func (s Static) GetMetadata(key string) (string, error) {
+	var v string
+	switch key {
+	case "instance-id":
+		v = s.Instance
+	case "placement/availability-zone":
+		v = s.AvailabilityZone
+	case "placement/region":
+		v = s.Region
+	case "local-ipv4":
+		v = s.IPAddress
+	}
+	if v == "" {
+		return "", errors.New(fmt.Sprintf("Key %s not set in static metadata", key))
+	}
+	return v, nil
+}
+
+func (s Static) InstanceMetadata() InstanceMetadata {
+	return InstanceMetadata{
+		Subnet:           s.Subnet,
+		Instance:         s.Instance,
+		AvailabilityZone: s.AvailabilityZone,
+		Region:           s.Region,
+		IPAddress:        s.IPAddress,
+		VPC:              s.VPC,
+		VPCCIDRs:         s.VPCCIDRs,
+		Tags:             s.Tags,
+	}
+}
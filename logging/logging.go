@@ -0,0 +1,183 @@
+// Package logging sets up where logs go and in what format, and gives each part of
+// AWSnycast (healthcheck, aws, daemon...) its own logger, so that each can have its own
+// level. Every entry from a subsystem's logger has a subsystem field naming it.
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Config is the top level log_* keys of the config file.
+type Config struct {
+	Format string            `yaml:"log_format"`
+	File   *FileConfig       `yaml:"log_file"`
+	Syslog string            `yaml:"log_syslog"`
+	Levels map[string]string `yaml:"log_levels"`
+	// LocalSyslog also sends logs to the local syslog daemon (the -syslog flag).
+	LocalSyslog bool `yaml:"-"`
+}
+
+// FileConfig logs to a file instead of stderr, rotating it once it gets to MaxSize
+// megabytes and keeping MaxBackups old files for up to MaxAge days.
+type FileConfig struct {
+	Path       string `yaml:"path"`
+	MaxSize    int    `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
+	MaxAge     int    `yaml:"max_age"`
+	Compress   bool   `yaml:"compress"`
+}
+
+func (c *Config) Validate() error {
+	var result *multierror.Error
+	if c.Format == "" {
+		c.Format = "text"
+	}
+	if c.Format != "text" && c.Format != "json" {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("log_format '%s' is not text or json", c.Format)))
+	}
+	if c.File != nil {
+		if c.File.Path == "" {
+			result = multierror.Append(result, errors.New("log_file needs a path"))
+		}
+		if c.File.MaxSize < 0 || c.File.MaxBackups < 0 || c.File.MaxAge < 0 {
+			result = multierror.Append(result, errors.New("log_file max_size, max_backups and max_age cannot be negative"))
+		}
+		if c.File.MaxSize == 0 {
+			c.File.MaxSize = 100
+		}
+	}
+	if c.Syslog != "" {
+		if _, _, err := parseSyslogURL(c.Syslog); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	names := make([]string, 0, len(c.Levels))
+	for name := range c.Levels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := logrus.ParseLevel(c.Levels[name]); err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("log_levels %s: '%s' is not a log level", name, c.Levels[name])))
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+var (
+	mu      sync.Mutex
+	loggers = make(map[string]*logrus.Logger)
+	closers = make([]io.Closer, 0)
+)
+
+// For is the logger for a subsystem, which is set up by Configure.
+func For(subsystem string) *logrus.Entry {
+	mu.Lock()
+	defer mu.Unlock()
+	l, ok := loggers[subsystem]
+	if !ok {
+		l = logrus.New()
+		loggers[subsystem] = l
+	}
+	return l.WithField("subsystem", subsystem)
+}
+
+// Subsystems are the names log_levels can set the level for, as well as default.
+func Subsystems() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(loggers))
+	for name := range loggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Configure sends every logger's output where c says, in its format and at its levels
+// (the default level is for anything log_levels doesn't name). debug turns everything up
+// to debug, whatever the levels say.
+func Configure(c Config, debug bool) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for name := range c.Levels {
+		if _, ok := loggers[name]; !ok && name != "default" {
+			return errors.New(fmt.Sprintf("log_levels %s: no such subsystem", name))
+		}
+	}
+
+	var formatter logrus.Formatter = &logrus.TextFormatter{}
+	if c.Format == "json" {
+		formatter = &logrus.JSONFormatter{}
+	}
+	var out io.Writer = os.Stderr
+	for _, closer := range closers {
+		closer.Close()
+	}
+	closers = closers[:0]
+	if c.File != nil {
+		file := &lumberjack.Logger{
+			Filename:   c.File.Path,
+			MaxSize:    c.File.MaxSize,
+			MaxBackups: c.File.MaxBackups,
+			MaxAge:     c.File.MaxAge,
+			Compress:   c.File.Compress,
+		}
+		closers = append(closers, file)
+		out = file
+	}
+	hooks := make(logrus.LevelHooks)
+	if c.Syslog != "" {
+		hook, err := newSyslogHook(c.Syslog, formatter)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, hook)
+		hooks.Add(hook)
+	}
+	if c.LocalSyslog {
+		hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, "awsnycast")
+		if err != nil {
+			return errors.New(fmt.Sprintf("Could not connect to local syslog: %s", err.Error()))
+		}
+		hooks.Add(hook)
+	}
+
+	level := func(name string) logrus.Level {
+		if debug {
+			return logrus.DebugLevel
+		}
+		for _, n := range []string{name, "default"} {
+			if l, ok := c.Levels[n]; ok {
+				parsed, _ := logrus.ParseLevel(l)
+				return parsed
+			}
+		}
+		return logrus.InfoLevel
+	}
+	apply := func(l *logrus.Logger, name string) {
+		l.SetOutput(out)
+		l.SetFormatter(formatter)
+		l.SetLevel(level(name))
+		l.ReplaceHooks(hooks)
+	}
+	apply(logrus.StandardLogger(), "default")
+	for name, l := range loggers {
+		apply(l, name)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateDefaults(t *testing.T) {
+	c := &Config{File: &FileConfig{Path: "/var/log/awsnycast.log"}}
+	assert.Nil(t, c.Validate())
+	assert.Equal(t, c.Format, "text")
+	assert.Equal(t, c.File.MaxSize, 100)
+}
+
+func TestValidateFails(t *testing.T) {
+	c := &Config{
+		Format: "xml",
+		File:   &FileConfig{MaxAge: -1},
+		Syslog: "syslog.example.com:514",
+		Levels: map[string]string{"aws": "loud"},
+	}
+	err := c.Validate()
+	if assert.NotNil(t, err) {
+		errs := err.(*multierror.Error).Errors
+		assert.Equal(t, len(errs), 5)
+		assert.Equal(t, errs[0].Error(), "log_format 'xml' is not text or json")
+		assert.Equal(t, errs[3].Error(), "log_syslog 'syslog.example.com:514' is not a udp:// or tcp:// URL")
+		assert.Equal(t, errs[4].Error(), "log_levels aws: 'loud' is not a log level")
+	}
+}
+
+func TestParseSyslogURL(t *testing.T) {
+	network, address, err := parseSyslogURL("udp://syslog.example.com")
+	if assert.Nil(t, err) {
+		assert.Equal(t, network, "udp")
+		assert.Equal(t, address, "syslog.example.com:514")
+	}
+	network, address, err = parseSyslogURL("tcp://10.0.0.1:1514")
+	if assert.Nil(t, err) {
+		assert.Equal(t, network, "tcp")
+		assert.Equal(t, address, "10.0.0.1:1514")
+	}
+}
+
+func TestConfigureUnknownSubsystem(t *testing.T) {
+	err := Configure(Config{Levels: map[string]string{"nosuchthing": "debug"}}, false)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "log_levels nosuchthing: no such subsystem")
+	}
+}
+
+func TestConfigureJSONFileAndLevels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awsnycast-logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "awsnycast.log")
+	quiet := For("test-quiet")
+	loud := For("test-loud")
+	err = Configure(Config{
+		Format: "json",
+		File:   &FileConfig{Path: path},
+		Levels: map[string]string{"default": "warning", "test-loud": "debug"},
+	}, false)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer Configure(Config{}, false)
+	quiet.Info("not logged")
+	loud.WithFields(logrus.Fields{"route": "0.0.0.0/0"}).Debug("logged")
+	quiet.Warn("also logged")
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Equal(t, len(lines), 2) {
+		var entry map[string]interface{}
+		if assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry)) {
+			assert.Equal(t, entry["subsystem"], "test-loud")
+			assert.Equal(t, entry["level"], "debug")
+			assert.Equal(t, entry["route"], "0.0.0.0/0")
+			assert.Equal(t, entry["msg"], "logged")
+		}
+		if assert.Nil(t, json.Unmarshal([]byte(lines[1]), &entry)) {
+			assert.Equal(t, entry["subsystem"], "test-quiet")
+			assert.Equal(t, entry["level"], "warning")
+		}
+	}
+}
+
+func TestConfigureDebugOverridesLevels(t *testing.T) {
+	l := For("test-debug")
+	assert.Nil(t, Configure(Config{Levels: map[string]string{"test-debug": "error"}}, true))
+	defer Configure(Config{}, false)
+	assert.Equal(t, l.Logger.GetLevel(), logrus.DebugLevel)
+	assert.Contains(t, Subsystems(), "test-debug")
+}
+
+var rfc5424 = regexp.MustCompile(`^<(\d+)>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z \S+ awsnycast \d+ (\S+) - (.*)$`)
+
+func TestSyslogHookUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	hook, err := newSyslogHook("udp://"+conn.LocalAddr().String(), &logrus.JSONFormatter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Close()
+	l := logrus.New()
+	l.SetOutput(ioutil.Discard)
+	l.AddHook(hook)
+	l.WithField("subsystem", "healthcheck").Warn("down")
+
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := rfc5424.FindStringSubmatch(string(buf[:n]))
+	if assert.NotNil(t, m, string(buf[:n])) {
+		assert.Equal(t, m[1], "28") // daemon (3) * 8 + warning (4)
+		assert.Equal(t, m[2], "healthcheck")
+		var entry map[string]interface{}
+		if assert.Nil(t, json.Unmarshal([]byte(m[3]), &entry)) {
+			assert.Equal(t, entry["msg"], "down")
+		}
+	}
+}
+
+func TestSyslogHookTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	hook, err := newSyslogHook("tcp://"+l.Addr().String(), &logrus.TextFormatter{DisableTimestamp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Close()
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logger.AddHook(hook)
+	logger.Error("one")
+	logger.Info("two")
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, want := range []struct{ pri, msg string }{{"27", "one"}, {"30", "two"}} {
+		var length int
+		if _, err := fmt.Fscanf(r, "%d ", &length); err != nil {
+			t.Fatal(err)
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			t.Fatal(err)
+		}
+		m := rfc5424.FindStringSubmatch(string(frame))
+		if assert.NotNil(t, m, string(frame)) {
+			assert.Equal(t, m[1], want.pri)
+			assert.Equal(t, m[2], "-")
+			assert.Contains(t, m[3], "msg="+want.msg)
+		}
+	}
+}
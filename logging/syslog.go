@@ -0,0 +1,137 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// facilityDaemon is the syslog facility logs are sent with.
+const facilityDaemon = 3
+
+func parseSyslogURL(raw string) (string, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return "", "", errors.New(fmt.Sprintf("log_syslog '%s' is not a udp:// or tcp:// URL", raw))
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "514")
+	}
+	return u.Scheme, host, nil
+}
+
+// syslogHook sends entries to a remote syslog server as RFC5424 messages: one per
+// datagram over UDP, or octet counted (RFC6587) over TCP. The connection is made again
+// if it breaks.
+type syslogHook struct {
+	network   string
+	address   string
+	formatter logrus.Formatter
+	hostname  string
+	pid       int
+
+	sync.Mutex
+	conn net.Conn
+}
+
+func newSyslogHook(raw string, formatter logrus.Formatter) (*syslogHook, error) {
+	network, address, err := parseSyslogURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &syslogHook{
+		network:   network,
+		address:   address,
+		formatter: formatter,
+		hostname:  hostname,
+		pid:       os.Getpid(),
+	}, nil
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func severity(l logrus.Level) int {
+	switch l {
+	case logrus.PanicLevel:
+		return 0
+	case logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	}
+	return 7
+}
+
+// message is an entry as RFC5424: the subsystem is the MSGID, and the entry formatted as
+// text or JSON is the MSG.
+func (h *syslogHook) message(e *logrus.Entry) ([]byte, error) {
+	body, err := h.formatter.Format(e)
+	if err != nil {
+		return nil, err
+	}
+	msgid := "-"
+	if s, ok := e.Data["subsystem"].(string); ok && s != "" {
+		msgid = s
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s awsnycast %d %s - %s",
+		facilityDaemon*8+severity(e.Level),
+		e.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		h.hostname, h.pid, msgid, strings.TrimRight(string(body), "\n"))
+	if h.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	return []byte(msg), nil
+}
+
+func (h *syslogHook) Fire(e *logrus.Entry) error {
+	msg, err := h.message(e)
+	if err != nil {
+		return err
+	}
+	h.Lock()
+	defer h.Unlock()
+	// Try again once on a new connection, in case the old one has gone away
+	for attempt := 0; attempt < 2; attempt++ {
+		if h.conn == nil {
+			if h.conn, err = net.DialTimeout(h.network, h.address, 5*time.Second); err != nil {
+				return err
+			}
+		}
+		h.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err = h.conn.Write(msg); err == nil {
+			return nil
+		}
+		h.conn.Close()
+		h.conn = nil
+	}
+	return err
+}
+
+func (h *syslogHook) Close() error {
+	h.Lock()
+	defer h.Unlock()
+	if h.conn == nil {
+		return nil
+	}
+	err := h.conn.Close()
+	h.conn = nil
+	return err
+}
@@ -4,14 +4,13 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log/syslog"
 	"os"
 	"os/signal"
-
-	log "github.com/sirupsen/logrus"
-	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
+	"syscall"
+	"time"
 
 	"github.com/justenwalker/awsnycast/daemon"
+	"github.com/justenwalker/awsnycast/instancemetadata"
 )
 
 var (
@@ -21,8 +20,25 @@ var (
 	noop         = flag.Bool("noop", false, "Don't actually *do* anything, just print what would be done")
 	printVersion = flag.Bool("version", false, "Print the version number")
 	logToSyslog  = flag.Bool("syslog", false, "Log to syslog")
+
+	metadataEndpoint = flag.String("metadata-endpoint", "", "Instance metadata service endpoint, e.g. http://169.254.169.254")
+	metadataIPv6     = flag.Bool("metadata-ipv6", false, "Use the IPv6 instance metadata service endpoint")
+	metadataTimeout  = flag.Duration("metadata-timeout", 5*time.Second, "Timeout for each instance metadata lookup")
+
+	startupAttempts = flag.Int("startup-attempts", 8, "Times to try fetching instance metadata, AWS credentials and the router check at startup")
+	startupBackoff  = flag.Duration("startup-backoff", time.Second, "Wait before the first startup retry, doubling (up to 30s) after each")
+
+	staticInstance = flag.String("instance-id", "", "Static metadata: this instance's ID, instead of asking the metadata service")
+	staticRegion   = flag.String("region", "", "Static metadata: the AWS region, instead of asking the metadata service")
+	staticAZ       = flag.String("availability-zone", "", "Static metadata: this instance's availability zone")
+	staticSubnet   = flag.String("subnet-id", "", "Static metadata: this instance's subnet ID")
+	staticIP       = flag.String("ip", "", "Static metadata: this instance's primary IP address")
+	staticVPC      = flag.String("vpc-id", "", "Static metadata: the VPC ID")
 )
 
+// stopSignals make the daemon clean up and exit: SIGTERM is what systemd sends on stop.
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
 // goreleaser build options
 var (
 	version string
@@ -39,18 +55,27 @@ func main() {
 	}
 	d := new(daemon.Daemon)
 	d.Version = version
-	if *debug {
-		log.SetLevel(log.DebugLevel)
-	}
-	if *logToSyslog {
-		hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_INFO, "")
-		if err == nil {
-			log.AddHook(hook)
-		}
-	}
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := signal.NotifyContext(context.Background(), stopSignals...)
 	defer cancel()
 	d.Debug = *debug
+	d.LocalSyslog = *logToSyslog
 	d.ConfigFile = *f
+	d.StartupAttempts = *startupAttempts
+	d.StartupBackoff = *startupBackoff
+	d.MetadataOptions = instancemetadata.Options{
+		Endpoint: *metadataEndpoint,
+		IPv6:     *metadataIPv6,
+		Timeout:  *metadataTimeout,
+	}
+	if *staticInstance != "" || *staticRegion != "" || *staticAZ != "" {
+		d.StaticMetadata = &instancemetadata.Static{
+			Instance:         *staticInstance,
+			Region:           *staticRegion,
+			AvailabilityZone: *staticAZ,
+			Subnet:           *staticSubnet,
+			IPAddress:        *staticIP,
+			VPC:              *staticVPC,
+		}
+	}
 	os.Exit(d.Run(ctx, *oneshot, *noop))
 }
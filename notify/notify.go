@@ -0,0 +1,321 @@
+// Package notify sends webhooks when healthchecks change state and when routes are
+// changed. Each webhook has its own queue, so a slow or broken endpoint delays only its
+// own notifications, never route changes; when its queue is full, events are dropped.
+package notify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+
+	"github.com/justenwalker/awsnycast/aws"
+	"github.com/justenwalker/awsnycast/clock"
+	"github.com/justenwalker/awsnycast/logging"
+)
+
+var log = logging.For("notify")
+
+// Event types, which webhooks can choose between with events.
+const (
+	HealthcheckHealthy   = "healthcheck_healthy"
+	HealthcheckUnhealthy = "healthcheck_unhealthy"
+	RouteCreate          = "route_create"
+	RouteReplace         = "route_replace"
+	RouteDelete          = "route_delete"
+)
+
+var eventTypes = []string{HealthcheckHealthy, HealthcheckUnhealthy, RouteCreate, RouteReplace, RouteDelete}
+
+const pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// maxBackoff is the longest we wait between attempts to send a webhook.
+const maxBackoff = 30 * time.Second
+
+// Webhook is one target under the top level 'notifications' key.
+type Webhook struct {
+	URL        string            `yaml:"url"`
+	Format     string            `yaml:"format"`
+	RoutingKey string            `yaml:"routing_key"`
+	Headers    map[string]string `yaml:"headers"`
+	Events     []string          `yaml:"events"`
+	Timeout    float64           `yaml:"timeout"`
+	Retries    int               `yaml:"retries"`
+	QueueSize  int               `yaml:"queue_size"`
+}
+
+func (w *Webhook) Validate(name string) error {
+	var result *multierror.Error
+	if w.Format == "" {
+		w.Format = "json"
+	}
+	switch w.Format {
+	case "json", "slack":
+	case "pagerduty":
+		if w.URL == "" {
+			w.URL = pagerDutyURL
+		}
+		if w.RoutingKey == "" {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("notification %s needs a routing_key for pagerduty", name)))
+		}
+	default:
+		result = multierror.Append(result, errors.New(fmt.Sprintf("notification %s format '%s' is not json, slack or pagerduty", name, w.Format)))
+	}
+	if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("notification %s url '%s' is not an http or https URL", name, w.URL)))
+	}
+	if len(w.Events) == 0 {
+		w.Events = eventTypes
+	}
+	for _, e := range w.Events {
+		known := false
+		for _, t := range eventTypes {
+			known = known || e == t
+		}
+		if !known {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("notification %s has unknown event '%s'", name, e)))
+		}
+	}
+	if w.Timeout < 0 || w.Retries < 0 || w.QueueSize < 0 {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("notification %s timeout, retries and queue_size cannot be negative", name)))
+	}
+	if w.Timeout == 0 {
+		w.Timeout = 5
+	}
+	if w.Retries == 0 {
+		w.Retries = 3
+	}
+	if w.QueueSize == 0 {
+		w.QueueSize = 100
+	}
+	return result.ErrorOrNil()
+}
+
+// Event is something that happened, which is sent as is by json webhooks.
+type Event struct {
+	Type           string    `json:"type"`
+	Time           time.Time `json:"time"`
+	Instance       string    `json:"instance"`
+	Summary        string    `json:"summary"`
+	Healthcheck    string    `json:"healthcheck,omitempty"`
+	Destination    string    `json:"destination,omitempty"`
+	RouteTable     string    `json:"route_table,omitempty"`
+	Cidr           string    `json:"cidr,omitempty"`
+	PreviousTarget string    `json:"previous_target,omitempty"`
+	NewTarget      string    `json:"new_target,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+}
+
+// Notifier sends events to webhooks. It is told about healthchecks changing state as a
+// healthcheck.Notifier, and about route changes as an aws.RouteNotifier.
+type Notifier struct {
+	instance string
+	clock    clock.Clock
+	targets  []*target
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+type target struct {
+	name    string
+	webhook Webhook
+	events  map[string]bool
+	client  *http.Client
+	clock   clock.Clock
+	queue   chan Event
+	quit    chan bool
+	done    chan bool
+}
+
+// New starts sending to each (validated) webhook, saying events come from instance.
+func New(webhooks map[string]*Webhook, instance string, c clock.Clock) *Notifier {
+	n := &Notifier{instance: instance, clock: c}
+	names := make([]string, 0, len(webhooks))
+	for name := range webhooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w := webhooks[name]
+		t := &target{
+			name:    name,
+			webhook: *w,
+			events:  make(map[string]bool),
+			client:  &http.Client{Timeout: time.Duration(w.Timeout * float64(time.Second))},
+			clock:   c,
+			queue:   make(chan Event, w.QueueSize),
+			quit:    make(chan bool),
+			done:    make(chan bool),
+		}
+		for _, e := range w.Events {
+			t.events[e] = true
+		}
+		n.targets = append(n.targets, t)
+		go t.run()
+	}
+	return n
+}
+
+// Stop gives up retrying, sends whatever is queued (once), and waits for that to finish.
+func (n *Notifier) Stop() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	n.mu.Unlock()
+	for _, t := range n.targets {
+		close(t.quit)
+		close(t.queue)
+	}
+	for _, t := range n.targets {
+		<-t.done
+	}
+}
+
+// Send queues an event for each webhook which wants it. It never blocks: if a webhook's
+// queue is full, the event is dropped for that webhook.
+func (n *Notifier) Send(e Event) {
+	e.Time = n.clock.Now().UTC()
+	e.Instance = n.instance
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return
+	}
+	for _, t := range n.targets {
+		if !t.events[e.Type] {
+			continue
+		}
+		select {
+		case t.queue <- e:
+		default:
+			log.WithFields(logrus.Fields{"notification": t.name, "type": e.Type}).Warn("Notification queue is full, dropping event")
+		}
+	}
+}
+
+func (n *Notifier) HealthcheckChanged(name string, destination string, healthy bool) {
+	e := Event{Type: HealthcheckUnhealthy, Healthcheck: name, Destination: destination}
+	state := "unhealthy"
+	if healthy {
+		e.Type = HealthcheckHealthy
+		state = "healthy"
+	}
+	e.Summary = fmt.Sprintf("Healthcheck %s (%s) on %s is %s", name, destination, n.instance, state)
+	n.Send(e)
+}
+
+func (n *Notifier) RouteChanged(entry aws.AuditEntry) {
+	e := Event{
+		RouteTable:     entry.RouteTable,
+		Cidr:           entry.Cidr,
+		PreviousTarget: entry.PreviousTarget,
+		NewTarget:      entry.NewTarget,
+		Reason:         entry.Reason,
+	}
+	switch entry.Action {
+	case aws.ActionCreate:
+		e.Type = RouteCreate
+		e.Summary = fmt.Sprintf("%s created route %s in %s to %s (%s)", n.instance, e.Cidr, e.RouteTable, e.NewTarget, e.Reason)
+	case aws.ActionReplace:
+		e.Type = RouteReplace
+		e.Summary = fmt.Sprintf("%s replaced route %s in %s: %s -> %s (%s)", n.instance, e.Cidr, e.RouteTable, e.PreviousTarget, e.NewTarget, e.Reason)
+	case aws.ActionDelete:
+		e.Type = RouteDelete
+		e.Summary = fmt.Sprintf("%s deleted route %s in %s to %s (%s)", n.instance, e.Cidr, e.RouteTable, e.PreviousTarget, e.Reason)
+	default:
+		return
+	}
+	n.Send(e)
+}
+
+func (t *target) run() {
+	defer close(t.done)
+	for e := range t.queue {
+		t.deliver(e)
+	}
+}
+
+// permanentError is a response which sending again won't change.
+type permanentError struct {
+	status int
+}
+
+func (e permanentError) Error() string {
+	return fmt.Sprintf("webhook returned %d", e.status)
+}
+
+// deliver sends an event, retrying with exponential backoff until it has tried
+// retries more times, or Stop is called.
+func (t *target) deliver(e Event) {
+	contextLogger := log.WithFields(logrus.Fields{"notification": t.name, "type": e.Type})
+	body, err := payload(t.webhook, e)
+	if err != nil {
+		contextLogger.WithFields(logrus.Fields{"err": err.Error()}).Error("Could not make notification")
+		return
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := t.post(body)
+		if err == nil {
+			contextLogger.Debug("Sent notification")
+			return
+		}
+		contextLogger = contextLogger.WithFields(logrus.Fields{"err": err.Error(), "attempt": attempt + 1})
+		if _, ok := err.(permanentError); ok || attempt >= t.webhook.Retries {
+			contextLogger.Error("Could not send notification, giving up")
+			return
+		}
+		contextLogger.Warn("Could not send notification, will retry")
+		select {
+		case <-t.clock.After(backoff):
+		case <-t.quit:
+			contextLogger.Error("Stopping, so not retrying notification")
+			return
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (t *target) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, t.webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "awsnycast")
+	for k, v := range t.webhook.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return errors.New(fmt.Sprintf("webhook returned %d", resp.StatusCode))
+	}
+	return permanentError{resp.StatusCode}
+}
@@ -0,0 +1,296 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/justenwalker/awsnycast/aws"
+	"github.com/justenwalker/awsnycast/clock"
+)
+
+var start = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fakeHook is a webhook endpoint which answers with each of statuses in turn (then 200),
+// and can be held up until release is closed.
+type fakeHook struct {
+	*httptest.Server
+	sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	headers  []http.Header
+	received chan bool
+	release  chan bool
+}
+
+func newFakeHook(statuses ...int) *fakeHook {
+	f := &fakeHook{statuses: statuses, received: make(chan bool, 100)}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		f.Lock()
+		f.bodies = append(f.bodies, body)
+		f.headers = append(f.headers, r.Header)
+		status := http.StatusOK
+		if len(f.statuses) > 0 {
+			status, f.statuses = f.statuses[0], f.statuses[1:]
+		}
+		release := f.release
+		f.Unlock()
+		f.received <- true
+		if release != nil {
+			<-release
+		}
+		w.WriteHeader(status)
+	}))
+	return f
+}
+
+func (f *fakeHook) Bodies() [][]byte {
+	f.Lock()
+	defer f.Unlock()
+	return append([][]byte{}, f.bodies...)
+}
+
+func (f *fakeHook) wait(t *testing.T) {
+	select {
+	case <-f.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was never called")
+	}
+}
+
+func getNotifier(t *testing.T, c clock.Clock, webhooks map[string]*Webhook) *Notifier {
+	for name, w := range webhooks {
+		if err := w.Validate(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := New(webhooks, "i-1234", c)
+	t.Cleanup(n.Stop)
+	return n
+}
+
+// waitFor waits until the worker is sleeping before its next attempt.
+func waitFor(t *testing.T, c *clock.Fake) {
+	for i := 0; i < 500; i++ {
+		if c.Waiting() > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("never backed off")
+}
+
+func TestValidateDefaults(t *testing.T) {
+	w := &Webhook{URL: "https://hooks.example.com/awsnycast"}
+	assert.Nil(t, w.Validate("ops"))
+	assert.Equal(t, w.Format, "json")
+	assert.Equal(t, w.Events, eventTypes)
+	assert.Equal(t, w.Timeout, 5.0)
+	assert.Equal(t, w.Retries, 3)
+	assert.Equal(t, w.QueueSize, 100)
+
+	pd := &Webhook{Format: "pagerduty", RoutingKey: "abc"}
+	assert.Nil(t, pd.Validate("pager"))
+	assert.Equal(t, pd.URL, "https://events.pagerduty.com/v2/enqueue")
+}
+
+func TestValidateFails(t *testing.T) {
+	w := &Webhook{URL: "hooks.example.com", Format: "xml", Events: []string{"route_delete", "route_flap"}, Retries: -1}
+	err := w.Validate("ops")
+	if assert.NotNil(t, err) {
+		errs := err.(*multierror.Error).Errors
+		assert.Equal(t, len(errs), 4)
+		assert.Equal(t, errs[0].Error(), "notification ops format 'xml' is not json, slack or pagerduty")
+		assert.Equal(t, errs[1].Error(), "notification ops url 'hooks.example.com' is not an http or https URL")
+		assert.Equal(t, errs[2].Error(), "notification ops has unknown event 'route_flap'")
+	}
+	pd := &Webhook{Format: "pagerduty"}
+	err = pd.Validate("pager")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "notification pager needs a routing_key for pagerduty")
+	}
+}
+
+func TestSendJSON(t *testing.T) {
+	hook := newFakeHook()
+	defer hook.Close()
+	n := getNotifier(t, clock.NewFake(start), map[string]*Webhook{
+		"ops": {URL: hook.URL, Headers: map[string]string{"Authorization": "Bearer xyz"}},
+	})
+	n.RouteChanged(aws.AuditEntry{
+		RouteTable:     "rtb-1",
+		Cidr:           "0.0.0.0/0",
+		Action:         aws.ActionReplace,
+		PreviousTarget: "i-5678",
+		NewTarget:      "i-1234",
+		Reason:         aws.ReasonInstanceImpaired,
+	})
+	hook.wait(t)
+	var e Event
+	if assert.Nil(t, json.Unmarshal(hook.Bodies()[0], &e)) {
+		assert.Equal(t, e, Event{
+			Type:           RouteReplace,
+			Time:           start,
+			Instance:       "i-1234",
+			Summary:        "i-1234 replaced route 0.0.0.0/0 in rtb-1: i-5678 -> i-1234 (instance_impaired)",
+			RouteTable:     "rtb-1",
+			Cidr:           "0.0.0.0/0",
+			PreviousTarget: "i-5678",
+			NewTarget:      "i-1234",
+			Reason:         "instance_impaired",
+		})
+	}
+	assert.Equal(t, hook.headers[0].Get("Authorization"), "Bearer xyz")
+	assert.Equal(t, hook.headers[0].Get("Content-Type"), "application/json")
+}
+
+func TestSkipIsNotSent(t *testing.T) {
+	hook := newFakeHook()
+	defer hook.Close()
+	n := getNotifier(t, clock.NewFake(start), map[string]*Webhook{"ops": {URL: hook.URL}})
+	n.RouteChanged(aws.AuditEntry{Action: aws.ActionSkip})
+	n.Stop()
+	assert.Equal(t, len(hook.Bodies()), 0)
+}
+
+func TestPayloadSlack(t *testing.T) {
+	body, err := payload(Webhook{Format: "slack"}, Event{Summary: "Healthcheck service (127.0.0.1) on i-1234 is unhealthy"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, string(body), `{"text":"Healthcheck service (127.0.0.1) on i-1234 is unhealthy"}`)
+	}
+}
+
+func TestPayloadPagerDuty(t *testing.T) {
+	e := Event{Type: HealthcheckUnhealthy, Time: start, Instance: "i-1234", Summary: "down", Healthcheck: "service", Destination: "127.0.0.1"}
+	p := pagerDuty("abc", e)
+	assert.Equal(t, p.RoutingKey, "abc")
+	assert.Equal(t, p.EventAction, "trigger")
+	assert.Equal(t, p.DedupKey, "awsnycast/i-1234/healthcheck/service/127.0.0.1")
+	assert.Equal(t, p.Payload.Severity, "error")
+	assert.Equal(t, p.Payload.Source, "i-1234")
+	assert.Equal(t, p.Payload.Timestamp, "2016-01-01T00:00:00Z")
+
+	e.Type = HealthcheckHealthy
+	resolve := pagerDuty("abc", e)
+	assert.Equal(t, resolve.EventAction, "resolve")
+	assert.Equal(t, resolve.DedupKey, p.DedupKey)
+
+	route := pagerDuty("abc", Event{Type: RouteDelete, Cidr: "0.0.0.0/0"})
+	assert.Equal(t, route.EventAction, "trigger")
+	assert.Equal(t, route.DedupKey, "")
+	assert.Equal(t, route.Payload.Severity, "info")
+	assert.Equal(t, route.Payload.Component, "0.0.0.0/0")
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	hook := newFakeHook(http.StatusInternalServerError, http.StatusTooManyRequests)
+	defer hook.Close()
+	c := clock.NewFake(start)
+	n := getNotifier(t, c, map[string]*Webhook{"ops": {URL: hook.URL}})
+	n.HealthcheckChanged("service", "127.0.0.1", false)
+	hook.wait(t)
+	waitFor(t, c)
+	c.Advance(999 * time.Millisecond)
+	assert.Equal(t, len(hook.Bodies()), 1)
+	c.Advance(time.Millisecond)
+	hook.wait(t)
+	waitFor(t, c)
+	c.Advance(time.Second)
+	assert.Equal(t, len(hook.Bodies()), 2) // Backed off for 2s this time
+	c.Advance(time.Second)
+	hook.wait(t)
+	assert.Equal(t, len(hook.Bodies()), 3)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	hook := newFakeHook(http.StatusBadGateway, http.StatusBadGateway)
+	defer hook.Close()
+	c := clock.NewFake(start)
+	n := getNotifier(t, c, map[string]*Webhook{"ops": {URL: hook.URL, Retries: 1}})
+	n.HealthcheckChanged("service", "127.0.0.1", false)
+	hook.wait(t)
+	waitFor(t, c)
+	c.Advance(time.Second)
+	hook.wait(t)
+	n.Stop()
+	assert.Equal(t, len(hook.Bodies()), 2)
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	hook := newFakeHook(http.StatusBadRequest)
+	defer hook.Close()
+	c := clock.NewFake(start)
+	n := getNotifier(t, c, map[string]*Webhook{"ops": {URL: hook.URL}})
+	n.HealthcheckChanged("service", "127.0.0.1", false)
+	n.HealthcheckChanged("service", "127.0.0.1", true)
+	n.Stop()
+	assert.Equal(t, len(hook.Bodies()), 2)
+	assert.Equal(t, c.Waiting(), 0)
+}
+
+func TestQueueIsBounded(t *testing.T) {
+	hook := newFakeHook()
+	defer hook.Close()
+	hook.release = make(chan bool)
+	n := getNotifier(t, clock.NewFake(start), map[string]*Webhook{"ops": {URL: hook.URL, QueueSize: 1}})
+	n.HealthcheckChanged("service", "127.0.0.1", false)
+	hook.wait(t) // The worker is now stuck sending the first
+	sent := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			n.HealthcheckChanged("service", "127.0.0.1", i%2 == 0)
+		}
+		sent <- true
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending blocked on a slow webhook")
+	}
+	close(hook.release)
+	n.Stop()
+	// The one being sent, and the one which fitted in the queue
+	assert.Equal(t, len(hook.Bodies()), 2)
+}
+
+func TestEventFilters(t *testing.T) {
+	routes := newFakeHook()
+	defer routes.Close()
+	healthchecks := newFakeHook()
+	defer healthchecks.Close()
+	n := getNotifier(t, clock.NewFake(start), map[string]*Webhook{
+		"routes":       {URL: routes.URL, Events: []string{RouteDelete}},
+		"healthchecks": {URL: healthchecks.URL, Events: []string{HealthcheckUnhealthy, HealthcheckHealthy}, Format: "slack"},
+	})
+	n.HealthcheckChanged("service", "127.0.0.1", false)
+	n.RouteChanged(aws.AuditEntry{Action: aws.ActionCreate, Cidr: "0.0.0.0/0"})
+	n.RouteChanged(aws.AuditEntry{Action: aws.ActionDelete, Cidr: "0.0.0.0/0"})
+	n.Stop()
+	if assert.Equal(t, len(routes.Bodies()), 1) {
+		assert.Contains(t, string(routes.Bodies()[0]), `"type":"route_delete"`)
+	}
+	if assert.Equal(t, len(healthchecks.Bodies()), 1) {
+		assert.Contains(t, string(healthchecks.Bodies()[0]), "Healthcheck service (127.0.0.1) on i-1234 is unhealthy")
+	}
+}
+
+func TestStopAbandonsRetries(t *testing.T) {
+	hook := newFakeHook(http.StatusServiceUnavailable)
+	defer hook.Close()
+	c := clock.NewFake(start)
+	n := getNotifier(t, c, map[string]*Webhook{"ops": {URL: hook.URL}})
+	n.HealthcheckChanged("service", "127.0.0.1", false)
+	hook.wait(t)
+	waitFor(t, c)
+	n.Stop() // Would hang if it waited for the clock
+	n.HealthcheckChanged("service", "127.0.0.1", true)
+	assert.Equal(t, len(hook.Bodies()), 1)
+}
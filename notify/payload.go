@@ -0,0 +1,71 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// slackMessage is a Slack incoming webhook message.
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// pagerDutyEvent is a PagerDuty Events API v2 event.
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key,omitempty"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string `json:"summary"`
+	Source        string `json:"source"`
+	Severity      string `json:"severity"`
+	Timestamp     string `json:"timestamp"`
+	Component     string `json:"component,omitempty"`
+	Group         string `json:"group"`
+	Class         string `json:"class"`
+	CustomDetails Event  `json:"custom_details"`
+}
+
+// payload is what is sent to a webhook for an event, in the webhook's format.
+func payload(w Webhook, e Event) ([]byte, error) {
+	switch w.Format {
+	case "slack":
+		return json.Marshal(slackMessage{Text: e.Summary})
+	case "pagerduty":
+		return json.Marshal(pagerDuty(w.RoutingKey, e))
+	}
+	return json.Marshal(e)
+}
+
+// pagerDuty triggers an alert when a healthcheck fails, which is resolved when it passes
+// again. Route changes are informational alerts of their own.
+func pagerDuty(routingKey string, e Event) pagerDutyEvent {
+	p := pagerDutyEvent{
+		RoutingKey:  routingKey,
+		EventAction: "trigger",
+		Payload: &pagerDutyPayload{
+			Summary:       e.Summary,
+			Source:        e.Instance,
+			Severity:      "info",
+			Timestamp:     e.Time.Format(time.RFC3339),
+			Component:     e.Cidr,
+			Group:         "awsnycast",
+			Class:         e.Type,
+			CustomDetails: e,
+		},
+	}
+	switch e.Type {
+	case HealthcheckUnhealthy, HealthcheckHealthy:
+		p.DedupKey = fmt.Sprintf("awsnycast/%s/healthcheck/%s/%s", e.Instance, e.Healthcheck, e.Destination)
+		p.Payload.Component = e.Healthcheck
+		p.Payload.Severity = "error"
+		if e.Type == HealthcheckHealthy {
+			p.EventAction = "resolve"
+		}
+	}
+	return p
+}
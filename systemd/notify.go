@@ -0,0 +1,85 @@
+// Package systemd tells systemd how the daemon is getting on, with the sd_notify protocol:
+// when it is ready, a status line for systemctl status, and watchdog keep-alives.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notifier sends to the socket systemd gave us in NOTIFY_SOCKET. A nil Notifier (when
+// we weren't started by systemd with Type=notify) sends nothing.
+type Notifier struct {
+	addr     *net.UnixAddr
+	watchdog time.Duration
+}
+
+// New is a Notifier for the socket in NOTIFY_SOCKET, or nil if there isn't one.
+func New() *Notifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	return &Notifier{
+		addr:     &net.UnixAddr{Name: socket, Net: "unixgram"},
+		watchdog: watchdogInterval(),
+	}
+}
+
+// watchdogInterval is how often systemd needs to hear from us (WATCHDOG_USEC), if the
+// watchdog is meant for this process.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// WatchdogInterval is how often systemd needs a Watchdog ping, or 0 if it doesn't.
+func (n *Notifier) WatchdogInterval() time.Duration {
+	if n == nil {
+		return 0
+	}
+	return n.watchdog
+}
+
+// Notify sends one or more VARIABLE=value assignments, e.g. READY=1.
+func (n *Notifier) Notify(state ...string) error {
+	if n == nil {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(state, "\n")))
+	return err
+}
+
+// Ready tells systemd we've started up.
+func (n *Notifier) Ready(status string) error {
+	return n.Notify("READY=1", "STATUS="+status)
+}
+
+// Status sets the line shown by systemctl status.
+func (n *Notifier) Status(status string) error {
+	return n.Notify("STATUS=" + status)
+}
+
+// Watchdog tells systemd we're still making progress.
+func (n *Notifier) Watchdog(status string) error {
+	return n.Notify("WATCHDOG=1", "STATUS="+status)
+}
+
+// Stopping tells systemd we're shutting down.
+func (n *Notifier) Stopping() error {
+	return n.Notify("STOPPING=1")
+}
@@ -0,0 +1,76 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listen is a fake systemd notify socket, set as NOTIFY_SOCKET for the test.
+func listen(t *testing.T) *net.UnixConn {
+	addr := &net.UnixAddr{Name: filepath.Join(t.TempDir(), "notify"), Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", addr.Name)
+	t.Setenv("WATCHDOG_USEC", "")
+	t.Setenv("WATCHDOG_PID", "")
+	return conn
+}
+
+func read(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNoSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	n := New()
+	assert.Nil(t, n)
+	assert.Nil(t, n.Ready("Starting"))
+	assert.Equal(t, n.WatchdogInterval(), time.Duration(0))
+}
+
+func TestNotify(t *testing.T) {
+	conn := listen(t)
+	n := New()
+	if !assert.NotNil(t, n) {
+		return
+	}
+	assert.Nil(t, n.Ready("Owns 1 routes"))
+	assert.Equal(t, read(t, conn), "READY=1\nSTATUS=Owns 1 routes")
+	assert.Nil(t, n.Status("Owns 2 routes"))
+	assert.Equal(t, read(t, conn), "STATUS=Owns 2 routes")
+	assert.Nil(t, n.Watchdog("Owns 2 routes"))
+	assert.Equal(t, read(t, conn), "WATCHDOG=1\nSTATUS=Owns 2 routes")
+	assert.Nil(t, n.Stopping())
+	assert.Equal(t, read(t, conn), "STOPPING=1")
+}
+
+func TestNotifyNoListener(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	assert.NotNil(t, New().Ready("Starting"))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	listen(t)
+	assert.Equal(t, New().WatchdogInterval(), time.Duration(0))
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(t, New().WatchdogInterval(), 30*time.Second)
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(t, New().WatchdogInterval(), 30*time.Second)
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	assert.Equal(t, New().WatchdogInterval(), time.Duration(0))
+}
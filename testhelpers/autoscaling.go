@@ -0,0 +1,67 @@
+package testhelpers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// FakeAutoScaling is a stand-in for the Auto Scaling API, answering the calls AWSnycast
+// makes to complete lifecycle actions. Point the autoscaling endpoint config at it.
+type FakeAutoScaling struct {
+	*httptest.Server
+	Groups map[string]string // instance ID to group name
+
+	sync.Mutex
+	Completed []url.Values
+}
+
+func NewFakeAutoScaling(groups map[string]string) *FakeAutoScaling {
+	f := &FakeAutoScaling{Groups: groups}
+	f.Server = httptest.NewServer(f)
+	return f
+}
+
+// CompletedActions returns the CompleteLifecycleAction calls made so far.
+func (f *FakeAutoScaling) CompletedActions() []url.Values {
+	f.Lock()
+	defer f.Unlock()
+	return append([]url.Values{}, f.Completed...)
+}
+
+func (f *FakeAutoScaling) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	action := r.PostForm.Get("Action")
+	w.Header().Set("Content-Type", "text/xml")
+	switch action {
+	case "CompleteLifecycleAction":
+		f.Completed = append(f.Completed, r.PostForm)
+		fmt.Fprint(w, `<CompleteLifecycleActionResponse xmlns="http://autoscaling.amazonaws.com/doc/2011-01-01/">
+  <CompleteLifecycleActionResult/>
+  <ResponseMetadata><RequestId>fake</RequestId></ResponseMetadata>
+</CompleteLifecycleActionResponse>`)
+	case "DescribeAutoScalingInstances":
+		members := ""
+		for k, v := range r.PostForm {
+			if strings.HasPrefix(k, "InstanceIds.member.") {
+				if group, ok := f.Groups[v[0]]; ok {
+					members += fmt.Sprintf("<member><InstanceId>%s</InstanceId><AutoScalingGroupName>%s</AutoScalingGroupName></member>", v[0], group)
+				}
+			}
+		}
+		fmt.Fprintf(w, `<DescribeAutoScalingInstancesResponse xmlns="http://autoscaling.amazonaws.com/doc/2011-01-01/">
+  <DescribeAutoScalingInstancesResult><AutoScalingInstances>%s</AutoScalingInstances></DescribeAutoScalingInstancesResult>
+  <ResponseMetadata><RequestId>fake</RequestId></ResponseMetadata>
+</DescribeAutoScalingInstancesResponse>`, members)
+	default:
+		http.Error(w, fmt.Sprintf("unknown action %s", action), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,76 @@
+package testhelpers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// FakeIMDS is an instance metadata service which, like an instance with
+// HttpTokens=required, only answers requests carrying a valid IMDSv2 session token.
+type FakeIMDS struct {
+	*httptest.Server
+	Meta map[string]string
+
+	sync.Mutex
+	tokens      map[string]bool
+	TokenCount  int
+	Unavailable bool
+	// DropTokens never answers token requests, as when the response runs out of hops
+	// before reaching a container.
+	DropTokens bool
+}
+
+func NewFakeIMDS(meta map[string]string) *FakeIMDS {
+	f := &FakeIMDS{
+		Meta:   meta,
+		tokens: make(map[string]bool),
+	}
+	f.Server = httptest.NewServer(f)
+	return f
+}
+
+// ExpireTokens makes every token issued so far invalid, as if their TTL had passed.
+func (f *FakeIMDS) ExpireTokens() {
+	f.Lock()
+	defer f.Unlock()
+	f.tokens = make(map[string]bool)
+}
+
+func (f *FakeIMDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	if f.DropTokens && r.URL.Path == "/latest/api/token" {
+		f.Unlock()
+		<-r.Context().Done()
+		return
+	}
+	defer f.Unlock()
+	if f.Unavailable {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path == "/latest/api/token" {
+		if r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f.TokenCount++
+		token := fmt.Sprintf("token-%d", f.TokenCount)
+		f.tokens[token] = true
+		w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+		fmt.Fprint(w, token)
+		return
+	}
+	if !f.tokens[r.Header.Get("X-Aws-Ec2-Metadata-Token")] {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	v, ok := f.Meta[strings.TrimPrefix(r.URL.Path, "/latest/meta-data/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprint(w, v)
+}
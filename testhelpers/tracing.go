@@ -0,0 +1,92 @@
+package testhelpers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// RecordSpans sends spans to a recorder until the test ends, rather than nowhere.
+func RecordSpans(t testing.TB) *tracetest.SpanRecorder {
+	sr := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return sr
+}
+
+// FakeCollector is an OTLP/HTTP trace collector. Point the tracing endpoint config at it.
+type FakeCollector struct {
+	*httptest.Server
+
+	sync.Mutex
+	Requests []*collectortrace.ExportTraceServiceRequest
+}
+
+func NewFakeCollector() *FakeCollector {
+	f := &FakeCollector{}
+	f.Server = httptest.NewServer(f)
+	return f
+}
+
+func (f *FakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "unsupported", http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &collectortrace.ExportTraceServiceRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Lock()
+	f.Requests = append(f.Requests, req)
+	f.Unlock()
+	out, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(out)
+}
+
+// Spans returns every span received so far.
+func (f *FakeCollector) Spans() []*tracepb.Span {
+	f.Lock()
+	defer f.Unlock()
+	spans := make([]*tracepb.Span, 0)
+	for _, req := range f.Requests {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+// Resource returns the string attributes of the resource that sent the spans.
+func (f *FakeCollector) Resource() map[string]string {
+	f.Lock()
+	defer f.Unlock()
+	attrs := make(map[string]string)
+	for _, req := range f.Requests {
+		for _, rs := range req.ResourceSpans {
+			for _, kv := range rs.Resource.GetAttributes() {
+				attrs[kv.Key] = kv.Value.GetStringValue()
+			}
+		}
+	}
+	return attrs
+}
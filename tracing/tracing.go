@@ -0,0 +1,120 @@
+// Package tracing sends OpenTelemetry traces of what AWSnycast does (route table runs,
+// reevaluations after healthcheck changes, and EC2 API calls) to an OTLP collector, to
+// show where the time goes in a slow failover. Until Setup is called, spans go nowhere.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/justenwalker/awsnycast"
+
+// Attributes put on spans.
+const (
+	RouteTable  = attribute.Key("awsnycast.route_table")
+	Cidr        = attribute.Key("awsnycast.cidr")
+	Instance    = attribute.Key("awsnycast.instance")
+	Healthcheck = attribute.Key("awsnycast.healthcheck")
+	Healthy     = attribute.Key("awsnycast.healthcheck.healthy")
+	Type        = attribute.Key("awsnycast.healthcheck.type")
+	Destination = attribute.Key("awsnycast.healthcheck.destination")
+	Rise        = attribute.Key("awsnycast.healthcheck.rise")
+	Fall        = attribute.Key("awsnycast.healthcheck.fall")
+	Remote      = attribute.Key("awsnycast.healthcheck.remote")
+	Decision    = attribute.Key("awsnycast.decision")
+)
+
+// Config is the top level 'tracing' key: where to send traces (over OTLP/HTTP), with what
+// extra headers, and what fraction of traces to keep.
+type Config struct {
+	Endpoint    string            `yaml:"endpoint"`
+	Headers     map[string]string `yaml:"headers"`
+	SampleRatio float64           `yaml:"sample_ratio"`
+	ServiceName string            `yaml:"service_name"`
+}
+
+func (c *Config) Validate() error {
+	var result *multierror.Error
+	if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("tracing endpoint '%s' is not an http or https URL", c.Endpoint)))
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		result = multierror.Append(result, errors.New("tracing sample_ratio must be between 0 and 1"))
+	}
+	if c.SampleRatio == 0 {
+		c.SampleRatio = 1
+	}
+	if c.ServiceName == "" {
+		c.ServiceName = "awsnycast"
+	}
+	return result.ErrorOrNil()
+}
+
+// Setup starts sending spans where c says, describing where they come from with attrs
+// (e.g. the instance ID). The function it returns sends any spans not yet sent, and stops.
+func Setup(c Config, attrs ...attribute.KeyValue) (func(context.Context) error, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(c.Endpoint)
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	if len(c.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(c.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		append([]attribute.KeyValue{semconv.ServiceNameKey.String(c.ServiceName)}, attrs...)...))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span, as a child of any span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Record makes a span of something which has already happened, from start to end.
+func Record(ctx context.Context, name string, start time.Time, end time.Time, attrs ...attribute.KeyValue) {
+	_, span := otel.Tracer(instrumentation).Start(ctx, name, trace.WithTimestamp(start), trace.WithAttributes(attrs...))
+	span.End(trace.WithTimestamp(end))
+}
+
+// End ends a span, marking it as failed if err is set.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"github.com/justenwalker/awsnycast/testhelpers"
+)
+
+func TestValidateDefaults(t *testing.T) {
+	c := &Config{Endpoint: "http://localhost:4318"}
+	assert.Nil(t, c.Validate())
+	assert.Equal(t, c.SampleRatio, 1.0)
+	assert.Equal(t, c.ServiceName, "awsnycast")
+}
+
+func TestValidateFails(t *testing.T) {
+	c := &Config{Endpoint: "localhost:4318", SampleRatio: 2}
+	err := c.Validate()
+	if assert.NotNil(t, err) {
+		errs := err.(*multierror.Error).Errors
+		assert.Equal(t, len(errs), 2)
+		assert.Equal(t, errs[0].Error(), "tracing endpoint 'localhost:4318' is not an http or https URL")
+		assert.Equal(t, errs[1].Error(), "tracing sample_ratio must be between 0 and 1")
+	}
+}
+
+func TestStartAndEnd(t *testing.T) {
+	sr := testhelpers.RecordSpans(t)
+	ctx, parent := Start(context.Background(), "parent", Cidr.String("0.0.0.0/0"))
+	_, child := Start(ctx, "child")
+	End(child, errors.New("it broke"))
+	End(parent, nil)
+
+	spans := sr.Ended()
+	if assert.Equal(t, len(spans), 2) {
+		assert.Equal(t, spans[0].Name(), "child")
+		assert.Equal(t, spans[0].Parent().SpanID(), spans[1].SpanContext().SpanID())
+		assert.Equal(t, spans[0].Status().Code, codes.Error)
+		assert.Equal(t, spans[0].Status().Description, "it broke")
+		assert.Equal(t, spans[1].Status().Code, codes.Unset)
+		assert.Contains(t, spans[1].Attributes(), Cidr.String("0.0.0.0/0"))
+	}
+}
+
+func TestRecord(t *testing.T) {
+	sr := testhelpers.RecordSpans(t)
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	Record(context.Background(), "waited", start, start.Add(3*time.Second), Rise.Int(3))
+	spans := sr.Ended()
+	if assert.Equal(t, len(spans), 1) {
+		assert.Equal(t, spans[0].StartTime(), start)
+		assert.Equal(t, spans[0].EndTime().Sub(spans[0].StartTime()), 3*time.Second)
+		assert.Equal(t, spans[0].Attributes(), []attribute.KeyValue{Rise.Int(3)})
+	}
+}
+
+func TestSetupSendsToCollector(t *testing.T) {
+	collector := testhelpers.NewFakeCollector()
+	defer collector.Close()
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+
+	stop, err := Setup(Config{Endpoint: collector.URL}, attribute.String("host.id", "i-1234"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, span := Start(context.Background(), "RunRouteTables")
+	End(span, nil)
+	assert.Nil(t, stop(context.Background()))
+
+	spans := collector.Spans()
+	if assert.Equal(t, len(spans), 1) {
+		assert.Equal(t, spans[0].Name, "RunRouteTables")
+	}
+	assert.Equal(t, collector.Resource()["service.name"], "awsnycast")
+	assert.Equal(t, collector.Resource()["host.id"], "i-1234")
+}